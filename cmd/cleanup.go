@@ -16,10 +16,17 @@ limitations under the License.
 package cmd
 
 import (
-	"log/slog"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"os"
+	"slices"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/consul"
 	"github.com/ncode/tagit/pkg/tagit"
 	"github.com/spf13/cobra"
 )
@@ -29,45 +36,192 @@ var cleanupCmd = &cobra.Command{
 	Use:   "cleanup",
 	Short: "cleanup removes all services with the tag prefix from a given consul service",
 	Run: func(cmd *cobra.Command, args []string) {
-		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: slog.LevelInfo,
-		}))
+		logger := commandLogger(cmd)
 
-		config := api.DefaultConfig()
-		config.Address = cmd.InheritedFlags().Lookup("consul-addr").Value.String()
-		config.Token = cmd.InheritedFlags().Lookup("token").Value.String()
-
-		consulClient, err := api.NewClient(config)
+		consulClient, err := createConsulClient(cmd)
 		if err != nil {
 			logger.Error("Failed to create Consul client", "error", err)
 			os.Exit(1)
 		}
 
-		serviceID := cmd.InheritedFlags().Lookup("service-id").Value.String()
-		tagPrefix := cmd.InheritedFlags().Lookup("tag-prefix").Value.String()
+		serviceID, err := cmd.Flags().GetString("service-id")
+		if err != nil {
+			logger.Error("Failed to get service-id flag", "error", err)
+			os.Exit(1)
+		}
+		tagPrefix, err := tagPrefixFlag(cmd)
+		if err != nil {
+			logger.Error("Invalid tag prefix", "error", err)
+			os.Exit(1)
+		}
+		excludeTags, err := cmd.InheritedFlags().GetStringSlice("exclude-tags")
+		if err != nil {
+			logger.Error("Failed to get exclude-tags flag", "error", err)
+			os.Exit(1)
+		}
+		protectTags, err := cmd.InheritedFlags().GetStringArray("protect-tag")
+		if err != nil {
+			logger.Error("Failed to get protect-tag flag", "error", err)
+			os.Exit(1)
+		}
+		removeTags, err := cmd.InheritedFlags().GetStringArray("remove-tag")
+		if err != nil {
+			logger.Error("Failed to get remove-tag flag", "error", err)
+			os.Exit(1)
+		}
+		consulTimeout, err := consulTimeoutFlag(cmd)
+		if err != nil {
+			logger.Error("Invalid consul-timeout", "error", err)
+			os.Exit(1)
+		}
+
+		lowercaseTags, err := cmd.Flags().GetBool("lowercase-tags")
+		if err != nil {
+			logger.Error("Failed to get lowercase-tags flag", "error", err)
+			os.Exit(1)
+		}
+
+		newCleanupTagIt := func(serviceID string) (*tagit.TagIt, error) {
+			t, err := tagit.New(
+				consulClient,
+				&tagit.CmdExecutor{},
+				serviceID,
+				"", // script is not needed for cleanup
+				0,  // interval is not needed for cleanup
+				tagPrefix,
+				logger,
+			)
+			if err != nil {
+				return nil, err
+			}
+			t.ExcludeTags = excludeTags
+			t.ProtectTags = protectTags
+			t.RemoveTags = removeTags
+			t.ConsulTimeout = consulTimeout
+			t.LowercaseTags = lowercaseTags
+			return t, nil
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			logger.Error("Failed to get dry-run flag", "error", err)
+			os.Exit(1)
+		}
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			logger.Error("Failed to get all flag", "error", err)
+			os.Exit(1)
+		}
+		if all {
+			if dryRun {
+				logger.Error("Invalid flags, all cannot be combined with dry-run")
+				os.Exit(1)
+			}
+			logger.Info("Starting tag cleanup of all services", "tagPrefix", tagPrefix)
+			if err := cleanupAll(context.Background(), consulClient, newCleanupTagIt); err != nil {
+				logger.Error("Failed to clean up tags", "error", err)
+				os.Exit(1)
+			}
+			logger.Info("Tag cleanup completed successfully")
+			return
+		}
+		if serviceID == "" {
+			logger.Error("Invalid configuration", "error", "service-id is required without all")
+			os.Exit(1)
+		}
+
+		t, err := newCleanupTagIt(serviceID)
+		if err != nil {
+			logger.Error("Failed to create tagit", "error", err)
+			os.Exit(1)
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			logger.Error("Failed to get output flag", "error", err)
+			os.Exit(1)
+		}
+		if output != "text" && output != "json" {
+			logger.Error("Invalid output format, must be text or json", "output", output)
+			os.Exit(1)
+		}
 
-		t := tagit.New(
-			tagit.NewConsulAPIWrapper(consulClient),
-			&tagit.CmdExecutor{},
-			serviceID,
-			"", // script is not needed for cleanup
-			0,  // interval is not needed for cleanup
-			tagPrefix,
-			logger,
-		)
+		if dryRun {
+			removedTags, err := t.CleanupTagsDryRun(context.Background())
+			if err != nil {
+				logger.Error("Failed to get tags to clean up", "error", err)
+				os.Exit(1)
+			}
+			logger.Info("Dry run, no tags were removed", "serviceID", serviceID, "tags", len(removedTags))
+			if err := printCleanupPlan(os.Stdout, serviceID, removedTags, output); err != nil {
+				logger.Error("Failed to print tags to clean up", "error", err)
+				os.Exit(1)
+			}
+			return
+		}
 
 		logger.Info("Starting tag cleanup", "serviceID", serviceID, "tagPrefix", tagPrefix)
 
-		err = t.CleanupTags()
+		removedTags, err := t.CleanupTags()
 		if err != nil {
 			logger.Error("Failed to clean up tags", "error", err)
 			os.Exit(1)
 		}
 
-		logger.Info("Tag cleanup completed successfully")
+		logger.Info("Tag cleanup completed successfully", "serviceID", serviceID, "tags", len(removedTags))
+		if err := printCleanupPlan(os.Stdout, serviceID, removedTags, output); err != nil {
+			logger.Error("Failed to print removed tags", "error", err)
+			os.Exit(1)
+		}
 	},
 }
 
+// cleanupAll cleans up the tags of every service registered with the agent
+// of client, each with a TagIt from newTagIt. It goes on after a failure and
+// returns all failures joined.
+func cleanupAll(ctx context.Context, client consul.Client, newTagIt func(serviceID string) (*tagit.TagIt, error)) error {
+	services, err := client.Agent().ServicesWithFilterOpts("", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error listing services: %w", err)
+	}
+	serviceIDs := slices.Sorted(maps.Keys(services))
+
+	var errs []error
+	for _, serviceID := range serviceIDs {
+		t, err := newTagIt(serviceID)
+		if err == nil {
+			_, err = t.CleanupTagsContext(ctx)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", serviceID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cleanupPlan is the json output of a cleanup or its dry run.
+type cleanupPlan struct {
+	ServiceID   string   `json:"service_id"`
+	RemovedTags []string `json:"removed_tags"`
+}
+
+// printCleanupPlan writes the tags a cleanup removed, or would remove, to w,
+// one per line or as json.
+func printCleanupPlan(w io.Writer, serviceID string, removedTags []string, output string) error {
+	if output == "json" {
+		return json.NewEncoder(w).Encode(cleanupPlan{ServiceID: serviceID, RemovedTags: removedTags})
+	}
+	for _, tag := range removedTags {
+		if _, err := fmt.Fprintln(w, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(cleanupCmd)
+	cleanupCmd.Flags().Bool("all", false, "clean up every service of the agent instead of service-id, going on after failures")
+	cleanupCmd.Flags().Bool("dry-run", false, "list the tags that would be removed without removing them")
+	cleanupCmd.Flags().StringP("output", "o", "text", "output format of the removed tags (text or json)")
+	cleanupCmd.Flags().Bool("lowercase-tags", false, "match the tag prefix regardless of case, for tags added by run --lowercase-tags")
 }
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupAll(t *testing.T) {
+	consulClient := NewMockConsulClient()
+	consulClient.tags["service-a"] = []string{"tag-primary", "other-tag"}
+	consulClient.tags["service-b"] = []string{"tag-replica", "other-tag"}
+	consulClient.tags["service-c"] = []string{"tag-primary"}
+	consulClient.tags["service-d"] = []string{"tag-primary"}
+	consulClient.RegisterErrors = map[string]error{
+		"service-b": fmt.Errorf("registration rejected"),
+		"service-d": fmt.Errorf("agent unavailable"),
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newTagIt := func(serviceID string) (*tagit.TagIt, error) {
+		return tagit.New(consulClient, &tagit.CmdExecutor{}, serviceID, "", 0, "tag", logger)
+	}
+
+	err := cleanupAll(context.Background(), consulClient, newTagIt)
+
+	assert.ErrorContains(t, err, "service service-b: error cleaning up tags")
+	assert.ErrorContains(t, err, "registration rejected")
+	assert.ErrorContains(t, err, "service service-d: error cleaning up tags")
+	assert.ErrorContains(t, err, "agent unavailable")
+	assert.NotContains(t, err.Error(), "service-a")
+	assert.Equal(t, []string{"other-tag"}, consulClient.Tags("service-a"), "Expected the services before a failure to be cleaned")
+	assert.Equal(t, []string{"tag-replica", "other-tag"}, consulClient.Tags("service-b"), "Expected the failing service to keep its tags")
+	assert.Equal(t, []string{}, consulClient.Tags("service-c"), "Expected the services after a failure to be cleaned")
+}
+
+func TestPrintCleanupPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		removedTags []string
+		output      string
+		expected    string
+	}{
+		{
+			name:        "Text",
+			removedTags: []string{"tag-one", "tag-two"},
+			output:      "text",
+			expected:    "tag-one\ntag-two\n",
+		},
+		{
+			name:        "Text nothing to remove",
+			removedTags: []string{},
+			output:      "text",
+			expected:    "",
+		},
+		{
+			name:        "JSON",
+			removedTags: []string{"tag-one", "tag-two"},
+			output:      "json",
+			expected:    `{"service_id":"test-service","removed_tags":["tag-one","tag-two"]}` + "\n",
+		},
+		{
+			name:        "JSON nothing to remove",
+			removedTags: []string{},
+			output:      "json",
+			expected:    `{"service_id":"test-service","removed_tags":[]}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := printCleanupPlan(&buf, "test-service", tt.removedTags, tt.output)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncode/tagit/pkg/consul"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+)
+
+// clientFactory is used by the commands to create Consul clients.
+var clientFactory consul.ClientFactory = &consul.DefaultFactory{}
+
+// createConsulClient creates a Consul client from the inherited connection flags.
+func createConsulClient(cmd *cobra.Command) (consul.Client, error) {
+	cfg, err := consulConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConsulAddr(cfg.Address); err != nil {
+		return nil, err
+	}
+
+	return clientFactory.NewClient(cfg)
+}
+
+// requiredFlag returns the string flag name of cmd, set on the command line or
+// in the config file, failing when it is empty.
+func requiredFlag(cmd *cobra.Command, name string) (string, error) {
+	value, err := cmd.Flags().GetString(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s flag: %w", name, err)
+	}
+	if value == "" {
+		return "", fmt.Errorf("%s is required", name)
+	}
+	return value, nil
+}
+
+// tagPrefixFlag returns the validated tag-prefix flag of cmd, trimmed of
+// surrounding whitespace.
+func tagPrefixFlag(cmd *cobra.Command) (string, error) {
+	tagPrefix, err := cmd.Flags().GetString("tag-prefix")
+	if err != nil {
+		return "", fmt.Errorf("failed to get tag-prefix flag: %w", err)
+	}
+	tagPrefix = strings.TrimSpace(tagPrefix)
+	if err := tagit.ValidateTagPrefix(tagPrefix); err != nil {
+		return "", err
+	}
+	return tagPrefix, nil
+}
+
+// consulTimeoutFlag returns the consul-timeout flag of cmd, rejecting negative values.
+func consulTimeoutFlag(cmd *cobra.Command) (time.Duration, error) {
+	consulTimeout, err := cmd.Flags().GetDuration("consul-timeout")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get consul-timeout flag: %w", err)
+	}
+	if consulTimeout < 0 {
+		return 0, fmt.Errorf("invalid consul-timeout %v: must not be negative", consulTimeout)
+	}
+	return consulTimeout, nil
+}
+
+// consulConfig returns the Consul client configuration from the inherited connection flags.
+func consulConfig(cmd *cobra.Command) (consul.Config, error) {
+	flags := cmd.InheritedFlags()
+	values := make(map[string]string)
+	for _, name := range []string{"consul-addr", "consul-scheme", "token", "consul-http-auth", "user-agent", "ca-cert", "client-cert", "client-key", "tls-server-name"} {
+		value, err := flags.GetString(name)
+		if err != nil {
+			return consul.Config{}, fmt.Errorf("failed to get %s flag: %w", name, err)
+		}
+		values[name] = value
+	}
+	skipVerify, err := flags.GetBool("tls-skip-verify")
+	if err != nil {
+		return consul.Config{}, fmt.Errorf("failed to get tls-skip-verify flag: %w", err)
+	}
+	qps, err := flags.GetFloat64("consul-qps")
+	if err != nil {
+		return consul.Config{}, fmt.Errorf("failed to get consul-qps flag: %w", err)
+	}
+	if qps < 0 {
+		return consul.Config{}, fmt.Errorf("invalid consul-qps %v: must not be negative", qps)
+	}
+	if values["consul-http-auth"] != "" {
+		if _, err := consul.ParseHTTPAuth(values["consul-http-auth"]); err != nil {
+			return consul.Config{}, fmt.Errorf("invalid consul-http-auth: must be user:pass")
+		}
+	}
+	burst, err := flags.GetInt("consul-burst")
+	if err != nil {
+		return consul.Config{}, fmt.Errorf("failed to get consul-burst flag: %w", err)
+	}
+	if burst < 1 {
+		return consul.Config{}, fmt.Errorf("invalid consul-burst %d: must be at least 1", burst)
+	}
+
+	return consul.Config{
+		Address:  values["consul-addr"],
+		Scheme:   values["consul-scheme"],
+		Token:    values["token"],
+		HTTPAuth: values["consul-http-auth"],
+		TLS: consul.TLSConfig{
+			CAFile:             values["ca-cert"],
+			CertFile:           values["client-cert"],
+			KeyFile:            values["client-key"],
+			ServerName:         values["tls-server-name"],
+			InsecureSkipVerify: skipVerify,
+		},
+		QPS:       qps,
+		Burst:     burst,
+		UserAgent: values["user-agent"],
+	}, nil
+}
+
+// validateConsulAddr checks that addr is either host:port, a URL with a host
+// or a unix:// URL with a socket path.
+func validateConsulAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("invalid consul address: must not be empty")
+	}
+
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid consul address %q: %w", addr, err)
+		}
+		if strings.EqualFold(u.Scheme, "unix") {
+			if u.Path == "" {
+				return fmt.Errorf("invalid consul address %q: missing socket path", addr)
+			}
+			return nil
+		}
+		if u.Hostname() == "" {
+			return fmt.Errorf("invalid consul address %q: missing host", addr)
+		}
+		if port := u.Port(); port != "" {
+			return validateConsulPort(addr, port)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid consul address %q: must be host:port or a URL", addr)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid consul address %q: missing host", addr)
+	}
+	return validateConsulPort(addr, port)
+}
+
+// validateConsulPort checks that port is a valid TCP port of addr.
+func validateConsulPort(addr, port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid consul address %q: invalid port %q", addr, port)
+	}
+	return nil
+}
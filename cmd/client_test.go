@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ncode/tagit/pkg/consul"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockFactory implements the consul.ClientFactory interface for testing.
+type MockFactory struct {
+	Config     consul.Config
+	Configs    []consul.Config
+	MockClient consul.Client
+	MockError  error
+}
+
+func (m *MockFactory) NewClient(cfg consul.Config) (consul.Client, error) {
+	m.Config = cfg
+	m.Configs = append(m.Configs, cfg)
+	return m.MockClient, m.MockError
+}
+
+// setupClientCmd creates a command that inherits the consul connection flags
+func setupClientCmd(args ...string) *cobra.Command {
+	root := &cobra.Command{Use: "tagit"}
+	root.PersistentFlags().String("consul-addr", "127.0.0.1:8500", "consul address")
+	root.PersistentFlags().String("consul-scheme", "", "consul scheme (http or https)")
+	root.PersistentFlags().String("token", "", "consul token")
+	root.PersistentFlags().String("consul-http-auth", "", "user:pass of the HTTP basic auth sent to consul")
+	root.PersistentFlags().String("ca-cert", "", "path to the CA certificate used to verify consul")
+	root.PersistentFlags().String("client-cert", "", "path to the client certificate used to authenticate to consul")
+	root.PersistentFlags().String("client-key", "", "path to the client key used to authenticate to consul")
+	root.PersistentFlags().String("tls-server-name", "", "server name used to verify the consul certificate")
+	root.PersistentFlags().Bool("tls-skip-verify", false, "do not verify the consul certificate, only for testing")
+	root.PersistentFlags().Float64("consul-qps", 0, "limit the calls to the consul agent to this many per second, 0 means unlimited")
+	root.PersistentFlags().Int("consul-burst", 1, "number of calls allowed at once above consul-qps")
+	root.PersistentFlags().String("user-agent", "", "User-Agent sent to consul")
+	root.PersistentFlags().String("tag-prefix", "tagged", "prefix to be added to tags")
+	root.PersistentFlags().Duration("consul-timeout", 0, "timeout of each call to consul, 0 means no timeout")
+
+	child := &cobra.Command{Use: "child", Run: func(cmd *cobra.Command, args []string) {}}
+	root.AddCommand(child)
+	root.SetArgs(append([]string{"child"}, args...))
+	root.Execute()
+	return child
+}
+
+func TestCreateConsulClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name: "Default flags",
+		},
+		{
+			name: "TLS server name",
+			args: []string{"--tls-server-name=consul.example.com"},
+		},
+		{
+			name: "Scheme in address",
+			args: []string{"--consul-addr=https://127.0.0.1:8501"},
+		},
+		{
+			name:    "Conflicting scheme",
+			args:    []string{"--consul-addr=http://127.0.0.1:8500", "--consul-scheme=https"},
+			wantErr: "conflicts with address",
+		},
+		{
+			name:    "Invalid address",
+			args:    []string{"--consul-addr=invalid-consul-address"},
+			wantErr: "invalid consul address",
+		},
+		{
+			name: "Rate limited",
+			args: []string{"--consul-qps=5", "--consul-burst=10"},
+		},
+		{
+			name:    "Negative qps",
+			args:    []string{"--consul-qps=-1"},
+			wantErr: "invalid consul-qps",
+		},
+		{
+			name:    "Zero burst",
+			args:    []string{"--consul-burst=0"},
+			wantErr: "invalid consul-burst",
+		},
+		{
+			name: "HTTP auth",
+			args: []string{"--consul-http-auth=admin:s3cr:et"},
+		},
+		{
+			name:    "HTTP auth without password",
+			args:    []string{"--consul-http-auth=admin"},
+			wantErr: "invalid consul-http-auth: must be user:pass",
+		},
+		{
+			name:    "HTTP auth without user",
+			args:    []string{"--consul-http-auth=:s3cret"},
+			wantErr: "invalid consul-http-auth: must be user:pass",
+		},
+		{
+			name:    "Bad CA cert path",
+			args:    []string{"--ca-cert=/nonexistent/ca.pem"},
+			wantErr: "failed to create Consul client",
+		},
+		{
+			name:    "Bad client cert path",
+			args:    []string{"--client-cert=/nonexistent/client.pem", "--client-key=/nonexistent/client-key.pem"},
+			wantErr: "failed to create Consul client",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := setupClientCmd(tt.args...)
+
+			client, err := createConsulClient(cmd)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, client)
+			}
+		})
+	}
+}
+
+func TestCreateConsulClientConfig(t *testing.T) {
+	originalFactory := clientFactory
+	defer func() { clientFactory = originalFactory }()
+
+	mockFactory := &MockFactory{}
+	clientFactory = mockFactory
+
+	cmd := setupClientCmd(
+		"--consul-addr=consul.example.com:8501",
+		"--consul-scheme=https",
+		"--token=secret",
+		"--consul-http-auth=admin:s3cret",
+		"--ca-cert=/etc/consul/ca.pem",
+		"--client-cert=/etc/consul/client.pem",
+		"--client-key=/etc/consul/client-key.pem",
+		"--tls-server-name=consul.example.com",
+		"--tls-skip-verify",
+		"--consul-qps=2.5",
+		"--consul-burst=4",
+	)
+
+	_, err := createConsulClient(cmd)
+	assert.NoError(t, err)
+
+	expected := consul.Config{
+		Address:  "consul.example.com:8501",
+		Scheme:   "https",
+		Token:    "secret",
+		HTTPAuth: "admin:s3cret",
+		TLS: consul.TLSConfig{
+			CAFile:             "/etc/consul/ca.pem",
+			CertFile:           "/etc/consul/client.pem",
+			KeyFile:            "/etc/consul/client-key.pem",
+			ServerName:         "consul.example.com",
+			InsecureSkipVerify: true,
+		},
+		QPS:   2.5,
+		Burst: 4,
+	}
+	assert.Equal(t, expected, mockFactory.Config)
+}
+
+func TestValidateConsulAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr string
+	}{
+		{name: "Host and port", addr: "127.0.0.1:8500"},
+		{name: "Hostname and port", addr: "consul.example.com:8500"},
+		{name: "IPv6 host and port", addr: "[::1]:8500"},
+		{name: "URL", addr: "https://consul.example.com:8501"},
+		{name: "URL without port", addr: "https://consul.example.com"},
+		{name: "Unix socket", addr: "unix:///var/run/consul.sock"},
+		{name: "Unix socket without path", addr: "unix://", wantErr: "missing socket path"},
+		{name: "Empty", addr: "", wantErr: "must not be empty"},
+		{name: "Missing port", addr: "invalid-consul-address", wantErr: "must be host:port or a URL"},
+		{name: "Missing host", addr: ":8500", wantErr: "missing host"},
+		{name: "Non-numeric port", addr: "127.0.0.1:consul", wantErr: "invalid port"},
+		{name: "Port out of range", addr: "127.0.0.1:70000", wantErr: "invalid port"},
+		{name: "URL without host", addr: "http://:8500", wantErr: "missing host"},
+		{name: "URL with invalid port", addr: "http://127.0.0.1:0", wantErr: "invalid port"},
+		{name: "Too many colons", addr: "127.0.0.1:8500:1", wantErr: "must be host:port or a URL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConsulAddr(tt.addr)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "invalid consul address")
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTagPrefixFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		wantErr  bool
+	}{
+		{name: "Default", expected: "tagged"},
+		{name: "Trimmed", args: []string{"--tag-prefix", " role "}, expected: "role"},
+		{name: "With separator", args: []string{"--tag-prefix", "my-app"}, expected: "my-app"},
+		{name: "Empty", args: []string{"--tag-prefix", " "}, wantErr: true},
+		{name: "Whitespace", args: []string{"--tag-prefix", "my prefix"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagPrefix, err := tagPrefixFlag(setupClientCmd(tt.args...))
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, tagPrefix)
+			}
+		})
+	}
+}
+
+func TestConsulTimeoutFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected time.Duration
+		wantErr  string
+	}{
+		{name: "Default", expected: 0},
+		{name: "Set", args: []string{"--consul-timeout", "5s"}, expected: 5 * time.Second},
+		{name: "Negative", args: []string{"--consul-timeout", "-1s"}, wantErr: "must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consulTimeout, err := consulTimeoutFlag(setupClientCmd(tt.args...))
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, consulTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompletionCommand(t *testing.T) {
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"completion", "bash"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	})
+
+	assert.NoError(t, rootCmd.Execute(), "completion should not require service-id or script")
+	assert.Contains(t, buf.String(), "bash completion V2 for tagit")
+	assert.Contains(t, buf.String(), "__start_tagit")
+}
+
+func TestWriteCompletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		shell   string
+		wantErr bool
+	}{
+		{name: "Bash", shell: "bash"},
+		{name: "Zsh", shell: "zsh"},
+		{name: "Fish", shell: "fish"},
+		{name: "PowerShell", shell: "powershell"},
+		{name: "Unsupported Shell", shell: "tcsh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeCompletion(&buf, rootCmd, tt.shell)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Empty(t, buf.String())
+			} else {
+				assert.NoError(t, err)
+				assert.Contains(t, buf.String(), "tagit")
+			}
+		})
+	}
+}
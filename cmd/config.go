@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values in the printed configuration.
+const redacted = "REDACTED"
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Print the effective configuration",
+	Long: `Print the effective configuration resolved from flags, environment
+variables and the config file, in that order of precedence. The consul token
+and http auth are redacted.
+
+example: tagit config --config /etc/tagit/my-service.yaml --format json
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cfgFile != "" {
+			if err := viper.ReadInConfig(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to bind flags: %v\n", err)
+			os.Exit(1)
+		}
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to get format flag: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := printConfig(os.Stdout, viper.GetViper(), format); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.Flags().String("format", "yaml", "output format, yaml or json")
+}
+
+// printConfig writes the settings resolved by v to w in the given format,
+// redacting the consul token and http auth.
+func printConfig(w io.Writer, v *viper.Viper, format string) error {
+	settings := v.AllSettings()
+	for _, key := range []string{"token", "consul-http-auth"} {
+		if v.GetString(key) != "" {
+			settings[key] = redacted
+		}
+	}
+
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(settings); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(settings); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid format %q: must be yaml or json", format)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// exampleServices documents the services list, which has no flag of its own.
+const exampleServices = `services runs several services from one process. Each entry takes
+service-id, script, tag-prefix, interval and consul-addr, the keys it leaves
+out fall back to the ones above.
+services:
+  - service-id: my-service1
+    script: /usr/local/bin/tags.sh
+  - service-id: my-service2
+    script: /usr/local/bin/other-tags.sh
+    interval: 5m`
+
+// configInitCmd represents the config init command
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a commented example config file",
+	Long: `Write an example config file with every setting at its default value,
+each explained by a comment, to $HOME/.tagit.yaml or the given path. An
+existing file is only replaced with --force.
+
+example: tagit config init --path /etc/tagit/my-service.yaml
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := cmd.Flags().GetString("path")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to get path flag: %v\n", err)
+			os.Exit(1)
+		}
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to find home directory: %v\n", err)
+				os.Exit(1)
+			}
+			path = filepath.Join(home, ".tagit.yaml")
+		}
+
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to get force flag: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := writeExampleConfig(path, cmd.Root(), force); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "Wrote example config file:", path)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configInitCmd)
+	configInitCmd.Flags().String("path", "", "path of the config file to write (default is $HOME/.tagit.yaml)")
+	configInitCmd.Flags().Bool("force", false, "overwrite the config file when it already exists")
+}
+
+// writeExampleConfig writes the example config of root to path. It fails when
+// path already exists, unless force is set.
+func writeExampleConfig(path string, root *cobra.Command, force bool) error {
+	config, err := exampleConfig(root)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	// The file may end up holding the consul token, so keep it private
+	f, err := os.OpenFile(path, flags, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("config file %s already exists, use --force to overwrite it", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	if _, err := f.Write(config); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// exampleConfig returns a YAML config with the keys known by root, see
+// knownConfigKeys, set to their defaults and commented with their usage.
+func exampleConfig(root *cobra.Command) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	known := knownConfigKeys(root)
+	seen := make(map[string]bool)
+	addFlag := func(f *pflag.Flag) {
+		if !known[f.Name] || seen[f.Name] || f.Hidden || f.Deprecated != "" {
+			return
+		}
+		seen[f.Name] = true
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: f.Name, HeadComment: f.Usage},
+			defaultNode(f))
+	}
+	root.PersistentFlags().VisitAll(addFlag)
+	for _, cmd := range root.Commands() {
+		if cmd.Name() == "run" {
+			cmd.Flags().VisitAll(addFlag)
+		}
+	}
+	doc.FootComment = exampleServices
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to encode example config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode example config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultNode returns the default value of f as a YAML node.
+func defaultNode(f *pflag.Flag) *yaml.Node {
+	if _, ok := f.Value.(pflag.SliceValue); ok {
+		// The current value may come from the config file, the default is
+		// only kept formatted as [a,b]
+		node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		if items := strings.TrimSuffix(strings.TrimPrefix(f.DefValue, "["), "]"); items != "" {
+			for _, item := range strings.Split(items, ",") {
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		}
+		return node
+	}
+
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: f.DefValue}
+	if f.Value.Type() == "string" {
+		// Keep strings such as an empty default quoted
+		node.Tag = "!!str"
+	}
+	return node
+}
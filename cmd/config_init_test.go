@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteExampleConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".tagit.yaml")
+	assert.NoError(t, writeExampleConfig(path, rootCmd, false))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var settings map[string]any
+	assert.NoError(t, yaml.Unmarshal(content, &settings))
+
+	assert.Equal(t, "", settings["service-id"])
+	assert.Equal(t, "", settings["script"])
+	assert.Equal(t, "tagged", settings["tag-prefix"])
+	assert.Equal(t, "60s", settings["interval"])
+	assert.Equal(t, "127.0.0.1:8500", settings["consul-addr"])
+	assert.Equal(t, 1, settings["consul-burst"])
+	assert.Equal(t, false, settings["once"], "Expected the flags of the run command")
+	assert.Equal(t, []any{}, settings["exclude-tags"])
+	assert.NotContains(t, settings, "config", "The config flag is not a config key")
+	assert.NotContains(t, settings, "services", "The services example should be commented out")
+	assert.Contains(t, string(content), "# consul service id\nservice-id: \"\"\n", "Expected each key to be commented with its usage")
+	assert.Contains(t, string(content), "# services:\n")
+
+	for key := range knownConfigKeys(rootCmd) {
+		if key != "services" {
+			assert.Contains(t, settings, key, "Expected every known key")
+		}
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	assert.NoError(t, v.ReadInConfig())
+	assert.NoError(t, checkConfigKeys(v, knownConfigKeys(rootCmd)), "Expected the example to pass strict-config")
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestWriteExampleConfigOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".tagit.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("service-id: mine\n"), 0o600))
+
+	err := writeExampleConfig(path, rootCmd, false)
+	assert.ErrorContains(t, err, "already exists, use --force to overwrite it")
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "service-id: mine\n", string(content), "Expected the existing file to be left alone")
+
+	assert.NoError(t, writeExampleConfig(path, rootCmd, true))
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "tag-prefix: tagged")
+	assert.NotContains(t, string(content), "mine")
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestPrintConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tagit.yaml")
+	config := `service-id: file-service
+script: /usr/local/bin/tags.sh
+tag-prefix: file
+interval: 10s
+token: file-secret
+consul-http-auth: admin:file-password
+`
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	t.Setenv("SERVICE_ID", "env-service")
+	t.Setenv("TAG_PREFIX", "env")
+
+	flags := pflag.NewFlagSet("tagit", pflag.ContinueOnError)
+	flags.String("service-id", "", "")
+	flags.String("interval", "60s", "")
+	flags.String("tag-prefix", "tagged", "")
+	flags.String("token", "", "")
+	flags.String("consul-http-auth", "", "")
+	assert.NoError(t, flags.Parse([]string{"--service-id", "flag-service"}))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	configureEnv(v)
+	assert.NoError(t, v.ReadInConfig())
+	assert.NoError(t, v.BindPFlags(flags))
+
+	tests := []struct {
+		name   string
+		format string
+		decode func([]byte, any) error
+	}{
+		{name: "YAML", format: "yaml", decode: yaml.Unmarshal},
+		{name: "JSON", format: "json", decode: json.Unmarshal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NoError(t, printConfig(&buf, v, tt.format))
+
+			var settings map[string]any
+			assert.NoError(t, tt.decode(buf.Bytes(), &settings))
+
+			assert.Equal(t, "flag-service", settings["service-id"], "Flag should take precedence over env and file")
+			assert.Equal(t, "env", settings["tag-prefix"], "Env should take precedence over file")
+			assert.Equal(t, "10s", settings["interval"], "File should take precedence over flag defaults")
+			assert.Equal(t, "/usr/local/bin/tags.sh", settings["script"])
+			assert.Equal(t, redacted, settings["token"], "Token should be redacted")
+			assert.NotContains(t, buf.String(), "file-secret")
+			assert.Equal(t, redacted, settings["consul-http-auth"], "HTTP auth should be redacted")
+			assert.NotContains(t, buf.String(), "file-password")
+		})
+	}
+}
+
+func TestPrintConfigInvalidFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := printConfig(&buf, viper.New(), "toml")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid format")
+}
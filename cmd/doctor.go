@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the script, consul connectivity, the service and optionally the token permissions",
+	Long: `Check the setup before enabling the service and print a checklist.
+
+The script is run once, the consul agent is contacted and the service is
+looked up, without writing to consul. With --write-check the token is also
+checked for write permission by registering the service again as it is,
+which does not change its tags but is a real write to the agent.
+
+example: tagit doctor -s my-super-service -x '/tmp/tag-role.sh' -p role
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := commandLogger(cmd)
+
+		consulClient, err := createConsulClient(cmd)
+		if err != nil {
+			logger.Error("Failed to create Consul client", "error", err)
+			os.Exit(1)
+		}
+
+		serviceID, err := requiredFlag(cmd, "service-id")
+		if err != nil {
+			logger.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		script, err := requiredFlag(cmd, "script")
+		if err != nil {
+			logger.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		tagPrefix, err := tagPrefixFlag(cmd)
+		if err != nil {
+			logger.Error("Invalid tag prefix", "error", err)
+			os.Exit(1)
+		}
+		consulTimeout, err := consulTimeoutFlag(cmd)
+		if err != nil {
+			logger.Error("Invalid consul-timeout", "error", err)
+			os.Exit(1)
+		}
+
+		t, err := tagit.New(
+			consulClient,
+			&tagit.CmdExecutor{},
+			serviceID,
+			script,
+			0, // interval is not needed for doctor
+			tagPrefix,
+			logger,
+		)
+		if err != nil {
+			logger.Error("Failed to create tagit", "error", err)
+			os.Exit(1)
+		}
+		t.ConsulTimeout = consulTimeout
+
+		writeCheck, err := cmd.Flags().GetBool("write-check")
+		if err != nil {
+			logger.Error("Failed to get write-check flag", "error", err)
+			os.Exit(1)
+		}
+
+		passed, err := printChecks(cmd.OutOrStdout(), t.Doctor(context.Background(), writeCheck))
+		if err != nil {
+			logger.Error("Failed to print checks", "error", err)
+			os.Exit(1)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().Bool("write-check", false, "also check the token may write the service by registering it again unchanged, this writes to the consul agent")
+}
+
+// printChecks writes one line per check to w, marked PASS, FAIL or SKIP, and
+// reports whether all checks passed.
+func printChecks(w io.Writer, checks []tagit.Check) (passed bool, err error) {
+	passed = true
+	for _, check := range checks {
+		var line string
+		switch {
+		case check.Err == nil && check.Detail != "":
+			line = fmt.Sprintf("[PASS] %s: %s", check.Name, check.Detail)
+		case check.Err == nil:
+			line = fmt.Sprintf("[PASS] %s", check.Name)
+		case errors.Is(check.Err, tagit.ErrCheckSkipped):
+			passed = false
+			line = fmt.Sprintf("[SKIP] %s", check.Name)
+		default:
+			passed = false
+			line = fmt.Sprintf("[FAIL] %s: %v", check.Name, check.Err)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return false, err
+		}
+	}
+	return passed, nil
+}
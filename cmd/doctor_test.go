@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctorCommand(t *testing.T) {
+	originalFactory := clientFactory
+	defer func() { clientFactory = originalFactory }()
+	mockClient := NewMockConsulClient()
+	mockClient.tags["web"] = []string{"role-old"}
+	clientFactory = &MockFactory{MockClient: mockClient}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"doctor", "--service-id", "web", "--script", "echo primary replica", "--tag-prefix", "role", "--quiet"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+		resetFlags(doctorCmd)
+	})
+
+	assert.NoError(t, rootCmd.Execute())
+	assert.Equal(t, "[PASS] script: 2 tags generated\n"+
+		"[PASS] consul: 1 services visible\n"+
+		"[PASS] service: 1 tags registered\n", buf.String())
+	assert.Zero(t, mockClient.registerCalls(), "Expected doctor not to write without --write-check")
+
+	buf.Reset()
+	rootCmd.SetArgs([]string{"doctor", "--service-id", "web", "--script", "echo primary replica", "--tag-prefix", "role", "--quiet", "--write-check"})
+	assert.NoError(t, rootCmd.Execute())
+	assert.Equal(t, "[PASS] script: 2 tags generated\n"+
+		"[PASS] consul: 1 services visible\n"+
+		"[PASS] service: 1 tags registered\n"+
+		"[PASS] write permission\n", buf.String())
+	assert.Equal(t, []string{"role-old"}, mockClient.Tags("web"), "Expected doctor to leave the tags untouched")
+}
+
+func TestPrintChecks(t *testing.T) {
+	tests := []struct {
+		name           string
+		checks         []tagit.Check
+		expected       string
+		expectedPassed bool
+	}{
+		{
+			name: "All Pass",
+			checks: []tagit.Check{
+				{Name: "script", Detail: "2 tags generated"},
+				{Name: "write permission"},
+			},
+			expected:       "[PASS] script: 2 tags generated\n[PASS] write permission\n",
+			expectedPassed: true,
+		},
+		{
+			name: "Failed And Skipped",
+			checks: []tagit.Check{
+				{Name: "script", Detail: "2 tags generated"},
+				{Name: "consul", Err: fmt.Errorf("connection refused")},
+				{Name: "service", Err: tagit.ErrCheckSkipped},
+			},
+			expected:       "[PASS] script: 2 tags generated\n[FAIL] consul: connection refused\n[SKIP] service\n",
+			expectedPassed: false,
+		},
+		{
+			name: "Permission Denied",
+			checks: []tagit.Check{
+				{Name: "write permission", Err: fmt.Errorf("%w: the consul token needs service:write on service web", tagit.ErrPermissionDenied)},
+			},
+			expected:       "[FAIL] write permission: permission denied: the consul token needs service:write on service web\n",
+			expectedPassed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			passed, err := printChecks(&buf, tt.checks)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedPassed, passed)
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
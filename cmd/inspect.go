@@ -0,0 +1,95 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Print the consul service registration as tagit sees it, as json",
+	Long: `Print the service registration fetched from the consul agent as indented
+json, the way tagit sees it on each update cycle. This helps to find out why
+a field is not preserved when tagit registers the service again.
+
+example: tagit inspect -s my-super-service
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := commandLogger(cmd)
+
+		consulClient, err := createConsulClient(cmd)
+		if err != nil {
+			logger.Error("Failed to create Consul client", "error", err)
+			os.Exit(1)
+		}
+
+		serviceID, err := requiredFlag(cmd, "service-id")
+		if err != nil {
+			logger.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		consulTimeout, err := consulTimeoutFlag(cmd)
+		if err != nil {
+			logger.Error("Invalid consul-timeout", "error", err)
+			os.Exit(1)
+		}
+
+		t, err := tagit.New(
+			consulClient,
+			&tagit.CmdExecutor{},
+			serviceID,
+			"", // script is not needed for inspect
+			0,  // interval is not needed for inspect
+			"", // tag prefix is not needed for inspect
+			logger,
+		)
+		if err != nil {
+			logger.Error("Failed to create tagit", "error", err)
+			os.Exit(1)
+		}
+		t.ConsulTimeout = consulTimeout
+
+		service, err := t.Service(context.Background())
+		if err != nil {
+			logger.Error("Failed to get service", "error", err)
+			os.Exit(1)
+		}
+		if err := printService(cmd.OutOrStdout(), service); err != nil {
+			logger.Error("Failed to print service", "error", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+}
+
+// printService writes service to w as indented json.
+func printService(w io.Writer, service *api.AgentService) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(service)
+}
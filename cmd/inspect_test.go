@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectCommand(t *testing.T) {
+	originalFactory := clientFactory
+	defer func() { clientFactory = originalFactory }()
+	mockClient := NewMockConsulClient()
+	mockClient.tags["web"] = []string{"role-primary", "other"}
+	clientFactory = &MockFactory{MockClient: mockClient}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"inspect", "--service-id", "web", "--quiet"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	})
+
+	assert.NoError(t, rootCmd.Execute())
+	assert.Contains(t, buf.String(), "\n  \"ID\": \"web\",\n", "Expected indented json")
+
+	var service api.AgentService
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &service))
+	assert.Equal(t, "web", service.ID)
+	assert.Equal(t, "web", service.Service)
+	assert.Equal(t, []string{"role-primary", "other"}, service.Tags)
+	assert.Equal(t, []string{"role-primary", "other"}, mockClient.Tags("web"), "Expected inspect to leave the tags untouched")
+}
+
+func TestPrintService(t *testing.T) {
+	service := &api.AgentService{
+		ID:      "web-1",
+		Service: "web",
+		Tags:    []string{"role-primary"},
+		Meta:    map[string]string{"region": "eu-west-1"},
+		Port:    8080,
+		Address: "10.0.0.1",
+		Weights: api.AgentWeights{Passing: 10, Warning: 1},
+		Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "web"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, printService(&buf, service))
+
+	output := buf.String()
+	for _, field := range []string{
+		`"ID": "web-1"`,
+		`"Service": "web"`,
+		`"region": "eu-west-1"`,
+		`"Port": 8080`,
+		`"Address": "10.0.0.1"`,
+		`"Passing": 10`,
+		`"DestinationServiceName": "web"`,
+	} {
+		assert.Contains(t, output, field)
+	}
+}
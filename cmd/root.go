@@ -16,10 +16,17 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"os"
 )
 
 var cfgFile string
@@ -28,6 +35,12 @@ var cfgFile string
 var rootCmd = &cobra.Command{
 	Use:   "tagit",
 	Short: "Update consul services with dynamic tags coming from a script",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := applyConfig(cmd, viper.GetViper()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -41,15 +54,29 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tagit.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tagit.yaml, .yml, .json or .toml)")
 	rootCmd.PersistentFlags().StringP("consul-addr", "c", "127.0.0.1:8500", "consul address")
 	rootCmd.PersistentFlags().StringP("service-id", "s", "", "consul service id")
-	rootCmd.MarkPersistentFlagRequired("service-id")
 	rootCmd.PersistentFlags().StringP("script", "x", "", "path to script used to generate tags")
-	rootCmd.MarkPersistentFlagRequired("script")
 	rootCmd.PersistentFlags().StringP("tag-prefix", "p", "tagged", "prefix to be added to tags")
-	rootCmd.PersistentFlags().StringP("interval", "i", "60s", "interval to run the script")
+	rootCmd.PersistentFlags().StringSlice("exclude-tags", nil, "tags or glob patterns that are never added or removed")
+	rootCmd.PersistentFlags().StringArray("protect-tag", nil, "exact tag that is never removed, even with the tag prefix, can be repeated")
+	rootCmd.PersistentFlags().StringArray("remove-tag", nil, "exact tag that is always removed, even without the tag prefix, can be repeated")
+	rootCmd.PersistentFlags().StringP("interval", "i", "60s", "interval to run the script, 0 runs a single update cycle and exits like --once")
+	rootCmd.PersistentFlags().String("consul-scheme", "", "consul scheme (http or https)")
 	rootCmd.PersistentFlags().StringP("token", "t", "", "consul token")
+	rootCmd.PersistentFlags().String("consul-http-auth", "", "user:pass of the HTTP basic auth sent to consul, for agents behind an auth proxy")
+	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "only log warnings and errors")
+	rootCmd.PersistentFlags().Bool("strict-config", false, "reject unknown keys in the config file")
+	rootCmd.PersistentFlags().String("ca-cert", "", "path to the CA certificate used to verify consul")
+	rootCmd.PersistentFlags().String("client-cert", "", "path to the client certificate used to authenticate to consul")
+	rootCmd.PersistentFlags().String("client-key", "", "path to the client key used to authenticate to consul")
+	rootCmd.PersistentFlags().String("tls-server-name", "", "server name used to verify the consul certificate")
+	rootCmd.PersistentFlags().Bool("tls-skip-verify", false, "do not verify the consul certificate, only for testing")
+	rootCmd.PersistentFlags().Duration("consul-timeout", 0, "timeout of each call to the consul agent, 0 means no timeout")
+	rootCmd.PersistentFlags().Float64("consul-qps", 0, "limit the calls to the consul agent to this many per second, 0 means unlimited")
+	rootCmd.PersistentFlags().Int("consul-burst", 1, "number of calls allowed at once above consul-qps")
+	rootCmd.PersistentFlags().String("user-agent", "", "User-Agent sent to consul (default tagit/<version>)")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -62,16 +89,88 @@ func initConfig() {
 		home, err := os.UserHomeDir()
 		cobra.CheckErr(err)
 
-		// Search config in home directory with name ".tagit" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigType("yaml")
-		viper.SetConfigName(".tagit")
+		findConfig(viper.GetViper(), home)
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	configureEnv(viper.GetViper())
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+		if quiet, _ := rootCmd.PersistentFlags().GetBool("quiet"); !quiet {
+			fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+		}
+	}
+}
+
+// configureEnv makes v read the environment variables that match its keys,
+// with dashes written as underscores, so SERVICE_ID sets service-id.
+func configureEnv(v *viper.Viper) {
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+}
+
+// applyConfig sets the flags of cmd not given on the command line to their
+// value in the config file of v, so every key of the config file is honored
+// whether it is read through v or through the flags. Only the keys known by
+// knownConfigKeys are applied. The flags are not marked as changed, so v keeps
+// preferring the config file, which is re-read on reload, over them.
+func applyConfig(cmd *cobra.Command, v *viper.Viper) error {
+	known := knownConfigKeys(cmd.Root())
+	var errs []error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || !known[f.Name] || !v.InConfig(f.Name) {
+			return
+		}
+		// The previous value stays the default of v for when the key is
+		// removed from the config file before a reload
+		var err error
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			v.SetDefault(f.Name, slice.GetSlice())
+			err = slice.Replace(v.GetStringSlice(f.Name))
+		} else {
+			v.SetDefault(f.Name, f.Value.String())
+			err = f.Value.Set(v.GetString(f.Name))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s in config file: %w", f.Name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// configExts are the extensions of the config files searched for, in order of
+// preference when several exist.
+var configExts = []string{"yaml", "yml", "json", "toml"}
+
+// findConfig points v at the .tagit config file in dir, preferring YAML when
+// files of several formats exist. A .tagit file without extension is read as YAML.
+func findConfig(v *viper.Viper, dir string) {
+	for _, ext := range configExts {
+		path := filepath.Join(dir, ".tagit."+ext)
+		if _, err := os.Stat(path); err == nil {
+			v.SetConfigFile(path)
+			return
+		}
+	}
+	v.AddConfigPath(dir)
+	v.SetConfigType("yaml")
+	v.SetConfigName(".tagit")
+}
+
+// commandLogger creates the logger for cmd, honoring the quiet flag.
+func commandLogger(cmd *cobra.Command) *slog.Logger {
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	return newLogger(os.Stderr, quiet)
+}
+
+// newLogger creates a logger writing to w. When quiet is set only warnings
+// and errors are logged.
+func newLogger(w io.Writer, quiet bool) *slog.Logger {
+	level := slog.LevelInfo
+	if quiet {
+		level = slog.LevelWarn
 	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+	}))
 }
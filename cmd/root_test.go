@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name        string
+		quiet       bool
+		expectInfo  bool
+		expectError bool
+	}{
+		{
+			name:        "Default",
+			quiet:       false,
+			expectInfo:  true,
+			expectError: true,
+		},
+		{
+			name:        "Quiet",
+			quiet:       true,
+			expectInfo:  false,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(&buf, tt.quiet)
+
+			logger.Info("running command")
+			logger.Error("error updating service tags")
+
+			assert.Equal(t, tt.expectInfo, bytes.Contains(buf.Bytes(), []byte("running command")), "Unexpected info log output")
+			assert.Equal(t, tt.expectError, bytes.Contains(buf.Bytes(), []byte("error updating service tags")), "Unexpected error log output")
+		})
+	}
+}
+
+func TestCommandLoggerQuiet(t *testing.T) {
+	root := &cobra.Command{Use: "tagit"}
+	root.PersistentFlags().BoolP("quiet", "q", false, "only log warnings and errors")
+
+	var logger *slog.Logger
+	child := &cobra.Command{Use: "child", Run: func(cmd *cobra.Command, args []string) {
+		logger = commandLogger(cmd)
+	}}
+	root.AddCommand(child)
+
+	root.SetArgs([]string{"child", "--quiet"})
+	assert.NoError(t, root.Execute())
+
+	assert.False(t, logger.Enabled(context.Background(), slog.LevelInfo), "Info logs should be suppressed with --quiet")
+	assert.True(t, logger.Enabled(context.Background(), slog.LevelError), "Error logs should be kept with --quiet")
+}
+
+func TestFindConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		expectedPrefix string
+	}{
+		{
+			name:           "JSON",
+			files:          map[string]string{".tagit.json": `{"tag-prefix": "json"}`},
+			expectedPrefix: "json",
+		},
+		{
+			name:           "TOML",
+			files:          map[string]string{".tagit.toml": `tag-prefix = "toml"`},
+			expectedPrefix: "toml",
+		},
+		{
+			name:           "YAML without extension",
+			files:          map[string]string{".tagit": "tag-prefix: bare"},
+			expectedPrefix: "bare",
+		},
+		{
+			name: "YAML preferred",
+			files: map[string]string{
+				".tagit.json": `{"tag-prefix": "json"}`,
+				".tagit.yaml": "tag-prefix: yaml",
+			},
+			expectedPrefix: "yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600))
+			}
+
+			v := viper.New()
+			findConfig(v, dir)
+			assert.NoError(t, v.ReadInConfig())
+			assert.Equal(t, tt.expectedPrefix, v.GetString("tag-prefix"))
+		})
+	}
+}
+
+// resetFlags sets the flags of cmd, including the inherited ones, back to
+// their defaults, as flags keep their values between executions of rootCmd.
+func resetFlags(cmd *cobra.Command) {
+	cmd.InheritedFlags()
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+}
+
+// setupConfigCmd creates a tagit-like command tree whose run command inherits
+// a few root flags, parsed from args.
+func setupConfigCmd(t *testing.T, args ...string) *cobra.Command {
+	root := &cobra.Command{Use: "tagit"}
+	root.PersistentFlags().String("service-id", "", "consul service id")
+	root.PersistentFlags().String("consul-addr", "127.0.0.1:8500", "consul address")
+	root.PersistentFlags().StringSlice("exclude-tags", nil, "tags that are never added or removed")
+	run := &cobra.Command{Use: "run", Run: func(cmd *cobra.Command, args []string) {}}
+	run.Flags().Bool("once", false, "run a single update cycle")
+	run.Flags().Duration("script-timeout", 0, "script timeout")
+	other := &cobra.Command{Use: "other", Run: func(cmd *cobra.Command, args []string) {}}
+	other.Flags().String("path", "", "not a config key")
+	root.AddCommand(run, other)
+	root.SetArgs(args)
+	assert.NoError(t, root.Execute())
+	cmd, _, err := root.Find(args)
+	assert.NoError(t, err)
+	return cmd
+}
+
+func TestApplyConfig(t *testing.T) {
+	v, path := loadTestConfig(t, "service-id: web\nconsul-addr: 10.0.0.1:8500\nexclude-tags: [a, b]\nonce: true\nscript-timeout: 5s\npath: /tmp/x\n")
+
+	cmd := setupConfigCmd(t, "run", "--consul-addr", "10.0.0.2:8500")
+	assert.NoError(t, applyConfig(cmd, v))
+	serviceID, _ := cmd.Flags().GetString("service-id")
+	assert.Equal(t, "web", serviceID, "Expected the config file to set the flag")
+	consulAddr, _ := cmd.Flags().GetString("consul-addr")
+	assert.Equal(t, "10.0.0.2:8500", consulAddr, "Expected the command line to take precedence")
+	excludeTags, _ := cmd.Flags().GetStringSlice("exclude-tags")
+	assert.Equal(t, []string{"a", "b"}, excludeTags)
+	once, _ := cmd.Flags().GetBool("once")
+	assert.True(t, once)
+	scriptTimeout, _ := cmd.Flags().GetDuration("script-timeout")
+	assert.Equal(t, 5*time.Second, scriptTimeout)
+	assert.False(t, cmd.Flags().Changed("service-id"), "Expected the flags not to be marked as changed")
+
+	other := setupConfigCmd(t, "other")
+	assert.NoError(t, applyConfig(other, v))
+	otherPath, _ := other.Flags().GetString("path")
+	assert.Empty(t, otherPath, "Expected keys unknown to the config file to be left alone")
+
+	// Keys removed from the config file fall back to the flag defaults on reload
+	assert.NoError(t, v.BindPFlags(cmd.Flags()))
+	assert.NoError(t, os.WriteFile(path, []byte("consul-addr: 10.0.0.1:8500\n"), 0o600))
+	assert.NoError(t, v.ReadInConfig())
+	assert.Equal(t, "", v.GetString("service-id"))
+	assert.Empty(t, v.GetStringSlice("exclude-tags"))
+
+	v, _ = loadTestConfig(t, "script-timeout: soon\n")
+	cmd = setupConfigCmd(t, "run")
+	assert.ErrorContains(t, applyConfig(cmd, v), "invalid script-timeout in config file")
+}
@@ -17,15 +17,33 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
+	"unicode"
 
-	"github.com/hashicorp/consul/api"
+	"github.com/fsnotify/fsnotify"
+	"github.com/ncode/tagit/pkg/consul"
+	"github.com/ncode/tagit/pkg/cron"
+	"github.com/ncode/tagit/pkg/metrics"
+	"github.com/ncode/tagit/pkg/systemd"
 	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/ncode/tagit/pkg/tracing"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // runCmd represents the run command
@@ -35,98 +53,1020 @@ var runCmd = &cobra.Command{
 	Long: `Run tagit to add tags to a given consul service based on a script output.
 
 example: tagit run -s my-super-service -x '/tmp/tag-role.sh'
+
+Multiple services can be managed by a single tagit using a services list in
+the config file, in which case the service-id and script flags are optional:
+
+  services:
+    - service-id: my-super-service
+      script: /tmp/tag-role.sh
+      tag-prefix: role
+      interval: 30s
+    - service-id: my-other-service
+      script: /tmp/tag-vhosts.sh
+      consul-addr: 10.0.0.2:8500
+
+A service with its own consul-addr is managed through that agent, the
+others through the consul-addr flag.
+
+With --once or --interval=0 a single update cycle is run and tagit exits with:
+
+  0 when no tags changed
+  1 on error
+  2 when the tags of at least one service changed
+
+Sending SIGHUP re-reads the config file, starting and stopping services as
+they are added or removed, and applies the script, tag-prefix and interval
+without restarting. Values given as flags take precedence. With
+--watch-config the same happens whenever the config file changes.
+Sending SIGUSR1 updates the tags of all services right away.
+
+With --tags-url the tags are read from the body of a GET request to the
+URL, such as a local sidecar, instead of the output of a script. With
+--from-stdin and --once they are read from stdin, such as a pipe.
+
+With --by-name and --config-from-meta each instance of the service gets
+the script, tag-prefix and interval of its tagit-script, tagit-prefix and
+tagit-interval meta, the flags giving the defaults. Anyone registering a
+service sets its meta, so tagit-script must be the absolute path of a script
+in --meta-script-dir, without arguments. Instances without a tagit-script
+meta, or naming anything else, are ignored. The agent is checked for changed
+instances every interval and on SIGHUP.
+
+With --print-systemd the systemd unit running the same service is printed
+instead, covering the service-id, script, tag-prefix, interval, token and
+consul-addr settings.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: slog.LevelInfo,
-		}))
+		logger := commandLogger(cmd)
+
+		// Bind the flags so the config file only applies to values not given on the command line
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			logger.Error("Failed to bind flags", "error", err)
+			os.Exit(1)
+		}
 
-		interval, err := cmd.InheritedFlags().GetString("interval")
+		strictConfig, err := cmd.Flags().GetBool("strict-config")
 		if err != nil {
-			logger.Error("Failed to get interval flag", "error", err)
+			logger.Error("Failed to get strict-config flag", "error", err)
 			os.Exit(1)
 		}
+		if strictConfig {
+			if err := checkConfigKeys(viper.GetViper(), knownConfigKeys(cmd.Root())); err != nil {
+				logger.Error("Invalid configuration", "error", err)
+				os.Exit(1)
+			}
+		}
 
-		if interval == "" || interval == "0" {
-			logger.Error("Interval is required")
+		printSystemd, err := cmd.Flags().GetBool("print-systemd")
+		if err != nil {
+			logger.Error("Failed to get print-systemd flag", "error", err)
 			os.Exit(1)
 		}
+		if printSystemd {
+			fields, err := systemdFields(cmd, viper.GetViper())
+			if err != nil {
+				logger.Error("Invalid configuration", "error", err)
+				os.Exit(1)
+			}
+			serviceFile, err := systemd.RenderTemplate(fields)
+			if err != nil {
+				logger.Error("Failed to generate systemd service file", "error", err)
+				os.Exit(1)
+			}
+			fmt.Println(serviceFile)
+			return
+		}
 
-		validInterval, err := time.ParseDuration(interval)
+		tagsURLTimeout, err := cmd.Flags().GetDuration("tags-url-timeout")
+		if err != nil {
+			logger.Error("Failed to get tags-url-timeout flag", "error", err)
+			os.Exit(1)
+		}
+		scriptTimeout, err := cmd.Flags().GetDuration("script-timeout")
+		if err != nil {
+			logger.Error("Failed to get script-timeout flag", "error", err)
+			os.Exit(1)
+		}
+		runAsUser, err := cmd.Flags().GetString("run-as-user")
+		if err != nil {
+			logger.Error("Failed to get run-as-user flag", "error", err)
+			os.Exit(1)
+		}
+		runAsGroup, err := cmd.Flags().GetString("run-as-group")
+		if err != nil {
+			logger.Error("Failed to get run-as-group flag", "error", err)
+			os.Exit(1)
+		}
+		scriptEnvPairs, err := cmd.Flags().GetStringArray("script-env")
+		if err != nil {
+			logger.Error("Failed to get script-env flag", "error", err)
+			os.Exit(1)
+		}
+		scriptEnv, err := parseScriptEnv(scriptEnvPairs)
+		if err != nil {
+			logger.Error("Invalid script-env", "error", err)
+			os.Exit(1)
+		}
+		// The script, probe and post-update commands all run as the run-as
+		// user, which is looked up once here so a typo fails at startup
+		cmdExecutor := &tagit.CmdExecutor{Timeout: scriptTimeout, RunAsUser: runAsUser, RunAsGroup: runAsGroup, Env: scriptEnv}
+		if err := cmdExecutor.ResolveCredential(); err != nil {
+			logger.Error("Invalid run-as user or group", "error", err)
+			os.Exit(1)
+		}
+		postUpdateExecutor := &tagit.CmdExecutor{Timeout: scriptTimeout, RunAsUser: runAsUser, RunAsGroup: runAsGroup}
+		if err := postUpdateExecutor.ResolveCredential(); err != nil {
+			logger.Error("Invalid run-as user or group", "error", err)
+			os.Exit(1)
+		}
+		byName, err := cmd.Flags().GetBool("by-name")
+		if err != nil {
+			logger.Error("Failed to get by-name flag", "error", err)
+			os.Exit(1)
+		}
+		source, err := newTagSource(cmd)
 		if err != nil {
-			logger.Error("Invalid interval", "interval", interval, "error", err)
+			logger.Error("Invalid configuration", "error", err)
 			os.Exit(1)
 		}
+		var executor tagit.CommandExecutor = cmdExecutor
+		switch source.kind {
+		case sourceURL:
+			executor = &tagit.HTTPExecutor{Timeout: tagsURLTimeout}
+		case sourceStdin:
+			executor = &tagit.StdinExecutor{}
+		}
+
+		zeroInterval := oneShotInterval(viper.GetViper(), cmd.Flag("interval").DefValue)
 
-		config := api.DefaultConfig()
-		config.Address, err = cmd.InheritedFlags().GetString("consul-addr")
+		// With config-from-meta the scripts come from the meta of each
+		// instance, so the settings only give the service name and defaults
+		services, err := loadServiceConfigs(viper.GetViper(), source)
 		if err != nil {
-			logger.Error("Failed to get consul-addr flag", "error", err)
+			logger.Error("Invalid configuration", "error", err)
 			os.Exit(1)
 		}
-		config.Token, err = cmd.InheritedFlags().GetString("token")
+
+		checkScript, err := cmd.Flags().GetBool("check-script")
 		if err != nil {
-			logger.Error("Failed to get token flag", "error", err)
+			logger.Error("Failed to get check-script flag", "error", err)
 			os.Exit(1)
 		}
+		if checkScript && source.kind == sourceScript {
+			for _, svc := range services {
+				if err := tagit.CheckScript(svc.Script); err != nil {
+					logger.Error("Invalid script", "serviceID", svc.ServiceID, "error", err)
+					os.Exit(1)
+				}
+			}
+		}
 
-		consulClient, err := api.NewClient(config)
+		consulCfg, err := consulConfig(cmd)
+		if err != nil {
+			logger.Error("Failed to create Consul client", "error", err)
+			os.Exit(1)
+		}
+		maxConcurrentWrites, err := cmd.Flags().GetInt("max-concurrent-writes")
+		if err != nil {
+			logger.Error("Failed to get max-concurrent-writes flag", "error", err)
+			os.Exit(1)
+		}
+		if maxConcurrentWrites < 0 {
+			logger.Error("Invalid max-concurrent-writes, must not be negative", "maxConcurrentWrites", maxConcurrentWrites)
+			os.Exit(1)
+		}
+		if maxConcurrentWrites > 0 {
+			consulCfg.WriteLimiter = consul.NewWriteLimiter(maxConcurrentWrites, logger)
+		}
+		consulClients, err := newServiceClients(services, consulCfg)
 		if err != nil {
 			logger.Error("Failed to create Consul client", "error", err)
 			os.Exit(1)
 		}
 
-		serviceID, err := cmd.InheritedFlags().GetString("service-id")
+		// With config-from-meta the settings only give the service name and
+		// the defaults of the instances found on the agent
+		var (
+			discover     func(ctx context.Context) ([]serviceConfig, error)
+			metaInterval time.Duration
+		)
+		if source.kind == sourceMeta {
+			defaults := services[0]
+			// Already validated, the agent is checked for new instances at the default interval
+			metaInterval, _ = parseInterval(defaults.Interval)
+			discover = func(ctx context.Context) ([]serviceConfig, error) {
+				return metaServiceConfigs(ctx, consulClients[""], defaults, source.metaScriptDir, logger)
+			}
+			services, err = discover(context.Background())
+			if err != nil {
+				logger.Error("Failed to get services from meta", "error", err)
+				os.Exit(1)
+			}
+			if len(services) == 0 {
+				logger.Warn("No instances with a script in their meta found", "service", defaults.ServiceID, "metaKey", tagit.ScriptMetaKey)
+			}
+			if checkScript {
+				for _, svc := range services {
+					if err := tagit.CheckScript(svc.Script); err != nil {
+						logger.Error("Invalid script", "serviceID", svc.ServiceID, "error", err)
+						os.Exit(1)
+					}
+				}
+			}
+		}
+
+		preserveOrder, err := cmd.Flags().GetBool("preserve-order")
 		if err != nil {
-			logger.Error("Failed to get service-id flag", "error", err)
+			logger.Error("Failed to get preserve-order flag", "error", err)
 			os.Exit(1)
 		}
-		script, err := cmd.InheritedFlags().GetString("script")
+
+		sortCaseInsensitive, err := cmd.Flags().GetBool("sort-case-insensitive")
 		if err != nil {
-			logger.Error("Failed to get script flag", "error", err)
+			logger.Error("Failed to get sort-case-insensitive flag", "error", err)
 			os.Exit(1)
 		}
-		tagPrefix, err := cmd.InheritedFlags().GetString("tag-prefix")
+
+		groupManagedTags, err := cmd.Flags().GetBool("group-managed-tags")
 		if err != nil {
-			logger.Error("Failed to get tag-prefix flag", "error", err)
+			logger.Error("Failed to get group-managed-tags flag", "error", err)
 			os.Exit(1)
 		}
 
-		t := tagit.New(
-			tagit.NewConsulAPIWrapper(consulClient),
-			&tagit.CmdExecutor{},
-			serviceID,
-			script,
-			validInterval,
-			tagPrefix,
-			logger,
-		)
+		postUpdateCommand, err := cmd.Flags().GetString("post-update-command")
+		if err != nil {
+			logger.Error("Failed to get post-update-command flag", "error", err)
+			os.Exit(1)
+		}
+
+		excludeTags, err := cmd.InheritedFlags().GetStringSlice("exclude-tags")
+		if err != nil {
+			logger.Error("Failed to get exclude-tags flag", "error", err)
+			os.Exit(1)
+		}
+		protectTags, err := cmd.InheritedFlags().GetStringArray("protect-tag")
+		if err != nil {
+			logger.Error("Failed to get protect-tag flag", "error", err)
+			os.Exit(1)
+		}
+		removeTags, err := cmd.InheritedFlags().GetStringArray("remove-tag")
+		if err != nil {
+			logger.Error("Failed to get remove-tag flag", "error", err)
+			os.Exit(1)
+		}
+
+		logTagSeparator, err := cmd.Flags().GetString("log-tag-separator")
+		if err != nil {
+			logger.Error("Failed to get log-tag-separator flag", "error", err)
+			os.Exit(1)
+		}
+
+		staticTags, err := cmd.Flags().GetStringArray("static-tag")
+		if err != nil {
+			logger.Error("Failed to get static-tag flag", "error", err)
+			os.Exit(1)
+		}
+
+		portTag, err := cmd.Flags().GetBool("port-tag")
+		if err != nil {
+			logger.Error("Failed to get port-tag flag", "error", err)
+			os.Exit(1)
+		}
+
+		hostnameTag, err := cmd.Flags().GetBool("add-hostname-tag")
+		if err != nil {
+			logger.Error("Failed to get add-hostname-tag flag", "error", err)
+			os.Exit(1)
+		}
+
+		addressTag, err := cmd.Flags().GetBool("add-address-tag")
+		if err != nil {
+			logger.Error("Failed to get add-address-tag flag", "error", err)
+			os.Exit(1)
+		}
+
+		probeCommand, err := cmd.Flags().GetString("probe-command")
+		if err != nil {
+			logger.Error("Failed to get probe-command flag", "error", err)
+			os.Exit(1)
+		}
+		probeTags := make(map[string]string)
+		for _, name := range []string{"probe-up-tag", "probe-down-tag"} {
+			tag, err := cmd.Flags().GetString(name)
+			if err != nil {
+				logger.Error("Failed to get "+name+" flag", "error", err)
+				os.Exit(1)
+			}
+			if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) != -1 {
+				logger.Error("Invalid "+name+", must be a single non-empty tag", "tag", tag)
+				os.Exit(1)
+			}
+			probeTags[name] = tag
+		}
+
+		tagTemplateTexts, err := cmd.Flags().GetStringArray("tag-template")
+		if err != nil {
+			logger.Error("Failed to get tag-template flag", "error", err)
+			os.Exit(1)
+		}
+		tagTemplates := make([]*template.Template, 0, len(tagTemplateTexts))
+		for _, text := range tagTemplateTexts {
+			tmpl, err := tagit.ParseTagTemplate(text)
+			if err != nil {
+				logger.Error("Invalid tag-template", "error", err)
+				os.Exit(1)
+			}
+			tagTemplates = append(tagTemplates, tmpl)
+		}
+
+		stripExistingPrefix, err := cmd.Flags().GetBool("strip-existing-prefix")
+		if err != nil {
+			logger.Error("Failed to get strip-existing-prefix flag", "error", err)
+			os.Exit(1)
+		}
+
+		changeMarker, err := cmd.Flags().GetString("change-marker")
+		if err != nil {
+			logger.Error("Failed to get change-marker flag", "error", err)
+			os.Exit(1)
+		}
+
+		lineMode, err := cmd.Flags().GetBool("line-mode")
+		if err != nil {
+			logger.Error("Failed to get line-mode flag", "error", err)
+			os.Exit(1)
+		}
+
+		lowercaseTags, err := cmd.Flags().GetBool("lowercase-tags")
+		if err != nil {
+			logger.Error("Failed to get lowercase-tags flag", "error", err)
+			os.Exit(1)
+		}
+
+		outputFilter, err := cmd.Flags().GetString("output-filter")
+		if err != nil {
+			logger.Error("Failed to get output-filter flag", "error", err)
+			os.Exit(1)
+		}
+		var outputFilterRegexp *regexp.Regexp
+		if outputFilter != "" {
+			outputFilterRegexp, err = regexp.Compile(outputFilter)
+			if err != nil {
+				logger.Error("Invalid output-filter", "outputFilter", outputFilter, "error", err)
+				os.Exit(1)
+			}
+		}
+
+		ignoreLinePrefix, err := cmd.Flags().GetString("ignore-line-prefix")
+		if err != nil {
+			logger.Error("Failed to get ignore-line-prefix flag", "error", err)
+			os.Exit(1)
+		}
+
+		consulTimeout, err := cmd.Flags().GetDuration("consul-timeout")
+		if err != nil {
+			logger.Error("Failed to get consul-timeout flag", "error", err)
+			os.Exit(1)
+		}
+		if consulTimeout < 0 {
+			logger.Error("Invalid consul-timeout, must not be negative", "consulTimeout", consulTimeout)
+			os.Exit(1)
+		}
+
+		waitForFile, err := cmd.Flags().GetString("wait-for-file")
+		if err != nil {
+			logger.Error("Failed to get wait-for-file flag", "error", err)
+			os.Exit(1)
+		}
+		waitForFileTimeout, err := cmd.Flags().GetDuration("wait-for-file-timeout")
+		if err != nil {
+			logger.Error("Failed to get wait-for-file-timeout flag", "error", err)
+			os.Exit(1)
+		}
+		if waitForFileTimeout < 0 {
+			logger.Error("Invalid wait-for-file-timeout, must not be negative", "waitForFileTimeout", waitForFileTimeout)
+			os.Exit(1)
+		}
+
+		scriptBreakerThreshold, err := cmd.Flags().GetInt("script-breaker-threshold")
+		if err != nil {
+			logger.Error("Failed to get script-breaker-threshold flag", "error", err)
+			os.Exit(1)
+		}
+		if scriptBreakerThreshold < 0 {
+			logger.Error("Invalid script-breaker-threshold, must not be negative", "scriptBreakerThreshold", scriptBreakerThreshold)
+			os.Exit(1)
+		}
+		scriptBreakerCooldown, err := cmd.Flags().GetDuration("script-breaker-cooldown")
+		if err != nil {
+			logger.Error("Failed to get script-breaker-cooldown flag", "error", err)
+			os.Exit(1)
+		}
+		if scriptBreakerCooldown <= 0 {
+			logger.Error("Invalid script-breaker-cooldown, must be positive", "scriptBreakerCooldown", scriptBreakerCooldown)
+			os.Exit(1)
+		}
+
+		scriptJitter, err := cmd.Flags().GetDuration("script-jitter")
+		if err != nil {
+			logger.Error("Failed to get script-jitter flag", "error", err)
+			os.Exit(1)
+		}
+		if scriptJitter < 0 {
+			logger.Error("Invalid script-jitter, must not be negative", "scriptJitter", scriptJitter)
+			os.Exit(1)
+		}
+
+		cronSpec, err := cmd.Flags().GetString("cron")
+		if err != nil {
+			logger.Error("Failed to get cron flag", "error", err)
+			os.Exit(1)
+		}
+		var schedule *cron.Schedule
+		if cronSpec != "" {
+			schedule, err = cron.Parse(cronSpec)
+			if err != nil {
+				logger.Error("Invalid cron", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		failFast, err := cmd.Flags().GetBool("fail-fast")
+		if err != nil {
+			logger.Error("Failed to get fail-fast flag", "error", err)
+			os.Exit(1)
+		}
+
+		kvPath, err := cmd.Flags().GetString("kv-path")
+		if err != nil {
+			logger.Error("Failed to get kv-path flag", "error", err)
+			os.Exit(1)
+		}
+		if kvPath != "" && byName {
+			logger.Error("Invalid configuration", "error", "kv-path cannot be combined with by-name, every instance would write the same key")
+			os.Exit(1)
+		}
+
+		tagsOutputFile, err := cmd.Flags().GetString("tags-output-file")
+		if err != nil {
+			logger.Error("Failed to get tags-output-file flag", "error", err)
+			os.Exit(1)
+		}
+		if tagsOutputFile != "" && byName {
+			logger.Error("Invalid configuration", "error", "tags-output-file cannot be combined with by-name, every instance would write the same file")
+			os.Exit(1)
+		}
+
+		exclusive, err := cmd.Flags().GetBool("exclusive")
+		if err != nil {
+			logger.Error("Failed to get exclusive flag", "error", err)
+			os.Exit(1)
+		}
+
+		auditMeta, err := cmd.Flags().GetBool("audit-meta")
+		if err != nil {
+			logger.Error("Failed to get audit-meta flag", "error", err)
+			os.Exit(1)
+		}
+
+		lockPrefix, err := cmd.Flags().GetString("lock-prefix")
+		if err != nil {
+			logger.Error("Failed to get lock-prefix flag", "error", err)
+			os.Exit(1)
+		}
+
+		replace, err := cmd.Flags().GetBool("replace")
+		if err != nil {
+			logger.Error("Failed to get replace flag", "error", err)
+			os.Exit(1)
+		}
+
+		outputEncoding, err := cmd.Flags().GetString("output-encoding")
+		if err != nil {
+			logger.Error("Failed to get output-encoding flag", "error", err)
+			os.Exit(1)
+		}
+		if err := tagit.ValidateOutputEncoding(outputEncoding); err != nil {
+			logger.Error("Invalid output-encoding", "error", err)
+			os.Exit(1)
+		}
+
+		emptyOutput, err := cmd.Flags().GetString("empty-output")
+		if err != nil {
+			logger.Error("Failed to get empty-output flag", "error", err)
+			os.Exit(1)
+		}
+		if err := tagit.ValidateEmptyOutput(emptyOutput); err != nil {
+			logger.Error("Invalid empty-output", "error", err)
+			os.Exit(1)
+		}
 
-		ctx, cancel := context.WithCancel(context.Background())
+		onlyIfHealthy, err := cmd.Flags().GetBool("only-if-healthy")
+		if err != nil {
+			logger.Error("Failed to get only-if-healthy flag", "error", err)
+			os.Exit(1)
+		}
+
+		skipInMaintenance, err := cmd.Flags().GetBool("skip-in-maintenance")
+		if err != nil {
+			logger.Error("Failed to get skip-in-maintenance flag", "error", err)
+			os.Exit(1)
+		}
+
+		allowStale, err := cmd.Flags().GetBool("allow-stale")
+		if err != nil {
+			logger.Error("Failed to get allow-stale flag", "error", err)
+			os.Exit(1)
+		}
+
+		useCache, err := cmd.Flags().GetBool("use-cache")
+		if err != nil {
+			logger.Error("Failed to get use-cache flag", "error", err)
+			os.Exit(1)
+		}
+
+		forceReregister, err := cmd.Flags().GetBool("force-reregister")
+		if err != nil {
+			logger.Error("Failed to get force-reregister flag", "error", err)
+			os.Exit(1)
+		}
+
+		metricsAddr, err := cmd.Flags().GetString("metrics-addr")
+		if err != nil {
+			logger.Error("Failed to get metrics-addr flag", "error", err)
+			os.Exit(1)
+		}
+		var tagMetrics *metrics.Metrics
+		if metricsAddr != "" {
+			tagMetrics = metrics.New()
+		}
+
+		otelEndpoint, err := cmd.Flags().GetString("otel-endpoint")
+		if err != nil {
+			logger.Error("Failed to get otel-endpoint flag", "error", err)
+			os.Exit(1)
+		}
+		var tracer trace.Tracer
+		shutdownTracing := func() {}
+		if otelEndpoint != "" {
+			tracerProvider, err := tracing.NewTracerProvider(otelEndpoint)
+			if err != nil {
+				logger.Error("Invalid configuration", "error", err)
+				os.Exit(1)
+			}
+			tracer = tracerProvider.Tracer(tracing.TracerName)
+			shutdownTracing = func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := tracerProvider.Shutdown(ctx); err != nil {
+					logger.Error("Failed to flush traces", "error", err)
+				}
+			}
+		}
+		defer shutdownTracing()
+		// exit flushes the traces first, as os.Exit skips the deferred calls
+		exit := func(code int) {
+			shutdownTracing()
+			os.Exit(code)
+		}
+
+		tagIts, err := newTagIts(services, consulClients, executor, logger)
+		if err != nil {
+			logger.Error("Invalid configuration", "error", err)
+			exit(1)
+		}
+
+		// configure applies the run flags to the TagIt of a service
+		configure := func(t *tagit.TagIt) {
+			t.PreserveOrder = preserveOrder
+			t.CaseInsensitiveSort = sortCaseInsensitive
+			t.GroupManagedTags = groupManagedTags
+			t.ExcludeTags = excludeTags
+			t.ProtectTags = protectTags
+			t.RemoveTags = removeTags
+			t.LogTagSeparator = logTagSeparator
+			t.StaticTags = staticTags
+			t.PortTag = portTag
+			t.HostnameTag = hostnameTag
+			t.AddressTag = addressTag
+			t.ProbeCommand = probeCommand
+			t.ProbeUpTag = probeTags["probe-up-tag"]
+			t.ProbeDownTag = probeTags["probe-down-tag"]
+			t.ProbeExecutor = cmdExecutor
+			t.TagTemplates = tagTemplates
+			t.ChangeMarker = changeMarker
+			t.OnlyIfHealthy = onlyIfHealthy
+			t.SkipInMaintenance = skipInMaintenance
+			// The instances found from meta are each managed on their own
+			t.ByName = byName && source.kind != sourceMeta
+			t.AllowStale = allowStale
+			t.UseCache = useCache
+			t.ForceReregister = forceReregister
+			if tagMetrics != nil {
+				t.Metrics = tagMetrics
+			}
+			t.Tracer = tracer
+			t.StripExistingPrefix = stripExistingPrefix
+			t.LineMode = lineMode
+			t.LowercaseTags = lowercaseTags
+			t.OutputFilter = outputFilterRegexp
+			t.IgnoreLinePrefix = ignoreLinePrefix
+			t.EmptyOutput = emptyOutput
+			t.OutputEncoding = outputEncoding
+			t.ConsulTimeout = consulTimeout
+			t.WaitForFile = waitForFile
+			t.FailFast = failFast
+			if schedule != nil {
+				t.Schedule = schedule
+			}
+			t.Replace = replace
+			t.Exclusive = exclusive
+			t.KVPath = kvPath
+			t.TagsOutputFile = tagsOutputFile
+			t.AuditMeta = auditMeta
+			if lockPrefix != "" {
+				t.LockKey = path.Join(lockPrefix, t.ServiceID)
+			}
+			t.ScriptJitter = scriptJitter
+			t.ScriptBreakerThreshold = scriptBreakerThreshold
+			t.ScriptBreakerCooldown = scriptBreakerCooldown
+			t.WaitForFileTimeout = waitForFileTimeout
+			if postUpdateCommand != "" {
+				serviceID := t.ServiceID
+				// The command runs within the update cycle, so it is bounded by
+				// script-timeout and killed on shutdown
+				t.OnUpdate = func(ctx context.Context, added, removed []string) {
+					logger.Info("running post-update command",
+						"service", serviceID,
+						"command", postUpdateCommand,
+						"added", added,
+						"removed", removed)
+					if _, err := postUpdateExecutor.ExecuteContext(ctx, postUpdateCommand); err != nil {
+						logger.Error("Post-update command failed", "command", postUpdateCommand, "error", err)
+					}
+				}
+			}
+		}
+		for _, t := range tagIts {
+			configure(t)
+		}
+
+		once, err := cmd.Flags().GetBool("once")
+		if err != nil {
+			logger.Error("Failed to get once flag", "error", err)
+			exit(1)
+		}
+		if source.kind == sourceStdin && !once && !zeroInterval {
+			logger.Error("Invalid configuration", "error", "from-stdin requires --once, as stdin is only read once")
+			exit(1)
+		}
+		if lockPrefix != "" && (once || zeroInterval) {
+			logger.Error("Invalid configuration", "error", "lock-prefix cannot be combined with once or a zero interval, a single update does not wait for the lock")
+			exit(1)
+		}
+		if once || zeroInterval {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			code := runOnce(ctx, tagIts, logger)
+			stop()
+			exit(code)
+		}
+
+		maxRuntime, err := cmd.Flags().GetDuration("max-runtime")
+		if err != nil {
+			logger.Error("Failed to get max-runtime flag", "error", err)
+			exit(1)
+		}
+		if maxRuntime < 0 {
+			logger.Error("Invalid max-runtime, must not be negative", "maxRuntime", maxRuntime)
+			exit(1)
+		}
+
+		watch, err := cmd.Flags().GetBool("watch-config")
+		if err != nil {
+			logger.Error("Failed to get watch-config flag", "error", err)
+			exit(1)
+		}
+
+		cleanupRemoved, err := cmd.Flags().GetBool("cleanup-removed")
+		if err != nil {
+			logger.Error("Failed to get cleanup-removed flag", "error", err)
+			exit(1)
+		}
+
+		ctx, cancel := withMaxRuntime(context.Background(), maxRuntime)
 		defer cancel()
 
-		// Setup signal handling for graceful shutdown
+		sup := newSupervisor(ctx, logger)
+		if tagMetrics != nil {
+			server, addr, err := startMetricsServer(metricsAddr, tagMetrics, statusHandler(sup.tagIts), logger)
+			if err != nil {
+				logger.Error("Failed to start metrics server", "error", err)
+				exit(1)
+			}
+			defer server.Close()
+			logger.Info("Serving metrics", "addr", addr.String())
+		}
+
+		sup.cleanupRemoved = cleanupRemoved
+		sup.newTagIt = func(service serviceConfig) (*tagit.TagIt, error) {
+			if checkScript && source.kind == sourceScript {
+				if err := tagit.CheckScript(service.Script); err != nil {
+					return nil, err
+				}
+			}
+			if _, ok := consulClients[service.ConsulAddr]; !ok {
+				clients, err := newServiceClients([]serviceConfig{service}, consulCfg)
+				if err != nil {
+					return nil, err
+				}
+				consulClients[service.ConsulAddr] = clients[service.ConsulAddr]
+			}
+			added, err := newTagIts([]serviceConfig{service}, consulClients, executor, logger)
+			if err != nil {
+				return nil, err
+			}
+			configure(added[0])
+			return added[0], nil
+		}
+		for i, t := range tagIts {
+			sup.start(services[i], t)
+		}
+
+		reload := func() error { return reloadConfig(viper.GetViper(), sup, source) }
+		if source.kind == sourceMeta {
+			reload = func() error { return reconcileMetaServices(ctx, sup, discover) }
+			go watchMetaServices(ctx, sup, discover, metaInterval, logger)
+		}
+
+		if watch {
+			if source.kind == sourceMeta {
+				logger.Error("Invalid configuration", "error", "watch-config cannot be combined with config-from-meta")
+				exit(1)
+			}
+			if viper.ConfigFileUsed() == "" {
+				logger.Error("Invalid configuration", "error", "watch-config requires a config file")
+				exit(1)
+			}
+			watchConfig(viper.GetViper(), sup, source, logger)
+		}
+
+		// Setup signal handling for graceful shutdown and reload
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
 		go func() {
-			sig := <-sigCh
-			logger.Info("Received signal, shutting down", "signal", sig)
-			cancel()
+			for sig := range sigCh {
+				if sig == syscall.SIGHUP {
+					logger.Info("Received signal, reloading configuration", "signal", sig)
+					if err := reload(); err != nil {
+						logger.Error("Failed to reload configuration", "error", err)
+					}
+					continue
+				}
+				if sig == syscall.SIGUSR1 {
+					logger.Info("Received signal, forcing an update", "signal", sig)
+					for _, t := range sup.tagIts() {
+						t.TriggerUpdate()
+					}
+					continue
+				}
+				logger.Info("Received signal, shutting down", "signal", sig)
+				cancel()
+				return
+			}
 		}()
 
-		logger.Info("Starting tagit",
-			"serviceID", serviceID,
-			"script", script,
-			"interval", validInterval,
-			"tagPrefix", tagPrefix)
-
-		t.Run(ctx)
+		if err := sup.wait(); err != nil {
+			logger.Error("Tagit failed", "error", err)
+			exit(1)
+		}
 
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Info("Max runtime reached", "maxRuntime", maxRuntime)
+		}
 		logger.Info("Tagit has stopped")
 	},
 }
 
+// withMaxRuntime returns a context that is cancelled after maxRuntime, or
+// only when cancel is called if maxRuntime is zero.
+func withMaxRuntime(ctx context.Context, maxRuntime time.Duration) (context.Context, context.CancelFunc) {
+	if maxRuntime > 0 {
+		return context.WithTimeout(ctx, maxRuntime)
+	}
+	return context.WithCancel(ctx)
+}
+
+// startMetricsServer serves the metrics on addr under /metrics, and status
+// under /status, until the returned server is closed.
+func startMetricsServer(addr string, m *metrics.Metrics, status http.Handler, logger *slog.Logger) (*http.Server, net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.Handle("/status", status)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", "error", err)
+		}
+	}()
+	return server, listener.Addr(), nil
+}
+
+// statusHandler serves the run history of the TagIts returned by tagIts as a
+// JSON object keyed by service ID.
+func statusHandler(tagIts func() []*tagit.TagIt) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string][]tagit.RunResult)
+		for _, t := range tagIts() {
+			status[t.ServiceID] = t.History()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// systemdFields maps the settings of a single service run to the fields of
+// the systemd unit running it.
+func systemdFields(cmd *cobra.Command, v *viper.Viper) (*systemd.Fields, error) {
+	if v.IsSet("services") {
+		return nil, fmt.Errorf("a systemd unit can only be printed for a single service, not a services list")
+	}
+
+	flags := make(map[string]string)
+	for _, name := range []string{"service-id", "script", "tag-prefix", "interval", "token", "consul-addr"} {
+		flags[name] = v.GetString(name)
+	}
+	for _, name := range []string{"user", "group"} {
+		value, err := cmd.Flags().GetString("systemd-" + name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get systemd-%s flag: %w", name, err)
+		}
+		flags[name] = value
+	}
+	return systemd.NewFieldsFromFlags(flags)
+}
+
+// Exit codes used by run --once.
+const (
+	exitCodeNoChange = 0
+	exitCodeError    = 1
+	exitCodeChanged  = 2
+)
+
+// parseScriptEnv parses KEY=VALUE pairs into the variables of the script
+// environment. The value may be empty or contain =, the key may not.
+func parseScriptEnv(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" || strings.ContainsAny(key, " \t\x00") {
+			return nil, fmt.Errorf("invalid script-env %q: must be KEY=VALUE", pair)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// oneShotInterval reports whether the interval of v is zero, such as 0 or
+// 0s, which asks for a single update cycle like --once. The interval is then
+// replaced with defaultInterval so the service configs still validate.
+func oneShotInterval(v *viper.Viper, defaultInterval string) bool {
+	duration, err := time.ParseDuration(v.GetString("interval"))
+	if err != nil || duration != 0 {
+		return false
+	}
+	v.Set("interval", defaultInterval)
+	return true
+}
+
+// runOnce runs a single update cycle for each TagIt and returns the exit code.
+// An error in any service takes precedence over a change. Cancelling ctx
+// aborts the cycle in progress.
+func runOnce(ctx context.Context, tagIts []*tagit.TagIt, logger *slog.Logger) int {
+	code := exitCodeNoChange
+	for _, t := range tagIts {
+		changed, err := t.RunOnceContext(ctx)
+		if err != nil {
+			logger.Error("error updating service tags",
+				"service", t.ServiceID,
+				"error", err)
+			code = exitCodeError
+			continue
+		}
+		if changed && code == exitCodeNoChange {
+			code = exitCodeChanged
+		}
+	}
+	return code
+}
+
+// reloadMu serializes the config reloads of SIGHUP and the config watcher.
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads the config file and reconciles the services of s with
+// it: added services are started, removed ones are stopped and the others get
+// the reloadable settings (script, tag-prefix and interval). The tags keep
+// coming from source. An invalid config leaves all services as they were.
+func reloadConfig(v *viper.Viper, s *supervisor, source tagSource) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if v.ConfigFileUsed() != "" {
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+
+	services, err := loadServiceConfigs(v, source)
+	if err != nil {
+		return err
+	}
+	return s.reconcile(services)
+}
+
+// watchConfig reloads the config into s whenever the config file of v is
+// written, as SIGHUP does.
+func watchConfig(v *viper.Viper, s *supervisor, source tagSource, logger *slog.Logger) {
+	v.OnConfigChange(func(event fsnotify.Event) {
+		logger.Info("Config file changed, reloading configuration", "file", event.Name)
+		if err := reloadConfig(v, s, source); err != nil {
+			logger.Error("Failed to reload configuration", "error", err)
+		}
+	})
+	v.WatchConfig()
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().String("post-update-command", "", "command to run after the service tags were changed, killed after script-timeout or on shutdown")
+	runCmd.Flags().String("log-tag-separator", "", "log updated tags as a single string joined by this separator")
+	runCmd.Flags().StringArray("static-tag", nil, "tag added on every cycle in addition to the script output, can be repeated")
+	runCmd.Flags().Bool("port-tag", false, "add a port-<port> tag with the port of the service on every cycle")
+	runCmd.Flags().Bool("add-hostname-tag", false, "add a host-<hostname> tag with the hostname of the machine on every cycle")
+	runCmd.Flags().Bool("add-address-tag", false, "add an addr-<address> tag with the address of the service on every cycle")
+	runCmd.Flags().String("probe-command", "", "command run on every cycle to add the probe-up-tag when it exits with 0 and the probe-down-tag when it exits with another code, its output is ignored")
+	runCmd.Flags().String("probe-up-tag", tagit.DefaultProbeUpTag, "tag added when the probe-command succeeds")
+	runCmd.Flags().String("probe-down-tag", tagit.DefaultProbeDownTag, "tag added when the probe-command fails")
+	runCmd.Flags().StringArray("tag-template", nil, "Go template rendered against the Consul service on every cycle, producing a tag, e.g. region-{{ .Meta.region }}, can be repeated")
+	runCmd.Flags().String("change-marker", "", "tag added for one cycle when the script output changed since the previous cycle")
+	runCmd.Flags().Bool("line-mode", false, "use each line of the script output as a tag instead of each word")
+	runCmd.Flags().Bool("lowercase-tags", false, "lowercase every managed tag, static and template tags included, and match the tag prefix regardless of case")
+	runCmd.Flags().String("output-filter", "", "regular expression the script output lines must match to be used as tags")
+	runCmd.Flags().String("ignore-line-prefix", "", "ignore script output lines starting with this prefix, such as #")
+	runCmd.Flags().String("output-encoding", tagit.OutputEncodingUTF8, "encoding of the script output, utf-8 or latin1")
+	runCmd.Flags().String("empty-output", tagit.EmptyOutputClear, "what to do when the script output has no tags: clear removes the managed tags, keep leaves them and error fails the cycle")
+	runCmd.Flags().Bool("strip-existing-prefix", false, "do not prefix script output that already carries the tag prefix")
+	runCmd.Flags().Bool("only-if-healthy", false, "skip updates while the service health is critical")
+	runCmd.Flags().Bool("skip-in-maintenance", false, "skip updates while the service is in maintenance mode")
+	runCmd.Flags().Bool("by-name", false, "treat service-id as a service name and update all its instances on the agent")
+	runCmd.Flags().Bool("config-from-meta", false, "with by-name, take the script, tag-prefix and interval of each instance from its tagit-script, tagit-prefix and tagit-interval meta, ignoring instances without tagit-script")
+	runCmd.Flags().String("meta-script-dir", "", "with config-from-meta, the absolute path of the directory holding the only scripts the tagit-script meta may name")
+	runCmd.Flags().Bool("allow-stale", false, "allow stale service lookups, reducing leader load at the cost of consistency")
+	runCmd.Flags().Bool("use-cache", false, "use the agent cache for service lookups, which may return slightly outdated tags")
+	runCmd.Flags().String("metrics-addr", "", "address to serve the tag change metrics on under /metrics, disabled when empty")
+	runCmd.Flags().String("otel-endpoint", "", "OTLP/HTTP collector to send the traces of the update cycles to, such as http://localhost:4318, disabled when empty")
+	runCmd.Flags().Bool("force-reregister", false, "deregister and register the service again when consul rejects an update as invalid, briefly removing it; services with health checks are never re-registered")
+	runCmd.Flags().String("cron", "", "cron expression such as '* * * * *' scheduling the updates instead of the interval")
+	runCmd.Flags().Duration("script-jitter", 0, "wait a random time up to this long before each script run, to spread the load of a fleet")
+	runCmd.Flags().String("wait-for-file", "", "wait for this file to exist before the first update")
+	runCmd.Flags().Duration("wait-for-file-timeout", 5*time.Minute, "how long to wait for wait-for-file before updating anyway, 0 means forever")
+	runCmd.Flags().Duration("max-runtime", 0, "stop after running for this long, 0 means unlimited")
+	runCmd.Flags().Bool("once", false, "run a single update cycle and exit")
+	runCmd.Flags().Bool("fail-fast", false, "exit with an error when the first update cycle fails instead of retrying")
+	runCmd.Flags().String("kv-path", "", "consul kv key the managed tags of the single service are written to as json on the first cycle and whenever they change")
+	runCmd.Flags().String("tags-output-file", "", "local file the managed tags of the single service are written to as json on the first cycle and whenever they change, replaced atomically")
+	runCmd.Flags().Bool("audit-meta", false, "record the time and the managed tags of each change in the service meta")
+	runCmd.Flags().String("lock-prefix", "", "consul kv prefix of a per-service lock, so only the instance holding it updates the service, not allowed with once")
+	runCmd.Flags().Bool("exclusive", false, "own the whole tag list, removing every tag that is not generated, excluded or protected, even without the prefix")
+	runCmd.Flags().Bool("replace", false, "drop all prefixed tags and add the new set in one registration, whenever the result differs in any way")
+	runCmd.Flags().Bool("check-script", false, "fail at startup unless the script, when given as a path, exists and is executable")
+	runCmd.Flags().Int("script-breaker-threshold", 0, "skip the script for script-breaker-cooldown after this many consecutive failures, 0 disables the breaker")
+	runCmd.Flags().Duration("script-breaker-cooldown", tagit.DefaultScriptBreakerCooldown, "how long the script is skipped once script-breaker-threshold is reached, before a single retry")
+	runCmd.Flags().Duration("script-timeout", 0, "kill the script once it ran this long, 0 means no timeout")
+	runCmd.Flags().StringArray("script-env", nil, "KEY=VALUE variable added to the environment of the script, can be repeated")
+	runCmd.Flags().String("run-as-user", "", "run the script, probe and post-update commands as this user, by name or id, usually requires root")
+	runCmd.Flags().String("run-as-group", "", "run the script, probe and post-update commands as this group, by name or id, defaults to the primary group of run-as-user")
+	runCmd.Flags().String("tags-url", "", "url to GET the tags from instead of running a script")
+	runCmd.Flags().Bool("from-stdin", false, "read the tags from stdin instead of running a script, requires --once")
+	runCmd.Flags().Duration("tags-url-timeout", 10*time.Second, "timeout of each request to tags-url, 0 means no timeout")
+	runCmd.Flags().Int("max-concurrent-writes", 0, "cap the registrations and other writes to consul in flight at once across all services, 0 means unlimited")
+	runCmd.Flags().Bool("watch-config", false, "reload the config file whenever it changes, starting and stopping services as they are added or removed")
+	runCmd.Flags().Bool("cleanup-removed", false, "remove the managed tags of services dropped from the config on reload")
+	runCmd.Flags().Bool("print-systemd", false, "print the systemd unit running this service and exit")
+	runCmd.Flags().String("systemd-user", "tagit", "user of the unit printed by print-systemd")
+	runCmd.Flags().String("systemd-group", "tagit", "group of the unit printed by print-systemd")
+	runCmd.Flags().Bool("preserve-order", false, "keep the script output order for tags instead of sorting them")
+	runCmd.Flags().Bool("sort-case-insensitive", false, "sort tags ignoring case, has no effect with preserve-order")
+	runCmd.Flags().Bool("group-managed-tags", false, "keep the unmanaged tags first and the managed tags after them, each sorted on its own, has no effect with preserve-order")
 }
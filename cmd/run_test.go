@@ -0,0 +1,1027 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/consul"
+	"github.com/ncode/tagit/pkg/metrics"
+	"github.com/ncode/tagit/pkg/systemd"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockConsulClient implements the tagit.ConsulClient interface, recording registered tags per service.
+type MockConsulClient struct {
+	mu           sync.Mutex
+	tags         map[string][]string
+	ServiceError error
+	// RegisterErrors fails the registrations of the services it holds.
+	RegisterErrors map[string]error
+	// Services, when set, are listed instead of the services with tags.
+	Services map[string]*api.AgentService
+	// registrations counts the calls to ServiceRegister.
+	registrations int
+}
+
+func NewMockConsulClient() *MockConsulClient {
+	return &MockConsulClient{tags: make(map[string][]string)}
+}
+
+func (m *MockConsulClient) Agent() tagit.ConsulAgent {
+	return m
+}
+
+func (m *MockConsulClient) KV() tagit.ConsulKV {
+	return m
+}
+
+func (m *MockConsulClient) LockKey(key string) (tagit.ConsulLock, error) {
+	return nil, fmt.Errorf("locks are not supported by the mock client")
+}
+
+func (m *MockConsulClient) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	return nil, nil
+}
+
+func (m *MockConsulClient) Service(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ServiceError != nil {
+		return nil, nil, m.ServiceError
+	}
+	return &api.AgentService{ID: serviceID, Service: serviceID, Tags: m.tags[serviceID]}, nil, nil
+}
+
+func (m *MockConsulClient) ServiceRegister(reg *api.AgentServiceRegistration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations++
+	if err := m.RegisterErrors[reg.ID]; err != nil {
+		return err
+	}
+	m.tags[reg.ID] = reg.Tags
+	return nil
+}
+
+// registerCalls returns how many times a service was registered.
+func (m *MockConsulClient) registerCalls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registrations
+}
+
+func (m *MockConsulClient) ServiceRegisterContext(ctx context.Context, reg *api.AgentServiceRegistration, opts api.ServiceRegisterOpts) error {
+	return m.ServiceRegister(reg)
+}
+
+func (m *MockConsulClient) ServicesWithFilterOpts(filter string, q *api.QueryOptions) (map[string]*api.AgentService, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Services != nil {
+		return maps.Clone(m.Services), nil
+	}
+	services := make(map[string]*api.AgentService, len(m.tags))
+	for serviceID, tags := range m.tags {
+		services[serviceID] = &api.AgentService{ID: serviceID, Service: serviceID, Tags: tags}
+	}
+	return services, nil
+}
+
+func (m *MockConsulClient) ServiceDeregisterOpts(serviceID string, q *api.QueryOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tags, serviceID)
+	return nil
+}
+
+func (m *MockConsulClient) AgentHealthServiceByIDOpts(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+	return api.HealthPassing, nil, nil
+}
+
+func (m *MockConsulClient) Tags(serviceID string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tags[serviceID]
+}
+
+// loadTestConfig writes contents to a temporary config file and loads it into a new viper.
+func loadTestConfig(t *testing.T, contents string) (*viper.Viper, string) {
+	path := filepath.Join(t.TempDir(), "tagit.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	assert.NoError(t, v.ReadInConfig())
+	return v, path
+}
+
+// newTestSupervisor returns a supervisor creating the TagIts of added
+// services against consulClient.
+func newTestSupervisor(ctx context.Context, consulClient consul.Client, logger *slog.Logger) *supervisor {
+	s := newSupervisor(ctx, logger)
+	s.newTagIt = func(service serviceConfig) (*tagit.TagIt, error) {
+		tagIts, err := newTagIts([]serviceConfig{service}, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+		if err != nil {
+			return nil, err
+		}
+		return tagIts[0], nil
+	}
+	return s
+}
+
+// serviceIDs returns the service IDs of the running TagIts of s.
+func serviceIDs(s *supervisor) []string {
+	var ids []string
+	for _, t := range s.tagIts() {
+		ids = append(ids, t.ServiceID)
+	}
+	return ids
+}
+
+func TestReloadConfig(t *testing.T) {
+	v, path := loadTestConfig(t, "service-id: test-service\nscript: echo old\ntag-prefix: old\ninterval: 30s\n")
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tg, err := tagit.New(NewMockConsulClient(), &tagit.CmdExecutor{}, "test-service", "echo old", 30*time.Second, "old", logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSupervisor(ctx, NewMockConsulClient(), logger)
+	s.start(serviceConfig{ServiceID: "test-service", Script: "echo old", TagPrefix: "old", Interval: "30s"}, tg)
+
+	assert.NoError(t, os.WriteFile(path, []byte("service-id: test-service\nscript: echo new\ntag-prefix: new\ninterval: 5s\n"), 0o600))
+	assert.NoError(t, reloadConfig(v, s, tagSource{}))
+	assert.Equal(t, "echo new", tg.Script)
+	assert.Equal(t, "new", tg.TagPrefix)
+	assert.Equal(t, 5*time.Second, tg.Interval)
+	assert.Equal(t, []*tagit.TagIt{tg}, s.tagIts(), "Expected the running TagIt to be reloaded in place")
+
+	assert.NoError(t, os.WriteFile(path, []byte("service-id: test-service\nscript: echo broken\ntag-prefix: broken\ninterval: soon\n"), 0o600))
+	err = reloadConfig(v, s, tagSource{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid interval")
+	assert.Equal(t, "new", tg.TagPrefix, "A failed reload should keep the previous settings")
+
+	assert.NoError(t, os.WriteFile(path, []byte("service-id: other-service\nscript: echo other\ntag-prefix: other\ninterval: 5s\n"), 0o600))
+	assert.NoError(t, reloadConfig(v, s, tagSource{}))
+	assert.Equal(t, []string{"other-service"}, serviceIDs(s), "Expected the renamed service to replace the old one")
+
+	cancel()
+	assert.NoError(t, s.wait())
+}
+
+func TestWatchConfig(t *testing.T) {
+	config := func(services ...string) string {
+		contents := "interval: 10ms\nservices:\n"
+		for _, service := range services {
+			contents += fmt.Sprintf("  - service-id: service-%s\n    script: echo %s\n    tag-prefix: %s\n", service, service, service)
+		}
+		return contents
+	}
+	v, path := loadTestConfig(t, config("a", "b"))
+	services, err := loadServiceConfigs(v, tagSource{})
+	assert.NoError(t, err)
+
+	consulClient := NewMockConsulClient()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSupervisor(ctx, consulClient, logger)
+	s.cleanupRemoved = true
+	for i, t := range tagIts {
+		s.start(services[i], t)
+	}
+	done := make(chan error)
+	go func() { done <- s.wait() }()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"a-a"}, consulClient.Tags("service-a")) &&
+			assert.ObjectsAreEqual([]string{"b-b"}, consulClient.Tags("service-b"))
+	}, time.Second, 5*time.Millisecond, "Expected the initial services to be tagged")
+
+	watchConfig(v, s, tagSource{}, logger)
+	assert.NoError(t, os.WriteFile(path, []byte(config("b", "c")), 0o600))
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"service-b", "service-c"}, serviceIDs(s))
+	}, 2*time.Second, 5*time.Millisecond, "Expected the loops to follow the rewritten config")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"c-c"}, consulClient.Tags("service-c"))
+	}, time.Second, 5*time.Millisecond, "Expected the added service to be tagged")
+	assert.Empty(t, consulClient.Tags("service-a"), "Expected the removed service to be cleaned up")
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("The supervisor did not stop after the context was cancelled")
+	}
+}
+
+func TestMetaServiceConfigs(t *testing.T) {
+	consulClient := NewMockConsulClient()
+	consulClient.Services = map[string]*api.AgentService{
+		"web-1": {ID: "web-1", Service: "web", Meta: map[string]string{
+			tagit.ScriptMetaKey:   "/opt/tagit/one.sh",
+			tagit.PrefixMetaKey:   "one",
+			tagit.IntervalMetaKey: "5s",
+		}},
+		"web-2":  {ID: "web-2", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/two.sh"}},
+		"web-3":  {ID: "web-3", Service: "web", Meta: map[string]string{tagit.PrefixMetaKey: "three"}},
+		"web-4":  {ID: "web-4", Service: "web"},
+		"web-5":  {ID: "web-5", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/five.sh", tagit.IntervalMetaKey: "soon"}},
+		"db-1":   {ID: "db-1", Service: "db", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/db.sh"}},
+		"web-10": {ID: "web-10", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/ten.sh", tagit.PrefixMetaKey: " ten "}},
+		"web-11": {ID: "web-11", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "echo eleven"}},
+		"web-12": {ID: "web-12", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/../../bin/sh"}},
+		"web-13": {ID: "web-13", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit/one.sh --all"}},
+		"web-14": {ID: "web-14", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: "/opt/tagit-other/one.sh"}},
+	}
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	defaults := serviceConfig{ServiceID: "web", TagPrefix: "tagged", Interval: "60s"}
+	services, err := metaServiceConfigs(context.Background(), consulClient, defaults, "/opt/tagit", logger)
+	assert.NoError(t, err)
+	assert.Equal(t, []serviceConfig{
+		{ServiceID: "web-1", Script: "/opt/tagit/one.sh", TagPrefix: "one", Interval: "5s"},
+		{ServiceID: "web-10", Script: "/opt/tagit/ten.sh", TagPrefix: "ten", Interval: "60s"},
+		{ServiceID: "web-2", Script: "/opt/tagit/two.sh", TagPrefix: "tagged", Interval: "60s"},
+	}, services, "Expected only the instances of web with a script meta in the script dir, with the defaults for the missing meta")
+	assert.Contains(t, logs.String(), "ignoring service with invalid meta")
+	for _, serviceID := range []string{"web-5", "web-11", "web-12", "web-13", "web-14"} {
+		assert.Contains(t, logs.String(), "serviceID="+serviceID)
+	}
+
+	consulClient.Services = map[string]*api.AgentService{"web-4": {ID: "web-4", Service: "web"}}
+	services, err = metaServiceConfigs(context.Background(), consulClient, defaults, "/opt/tagit", logger)
+	assert.NoError(t, err)
+	assert.Empty(t, services, "Expected instances without meta to be ignored")
+}
+
+func TestMetaDefaults(t *testing.T) {
+	v, _ := loadTestConfig(t, "service-id: web\ntag-prefix: ' web '\ninterval: 30s\n")
+	defaults, err := metaDefaults(v)
+	assert.NoError(t, err)
+	assert.Equal(t, serviceConfig{ServiceID: "web", TagPrefix: "web", Interval: "30s"}, defaults, "Expected the defaults without a script")
+
+	v, _ = loadTestConfig(t, "tag-prefix: web\ninterval: 30s\n")
+	_, err = metaDefaults(v)
+	assert.ErrorContains(t, err, "service-id is required")
+}
+
+// writeMetaScript writes an executable script printing output to dir and
+// returns its path.
+func writeMetaScript(t *testing.T, dir, name, output string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho "+output+"\n"), 0o755))
+	return path
+}
+
+func TestReconcileMetaServices(t *testing.T) {
+	scriptDir := t.TempDir()
+	consulClient := NewMockConsulClient()
+	consulClient.Services = map[string]*api.AgentService{
+		"web-1": {ID: "web-1", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: writeMetaScript(t, scriptDir, "one.sh", "one")}},
+		"web-2": {ID: "web-2", Service: "web"},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defaults := serviceConfig{ServiceID: "web", TagPrefix: "tagged", Interval: "10ms"}
+	discover := func(ctx context.Context) ([]serviceConfig, error) {
+		return metaServiceConfigs(ctx, consulClient, defaults, scriptDir, logger)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSupervisor(ctx, consulClient, logger)
+	s.cleanupRemoved = true
+	done := make(chan error)
+	go func() { done <- s.wait() }()
+
+	assert.NoError(t, reconcileMetaServices(ctx, s, discover))
+	assert.Equal(t, []string{"web-1"}, serviceIDs(s))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"tagged-one"}, consulClient.Tags("web-1"))
+	}, time.Second, 5*time.Millisecond, "Expected the instance with a script meta to be tagged")
+
+	go watchMetaServices(ctx, s, discover, 10*time.Millisecond, logger)
+	consulClient.mu.Lock()
+	consulClient.Services = map[string]*api.AgentService{
+		"web-1": {ID: "web-1", Service: "web"},
+		"web-2": {ID: "web-2", Service: "web", Meta: map[string]string{tagit.ScriptMetaKey: writeMetaScript(t, scriptDir, "two.sh", "two"), tagit.PrefixMetaKey: "two"}},
+	}
+	consulClient.mu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"web-2"}, serviceIDs(s))
+	}, 2*time.Second, 5*time.Millisecond, "Expected the instances to follow their meta")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"two-two"}, consulClient.Tags("web-2"))
+	}, time.Second, 5*time.Millisecond, "Expected the instance given a script meta to be tagged")
+	assert.Empty(t, consulClient.Tags("web-1"), "Expected the instance that lost its script meta to be cleaned up")
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("The supervisor did not stop after the context was cancelled")
+	}
+}
+
+func TestLoadServiceConfigs(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		source    tagSource
+		expected  []serviceConfig
+		wantErrs  []string
+		expectErr bool
+	}{
+		{
+			name: "Single service",
+			config: `service-id: my-service
+script: echo web
+tag-prefix: role
+interval: 30s
+`,
+			expected: []serviceConfig{
+				{ServiceID: "my-service", Script: "echo web", TagPrefix: "role", Interval: "30s"},
+			},
+		},
+		{
+			name: "Two services with defaults",
+			config: `tag-prefix: tagged
+interval: 60s
+services:
+  - service-id: service-a
+    script: echo a
+    tag-prefix: a
+    interval: 10s
+  - service-id: service-b
+    script: echo b
+`,
+			expected: []serviceConfig{
+				{ServiceID: "service-a", Script: "echo a", TagPrefix: "a", Interval: "10s"},
+				{ServiceID: "service-b", Script: "echo b", TagPrefix: "tagged", Interval: "60s"},
+			},
+		},
+		{
+			name: "Duplicate service IDs",
+			config: `interval: 60s
+services:
+  - service-id: service-a
+    script: echo a
+  - service-id: service-a
+    script: echo b
+`,
+			wantErrs:  []string{"services[1]: duplicate service-id \"service-a\""},
+			expectErr: true,
+		},
+		{
+			name: "KV path with services",
+			config: `interval: 60s
+kv-path: tagit/tags
+services:
+  - service-id: service-a
+    script: echo a
+  - service-id: service-b
+    script: echo b
+`,
+			wantErrs:  []string{"kv-path cannot be combined with a services list"},
+			expectErr: true,
+		},
+		{
+			name: "Tags output file with services",
+			config: `interval: 60s
+tags-output-file: /run/tagit/tags.json
+services:
+  - service-id: service-a
+    script: echo a
+`,
+			wantErrs:  []string{"tags-output-file cannot be combined with a services list"},
+			expectErr: true,
+		},
+		{
+			name: "Invalid service entry",
+			config: `interval: 60s
+services:
+  - service-id: service-a
+  - script: echo b
+    interval: soon
+`,
+			wantErrs: []string{
+				"services[0]: script is required",
+				"services[1]: service-id is required",
+				"services[1]: invalid interval \"soon\"",
+			},
+			expectErr: true,
+		},
+		{
+			name: "Per-service consul address",
+			config: `tag-prefix: tagged
+interval: 60s
+services:
+  - service-id: service-a
+    script: echo a
+    consul-addr: 10.0.0.1:8500
+  - service-id: service-b
+    script: echo b
+`,
+			expected: []serviceConfig{
+				{ServiceID: "service-a", Script: "echo a", TagPrefix: "tagged", Interval: "60s", ConsulAddr: "10.0.0.1:8500"},
+				{ServiceID: "service-b", Script: "echo b", TagPrefix: "tagged", Interval: "60s"},
+			},
+		},
+		{
+			name: "Invalid per-service consul address",
+			config: `tag-prefix: tagged
+interval: 60s
+services:
+  - service-id: service-a
+    script: echo a
+    consul-addr: not-an-address
+`,
+			wantErrs:  []string{"services[0]: invalid consul address \"not-an-address\""},
+			expectErr: true,
+		},
+		{
+			name:      "Empty services",
+			config:    "services: []\n",
+			wantErrs:  []string{"services must not be empty"},
+			expectErr: true,
+		},
+		{
+			name:   "URL source",
+			config: "service-id: my-service\ntag-prefix: role\ninterval: 30s\n",
+			source: tagSource{kind: sourceURL, url: "http://localhost/tags"},
+			expected: []serviceConfig{
+				{ServiceID: "my-service", Script: "http://localhost/tags", TagPrefix: "role", Interval: "30s"},
+			},
+		},
+		{
+			name:   "Stdin source ignores the script",
+			config: "service-id: my-service\nscript: echo web\ntag-prefix: role\ninterval: 30s\n",
+			source: tagSource{kind: sourceStdin},
+			expected: []serviceConfig{
+				{ServiceID: "my-service", Script: "-", TagPrefix: "role", Interval: "30s"},
+			},
+		},
+		{
+			name:   "Meta source",
+			config: "service-id: my-service\ntag-prefix: role\ninterval: 30s\n",
+			source: tagSource{kind: sourceMeta, metaScriptDir: "/opt/tagit"},
+			expected: []serviceConfig{
+				{ServiceID: "my-service", TagPrefix: "role", Interval: "30s"},
+			},
+		},
+		{
+			name:      "URL source with invalid settings",
+			config:    "tag-prefix: role\ninterval: soon\n",
+			source:    tagSource{kind: sourceURL, url: "http://localhost/tags"},
+			wantErrs:  []string{"service-id is required", "invalid interval"},
+			expectErr: true,
+		},
+		{
+			name: "URL source with services",
+			config: `services:
+  - service-id: service-a
+    script: echo a
+`,
+			source:    tagSource{kind: sourceURL, url: "http://localhost/tags"},
+			wantErrs:  []string{"tags-url cannot be combined with a services list"},
+			expectErr: true,
+		},
+		{
+			name: "Meta source with services",
+			config: `services:
+  - service-id: service-a
+    script: echo a
+`,
+			source:    tagSource{kind: sourceMeta, metaScriptDir: "/opt/tagit"},
+			wantErrs:  []string{"config-from-meta cannot be combined with a services list"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _ := loadTestConfig(t, tt.config)
+
+			services, err := loadServiceConfigs(v, tt.source)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				for _, want := range tt.wantErrs {
+					assert.Contains(t, err.Error(), want)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, services)
+			}
+		})
+	}
+}
+
+func TestNewTagSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected tagSource
+		wantErr  string
+	}{
+		{
+			name:     "Script",
+			expected: tagSource{kind: sourceScript},
+		},
+		{
+			name:     "URL",
+			args:     []string{"--tags-url", "http://localhost/tags"},
+			expected: tagSource{kind: sourceURL, url: "http://localhost/tags"},
+		},
+		{
+			name:     "Stdin",
+			args:     []string{"--from-stdin"},
+			expected: tagSource{kind: sourceStdin},
+		},
+		{
+			name:     "Meta",
+			args:     []string{"--config-from-meta", "--by-name", "--meta-script-dir", "/opt/tagit/"},
+			expected: tagSource{kind: sourceMeta, metaScriptDir: "/opt/tagit"},
+		},
+		{
+			name:    "URL and stdin",
+			args:    []string{"--tags-url", "http://localhost/tags", "--from-stdin"},
+			wantErr: "only one of tags-url, from-stdin and config-from-meta can be set, got tags-url and from-stdin",
+		},
+		{
+			name:    "Stdin and meta",
+			args:    []string{"--from-stdin", "--config-from-meta", "--by-name", "--meta-script-dir", "/opt/tagit"},
+			wantErr: "got from-stdin and config-from-meta",
+		},
+		{
+			name:    "Meta without by-name",
+			args:    []string{"--config-from-meta", "--meta-script-dir", "/opt/tagit"},
+			wantErr: "config-from-meta requires --by-name",
+		},
+		{
+			name:    "Meta without script dir",
+			args:    []string{"--config-from-meta", "--by-name"},
+			wantErr: "config-from-meta requires --meta-script-dir",
+		},
+		{
+			name:    "Relative script dir",
+			args:    []string{"--config-from-meta", "--by-name", "--meta-script-dir", "scripts"},
+			wantErr: "meta-script-dir must be an absolute path",
+		},
+		{
+			name:    "Script dir without meta",
+			args:    []string{"--meta-script-dir", "/opt/tagit"},
+			wantErr: "meta-script-dir requires --config-from-meta",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(runCmd)
+			defer resetFlags(runCmd)
+			assert.NoError(t, runCmd.ParseFlags(tt.args))
+
+			source, err := newTagSource(runCmd)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, source)
+			}
+		})
+	}
+}
+
+func TestReloadConfigKeepsTagSource(t *testing.T) {
+	v, path := loadTestConfig(t, "service-id: test-service\ntag-prefix: old\ninterval: 30s\n")
+	source := tagSource{kind: sourceURL, url: "http://localhost/tags"}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tg, err := tagit.New(NewMockConsulClient(), &tagit.HTTPExecutor{}, "test-service", source.url, 30*time.Second, "old", logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSupervisor(ctx, NewMockConsulClient(), logger)
+	s.start(serviceConfig{ServiceID: "test-service", Script: source.url, TagPrefix: "old", Interval: "30s"}, tg)
+
+	assert.NoError(t, os.WriteFile(path, []byte("service-id: test-service\nscript: echo new\ntag-prefix: new\ninterval: 30s\n"), 0o600))
+	assert.NoError(t, reloadConfig(v, s, source))
+	assert.Equal(t, source.url, tg.Script, "Expected the URL to keep taking the place of the script")
+	assert.Equal(t, "new", tg.TagPrefix)
+
+	cancel()
+	assert.NoError(t, s.wait())
+}
+
+func TestRunTagIts(t *testing.T) {
+	v, _ := loadTestConfig(t, `services:
+  - service-id: service-a
+    script: echo alpha
+    tag-prefix: a
+    interval: 10ms
+  - service-id: service-b
+    script: echo beta
+    tag-prefix: b
+    interval: 10ms
+`)
+	services, err := loadServiceConfigs(v, tagSource{})
+	assert.NoError(t, err)
+
+	consulClient := NewMockConsulClient()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+	assert.Len(t, tagIts, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s := newSupervisor(ctx, logger)
+		for i, t := range tagIts {
+			s.start(services[i], t)
+		}
+		s.wait()
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"a-alpha"}, consulClient.Tags("service-a")) &&
+			assert.ObjectsAreEqual([]string{"b-beta"}, consulClient.Tags("service-b"))
+	}, time.Second, 5*time.Millisecond, "Expected both services to be tagged independently")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The supervisor did not return after the context was cancelled")
+	}
+}
+
+func TestNewServiceClients(t *testing.T) {
+	originalFactory := clientFactory
+	defer func() { clientFactory = originalFactory }()
+
+	mockFactory := &MockFactory{MockClient: NewMockConsulClient()}
+	clientFactory = mockFactory
+
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo a", TagPrefix: "a", Interval: "60s", ConsulAddr: "10.0.0.1:8500"},
+		{ServiceID: "service-b", Script: "echo b", TagPrefix: "b", Interval: "60s", ConsulAddr: "10.0.0.2:8500"},
+		{ServiceID: "service-c", Script: "echo c", TagPrefix: "c", Interval: "60s", ConsulAddr: "10.0.0.1:8500"},
+	}
+	base := consul.Config{Address: "127.0.0.1:8500", Token: "secret"}
+
+	clients, err := newServiceClients(services, base)
+	assert.NoError(t, err)
+	assert.Len(t, clients, 2, "Expected one client per distinct address")
+	assert.Equal(t, []consul.Config{
+		{Address: "10.0.0.1:8500", Token: "secret"},
+		{Address: "10.0.0.2:8500", Token: "secret"},
+	}, mockFactory.Configs, "Expected the per-service addresses to keep the other settings")
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagIts, err := newTagIts(services, clients, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+	assert.Len(t, tagIts, 3)
+
+	mockFactory.Configs = nil
+	clients, err = newServiceClients(services[:1:1], base)
+	assert.NoError(t, err)
+	_, err = newTagIts([]serviceConfig{{ServiceID: "service-d", Script: "echo d", TagPrefix: "d", Interval: "60s"}}, clients, &tagit.CmdExecutor{}, logger)
+	assert.Error(t, err, "Expected an error for a service without a client")
+
+	clients, err = newServiceClients([]serviceConfig{{ServiceID: "service-d"}}, base)
+	assert.NoError(t, err)
+	assert.Contains(t, clients, "", "Expected services without an address to use the base address")
+	assert.Equal(t, base, mockFactory.Configs[len(mockFactory.Configs)-1])
+}
+
+func TestSupervisorFailFast(t *testing.T) {
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo alpha", TagPrefix: "a", Interval: "10ms"},
+		{ServiceID: "service-b", Script: "echo beta", TagPrefix: "b", Interval: "10ms", ConsulAddr: "10.0.0.2:8500"},
+	}
+	failingClient := NewMockConsulClient()
+	failingClient.ServiceError = fmt.Errorf("service not found")
+	clients := map[string]consul.Client{"": NewMockConsulClient(), "10.0.0.2:8500": failingClient}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagIts, err := newTagIts(services, clients, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+	for _, t := range tagIts {
+		t.FailFast = true
+	}
+
+	s := newSupervisor(context.Background(), logger)
+	for i, t := range tagIts {
+		s.start(services[i], t)
+	}
+	done := make(chan error)
+	go func() { done <- s.wait() }()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "service-b")
+	case <-time.After(time.Second):
+		t.Fatal("The supervisor did not stop all services after one failed")
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo alpha", TagPrefix: "a", Interval: "60s"},
+		{ServiceID: "service-b", Script: "echo beta", TagPrefix: "b", Interval: "60s"},
+	}
+
+	consulClient := NewMockConsulClient()
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+
+	assert.Equal(t, exitCodeChanged, runOnce(context.Background(), tagIts, logger), "Expected the changed exit code on the first run")
+	assert.Equal(t, exitCodeNoChange, runOnce(context.Background(), tagIts, logger), "Expected the no-change exit code once tags are up to date")
+
+	consulClient.ServiceError = fmt.Errorf("consul unavailable")
+	assert.Equal(t, exitCodeError, runOnce(context.Background(), tagIts, logger), "Expected the error exit code when consul fails")
+}
+
+func TestParseScriptEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		pairs    []string
+		expected map[string]string
+		wantErr  string
+	}{
+		{name: "None"},
+		{
+			name:     "Pairs",
+			pairs:    []string{"ROLE=primary", "EMPTY=", "QUERY=a=b"},
+			expected: map[string]string{"ROLE": "primary", "EMPTY": "", "QUERY": "a=b"},
+		},
+		{
+			name:     "Last Wins",
+			pairs:    []string{"ROLE=primary", "ROLE=replica"},
+			expected: map[string]string{"ROLE": "replica"},
+		},
+		{name: "Missing Separator", pairs: []string{"ROLE"}, wantErr: `invalid script-env "ROLE"`},
+		{name: "Empty Key", pairs: []string{"=primary"}, wantErr: `invalid script-env "=primary"`},
+		{name: "Space In Key", pairs: []string{"MY ROLE=primary"}, wantErr: `invalid script-env "MY ROLE=primary"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := parseScriptEnv(tt.pairs)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, env)
+		})
+	}
+}
+
+func TestOneShotInterval(t *testing.T) {
+	tests := []struct {
+		name             string
+		interval         string
+		expectedOneShot  bool
+		expectedInterval string
+	}{
+		{name: "Zero", interval: "0", expectedOneShot: true, expectedInterval: "60s"},
+		{name: "Zero Seconds", interval: "0s", expectedOneShot: true, expectedInterval: "60s"},
+		{name: "Positive", interval: "30s", expectedInterval: "30s"},
+		{name: "Negative", interval: "-1s", expectedInterval: "-1s"},
+		{name: "Invalid", interval: "soon", expectedInterval: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("interval", tt.interval)
+
+			assert.Equal(t, tt.expectedOneShot, oneShotInterval(v, "60s"))
+			assert.Equal(t, tt.expectedInterval, v.GetString("interval"))
+		})
+	}
+
+	t.Run("Runs Once", func(t *testing.T) {
+		v := viper.New()
+		v.Set("service-id", "service-a")
+		v.Set("script", "echo alpha")
+		v.Set("tag-prefix", "a")
+		v.Set("interval", "0")
+		assert.True(t, oneShotInterval(v, "60s"))
+
+		services, err := loadServiceConfigs(v, tagSource{})
+		assert.NoError(t, err, "Expected a zero interval to pass the validation")
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		consulClient := NewMockConsulClient()
+		tagIts, err := newTagIts(services, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+		assert.NoError(t, err)
+
+		assert.Equal(t, exitCodeChanged, runOnce(context.Background(), tagIts, logger))
+		assert.Equal(t, []string{"a-alpha"}, consulClient.Tags("service-a"))
+	})
+}
+
+func TestMetricsServer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo alpha beta", TagPrefix: "a", Interval: "60s"},
+	}
+	consulClient := NewMockConsulClient()
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": consulClient}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+
+	m := metrics.New()
+	tagIts[0].Metrics = m
+	server, addr, err := startMetricsServer("127.0.0.1:0", m, http.NotFoundHandler(), logger)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	scrape := func() string {
+		resp, err := http.Get("http://" + addr.String() + "/metrics")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	assert.NotContains(t, scrape(), `service="service-a"`, "No counters should exist before an update")
+
+	assert.Equal(t, exitCodeChanged, runOnce(context.Background(), tagIts, logger))
+	body := scrape()
+	assert.Contains(t, body, `tagit_tags_added_total{service="service-a"} 2`)
+	assert.Contains(t, body, `tagit_tags_removed_total{service="service-a"} 0`)
+
+	tagIts[0].Script = "echo alpha"
+	assert.Equal(t, exitCodeChanged, runOnce(context.Background(), tagIts, logger))
+	body = scrape()
+	assert.Contains(t, body, `tagit_tags_added_total{service="service-a"} 2`)
+	assert.Contains(t, body, `tagit_tags_removed_total{service="service-a"} 1`)
+}
+
+func TestStatusHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo alpha", TagPrefix: "a", Interval: "10ms"},
+		{ServiceID: "service-b", Script: "echo beta", TagPrefix: "b", Interval: "1h"},
+	}
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": NewMockConsulClient()}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSupervisor(ctx, logger)
+	for i, tagIt := range tagIts {
+		s.start(services[i], tagIt)
+	}
+	assert.Eventually(t, func() bool { return len(tagIts[0].History()) >= 2 }, time.Second, 5*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	statusHandler(s.tagIts).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	cancel()
+	s.wait()
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var status map[string][]tagit.RunResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Len(t, status, 2)
+	assert.Empty(t, status["service-b"], "Expected no runs before the first tick")
+	if assert.GreaterOrEqual(t, len(status["service-a"]), 2) {
+		assert.True(t, status["service-a"][0].Changed, "Expected the first run to add the tags")
+		assert.False(t, status["service-a"][1].Changed, "Expected later runs to leave the tags unchanged")
+		assert.Empty(t, status["service-a"][1].Error)
+	}
+}
+
+func TestWithMaxRuntime(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	services := []serviceConfig{
+		{ServiceID: "service-a", Script: "echo alpha", TagPrefix: "a", Interval: "10ms"},
+	}
+	tagIts, err := newTagIts(services, map[string]consul.Client{"": NewMockConsulClient()}, &tagit.CmdExecutor{}, logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := withMaxRuntime(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s := newSupervisor(ctx, logger)
+		s.start(services[0], tagIts[0])
+		s.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond, "Run returned before max-runtime elapsed")
+		assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after max-runtime elapsed")
+	}
+}
+
+func TestWithMaxRuntimeUnlimited(t *testing.T) {
+	ctx, cancel := withMaxRuntime(context.Background(), 0)
+
+	_, hasDeadline := ctx.Deadline()
+	assert.False(t, hasDeadline, "A zero max-runtime should not set a deadline")
+
+	cancel()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled, "Cancel should still stop the run")
+}
+
+func TestSystemdFields(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		args          []string
+		expectedExec  string
+		expectedUser  string
+		expectedError string
+	}{
+		{
+			name:         "Settings from the config file",
+			config:       "service-id: web\nscript: /usr/local/bin/web-tags.sh\ntag-prefix: web\ninterval: 30s\nconsul-addr: 127.0.0.1:8500\n",
+			expectedExec: "ExecStart=/usr/bin/tagit run -s web -x /usr/local/bin/web-tags.sh -p web -i 30s -c 127.0.0.1:8500",
+			expectedUser: "User=tagit",
+		},
+		{
+			name:         "Token and systemd user",
+			config:       "service-id: web\nscript: /usr/local/bin/web-tags.sh\ntag-prefix: web\ninterval: 30s\ntoken: secret\n",
+			args:         []string{"--systemd-user=consul", "--systemd-group=consul"},
+			expectedExec: "ExecStart=/usr/bin/tagit run -s web -x /usr/local/bin/web-tags.sh -p web -i 30s -t secret",
+			expectedUser: "User=consul",
+		},
+		{
+			name:          "Missing script",
+			config:        "service-id: web\ntag-prefix: web\ninterval: 30s\n",
+			expectedError: "missing required fields: Script",
+		},
+		{
+			name:          "Services list",
+			config:        "tag-prefix: web\ninterval: 30s\nservices:\n  - service-id: web\n    script: /usr/local/bin/web-tags.sh\n",
+			expectedError: "single service",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _ := loadTestConfig(t, tt.config)
+			cmd := &cobra.Command{Use: "run"}
+			cmd.Flags().String("systemd-user", "tagit", "")
+			cmd.Flags().String("systemd-group", "tagit", "")
+			assert.NoError(t, cmd.Flags().Parse(tt.args))
+
+			fields, err := systemdFields(cmd, v)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			serviceFile, err := systemd.RenderTemplate(fields)
+			assert.NoError(t, err)
+			assert.Contains(t, serviceFile, tt.expectedExec+"\n")
+			assert.Contains(t, serviceFile, tt.expectedUser+"\n")
+		})
+	}
+}
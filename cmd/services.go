@@ -0,0 +1,558 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/consul"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serviceConfig holds the settings of a single service managed by tagit.
+type serviceConfig struct {
+	ServiceID string `mapstructure:"service-id"`
+	Script    string `mapstructure:"script"`
+	TagPrefix string `mapstructure:"tag-prefix"`
+	Interval  string `mapstructure:"interval"`
+	// ConsulAddr is the address of the agent the service is registered with,
+	// the top-level consul-addr when empty.
+	ConsulAddr string `mapstructure:"consul-addr"`
+}
+
+// tagSourceKind tells where the tags of the services come from.
+type tagSourceKind int
+
+const (
+	// sourceScript runs the script of each service.
+	sourceScript tagSourceKind = iota
+	// sourceURL fetches the tags from tags-url.
+	sourceURL
+	// sourceStdin reads the tags from stdin, once.
+	sourceStdin
+	// sourceMeta runs the script named by the meta of each instance.
+	sourceMeta
+)
+
+// String returns the setting that selects the source.
+func (k tagSourceKind) String() string {
+	switch k {
+	case sourceURL:
+		return "tags-url"
+	case sourceStdin:
+		return "from-stdin"
+	case sourceMeta:
+		return "config-from-meta"
+	default:
+		return "script"
+	}
+}
+
+// tagSource is where the tags of the services come from: a script unless
+// the tags-url, from-stdin or config-from-meta flag is set.
+type tagSource struct {
+	kind tagSourceKind
+	// url is the tags-url of sourceURL.
+	url string
+	// metaScriptDir is the cleaned meta-script-dir of sourceMeta.
+	metaScriptDir string
+}
+
+// command returns what the executor of a URL or stdin source is given in
+// place of a script, which is also what gets logged.
+func (s tagSource) command() string {
+	if s.kind == sourceStdin {
+		return "-"
+	}
+	return s.url
+}
+
+// newTagSource returns the tag source selected by the flags of cmd and
+// checks the flags that only apply to some sources. The settings of the
+// source are checked by loadServiceConfigs.
+func newTagSource(cmd *cobra.Command) (tagSource, error) {
+	tagsURL, err := cmd.Flags().GetString("tags-url")
+	if err != nil {
+		return tagSource{}, fmt.Errorf("failed to get tags-url flag: %w", err)
+	}
+	fromStdin, err := cmd.Flags().GetBool("from-stdin")
+	if err != nil {
+		return tagSource{}, fmt.Errorf("failed to get from-stdin flag: %w", err)
+	}
+	configFromMeta, err := cmd.Flags().GetBool("config-from-meta")
+	if err != nil {
+		return tagSource{}, fmt.Errorf("failed to get config-from-meta flag: %w", err)
+	}
+	metaScriptDir, err := cmd.Flags().GetString("meta-script-dir")
+	if err != nil {
+		return tagSource{}, fmt.Errorf("failed to get meta-script-dir flag: %w", err)
+	}
+	byName, err := cmd.Flags().GetBool("by-name")
+	if err != nil {
+		return tagSource{}, fmt.Errorf("failed to get by-name flag: %w", err)
+	}
+
+	var selected []tagSourceKind
+	source := tagSource{kind: sourceScript}
+	if tagsURL != "" {
+		source = tagSource{kind: sourceURL, url: tagsURL}
+		selected = append(selected, sourceURL)
+	}
+	if fromStdin {
+		source = tagSource{kind: sourceStdin}
+		selected = append(selected, sourceStdin)
+	}
+	if configFromMeta {
+		source = tagSource{kind: sourceMeta}
+		selected = append(selected, sourceMeta)
+	}
+	if len(selected) > 1 {
+		return tagSource{}, fmt.Errorf("only one of tags-url, from-stdin and config-from-meta can be set, got %s and %s", selected[0], selected[1])
+	}
+
+	switch {
+	case source.kind != sourceMeta && metaScriptDir != "":
+		return tagSource{}, fmt.Errorf("meta-script-dir requires --config-from-meta")
+	case source.kind != sourceMeta:
+		return source, nil
+	case !byName:
+		return tagSource{}, fmt.Errorf("config-from-meta requires --by-name")
+	case metaScriptDir == "":
+		return tagSource{}, fmt.Errorf("config-from-meta requires --meta-script-dir")
+	case !filepath.IsAbs(metaScriptDir):
+		return tagSource{}, fmt.Errorf("meta-script-dir must be an absolute path")
+	}
+	source.metaScriptDir = filepath.Clean(metaScriptDir)
+	return source, nil
+}
+
+// loadServiceConfigs returns the services to manage with the tags from
+// source. When the config has a services list it is used, otherwise a single
+// service is built from the service-id, script, tag-prefix and interval
+// settings. A URL or stdin source takes the place of the script. With a meta
+// source the service only carries the defaults, see metaDefaults.
+func loadServiceConfigs(v *viper.Viper, source tagSource) ([]serviceConfig, error) {
+	if source.kind != sourceScript && v.IsSet("services") {
+		return nil, fmt.Errorf("%s cannot be combined with a services list", source.kind)
+	}
+	switch source.kind {
+	case sourceMeta:
+		defaults, err := metaDefaults(v)
+		if err != nil {
+			return nil, err
+		}
+		return []serviceConfig{defaults}, nil
+	case sourceURL, sourceStdin:
+		service := serviceConfig{
+			ServiceID: v.GetString("service-id"),
+			Script:    source.command(),
+			TagPrefix: strings.TrimSpace(v.GetString("tag-prefix")),
+			Interval:  v.GetString("interval"),
+		}
+		if err := errors.Join(settingErrors(service.ServiceID, service.TagPrefix, service.Interval)...); err != nil {
+			return nil, err
+		}
+		return []serviceConfig{service}, nil
+	}
+
+	if !v.IsSet("services") {
+		service := serviceConfig{
+			ServiceID: v.GetString("service-id"),
+			Script:    v.GetString("script"),
+			TagPrefix: strings.TrimSpace(v.GetString("tag-prefix")),
+			Interval:  v.GetString("interval"),
+		}
+		if err := validateConfig(service.ServiceID, service.Script, service.TagPrefix, service.Interval); err != nil {
+			return nil, err
+		}
+		return []serviceConfig{service}, nil
+	}
+
+	var services []serviceConfig
+	if err := v.UnmarshalKey("services", &services); err != nil {
+		return nil, fmt.Errorf("invalid services: %w", err)
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("services must not be empty")
+	}
+
+	var errs []error
+	if v.GetString("kv-path") != "" {
+		errs = append(errs, fmt.Errorf("kv-path cannot be combined with a services list, every service would write the same key"))
+	}
+	if v.GetString("tags-output-file") != "" {
+		errs = append(errs, fmt.Errorf("tags-output-file cannot be combined with a services list, every service would write the same file"))
+	}
+	seen := make(map[string]bool)
+	for i := range services {
+		service := &services[i]
+		if service.TagPrefix == "" {
+			service.TagPrefix = v.GetString("tag-prefix")
+		}
+		service.TagPrefix = strings.TrimSpace(service.TagPrefix)
+		if service.Interval == "" {
+			service.Interval = v.GetString("interval")
+		}
+
+		for _, err := range configErrors(service.ServiceID, service.Script, service.TagPrefix, service.Interval) {
+			errs = append(errs, fmt.Errorf("services[%d]: %w", i, err))
+		}
+		if service.ConsulAddr != "" {
+			if err := validateConsulAddr(service.ConsulAddr); err != nil {
+				errs = append(errs, fmt.Errorf("services[%d]: %w", i, err))
+			}
+		}
+		if service.ServiceID != "" && seen[service.ServiceID] {
+			errs = append(errs, fmt.Errorf("services[%d]: duplicate service-id %q", i, service.ServiceID))
+		}
+		seen[service.ServiceID] = true
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// metaDefaults returns the service name and the default tag prefix and
+// interval of the instances managed with config-from-meta, which take their
+// script from their meta instead of the settings of v.
+func metaDefaults(v *viper.Viper) (serviceConfig, error) {
+	defaults := serviceConfig{
+		ServiceID: v.GetString("service-id"),
+		TagPrefix: strings.TrimSpace(v.GetString("tag-prefix")),
+		Interval:  v.GetString("interval"),
+	}
+	if err := errors.Join(settingErrors(defaults.ServiceID, defaults.TagPrefix, defaults.Interval)...); err != nil {
+		return serviceConfig{}, err
+	}
+	return defaults, nil
+}
+
+// metaServiceConfigs returns the configs of the instances of the service
+// named defaults.ServiceID on the agent of client, built from their meta: the
+// script from tagit.ScriptMetaKey, the tag prefix from tagit.PrefixMetaKey and
+// the interval from tagit.IntervalMetaKey. The prefix and interval of
+// defaults apply when their meta is missing. Instances without a script meta
+// are ignored, and so are the ones with invalid meta or a script outside of
+// scriptDir, with a warning.
+func metaServiceConfigs(ctx context.Context, client consul.Client, defaults serviceConfig, scriptDir string, logger *slog.Logger) ([]serviceConfig, error) {
+	services, err := client.Agent().ServicesWithFilterOpts("", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error listing services: %w", err)
+	}
+
+	var configs []serviceConfig
+	for _, serviceID := range slices.Sorted(maps.Keys(services)) {
+		service := services[serviceID]
+		if service.Service != defaults.ServiceID || service.Meta[tagit.ScriptMetaKey] == "" {
+			continue
+		}
+		config := serviceConfig{
+			ServiceID: serviceID,
+			Script:    service.Meta[tagit.ScriptMetaKey],
+			TagPrefix: strings.TrimSpace(service.Meta[tagit.PrefixMetaKey]),
+			Interval:  service.Meta[tagit.IntervalMetaKey],
+		}
+		if config.TagPrefix == "" {
+			config.TagPrefix = defaults.TagPrefix
+		}
+		if config.Interval == "" {
+			config.Interval = defaults.Interval
+		}
+		err := validateConfig(config.ServiceID, config.Script, config.TagPrefix, config.Interval)
+		if err == nil {
+			err = validateMetaScript(scriptDir, config.Script)
+		}
+		if err != nil {
+			logger.Warn("ignoring service with invalid meta",
+				"serviceID", serviceID,
+				"error", err)
+			continue
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// watchMetaServices reconciles s with the instances found by discover every
+// interval until ctx is done, so instances registered, deregistered or with
+// changed meta are picked up.
+func watchMetaServices(ctx context.Context, s *supervisor, discover func(ctx context.Context) ([]serviceConfig, error), interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reconcileMetaServices(ctx, s, discover); err != nil {
+				logger.Error("Failed to update services from meta", "error", err)
+			}
+		}
+	}
+}
+
+// reconcileMetaServices reconciles s with the instances found by discover,
+// leaving s as it was when they cannot be listed.
+func reconcileMetaServices(ctx context.Context, s *supervisor, discover func(ctx context.Context) ([]serviceConfig, error)) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	services, err := discover(ctx)
+	if err != nil {
+		return err
+	}
+	return s.reconcile(services)
+}
+
+// newServiceClients creates a Consul client for each distinct consul-addr of
+// the services, keyed by address. The services without a consul-addr share a
+// client for the address of base, keyed by "".
+func newServiceClients(services []serviceConfig, base consul.Config) (map[string]consul.Client, error) {
+	clients := make(map[string]consul.Client)
+	for _, service := range services {
+		if _, ok := clients[service.ConsulAddr]; ok {
+			continue
+		}
+		cfg := base
+		if service.ConsulAddr != "" {
+			cfg.Address = service.ConsulAddr
+		}
+		if err := validateConsulAddr(cfg.Address); err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.ServiceID, err)
+		}
+		client, err := clientFactory.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.ServiceID, err)
+		}
+		clients[service.ConsulAddr] = client
+	}
+	return clients, nil
+}
+
+// newTagIts creates a TagIt for each service, using the client of its
+// consul-addr from clients and executor to run its script.
+func newTagIts(services []serviceConfig, clients map[string]consul.Client, executor tagit.CommandExecutor, logger *slog.Logger) ([]*tagit.TagIt, error) {
+	tagIts := make([]*tagit.TagIt, 0, len(services))
+	for _, service := range services {
+		interval, err := parseInterval(service.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.ServiceID, err)
+		}
+		consulClient, ok := clients[service.ConsulAddr]
+		if !ok {
+			return nil, fmt.Errorf("service %s: no consul client for address %q", service.ServiceID, service.ConsulAddr)
+		}
+		t, err := tagit.New(
+			consulClient,
+			executor,
+			service.ServiceID,
+			service.Script,
+			interval,
+			service.TagPrefix,
+			logger,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.ServiceID, err)
+		}
+		tagIts = append(tagIts, t)
+	}
+	return tagIts, nil
+}
+
+// supervisor runs a TagIt for each service until its context is done or one
+// of them fails, and starts, stops or reloads them as the configured services
+// change.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *slog.Logger
+	// newTagIt creates the TagIt of a service added by reconcile.
+	newTagIt func(service serviceConfig) (*tagit.TagIt, error)
+	// cleanupRemoved removes the managed tags of the services dropped by
+	// reconcile once their TagIt stopped.
+	cleanupRemoved bool
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+
+	mu       sync.Mutex
+	stopped  bool
+	services map[string]*supervisedService
+}
+
+// supervisedService is a running TagIt and the config it was started from.
+type supervisedService struct {
+	config serviceConfig
+	tagIt  *tagit.TagIt
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newSupervisor returns a supervisor running its TagIts until ctx is done.
+func newSupervisor(ctx context.Context, logger *slog.Logger) *supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &supervisor{
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+		services: make(map[string]*supervisedService),
+	}
+}
+
+// start runs t for service, unless the supervisor already stopped. When t
+// fails, all TagIts are stopped and wait returns the error.
+func (s *supervisor) start(service serviceConfig, t *tagit.TagIt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	running := &supervisedService{config: service, tagIt: t, cancel: cancel, done: make(chan struct{})}
+	s.services[service.ServiceID] = running
+	s.logger.Info("Starting tagit",
+		"serviceID", t.ServiceID,
+		"script", t.Script,
+		"interval", t.Interval,
+		"tagPrefix", t.TagPrefix)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(running.done)
+		if err := t.Run(ctx); err != nil {
+			s.errOnce.Do(func() {
+				s.err = err
+				s.cancel()
+			})
+		}
+	}()
+}
+
+// stop stops the TagIt of serviceID and waits for it to return.
+func (s *supervisor) stop(serviceID string) *supervisedService {
+	s.mu.Lock()
+	running, ok := s.services[serviceID]
+	delete(s.services, serviceID)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	s.logger.Info("Stopping tagit", "serviceID", serviceID)
+	running.cancel()
+	<-running.done
+	return running
+}
+
+// tagIts returns the running TagIts ordered by service ID.
+func (s *supervisor) tagIts() []*tagit.TagIt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tagIts := make([]*tagit.TagIt, 0, len(s.services))
+	for _, serviceID := range slices.Sorted(maps.Keys(s.services)) {
+		tagIts = append(tagIts, s.services[serviceID].tagIt)
+	}
+	return tagIts
+}
+
+// reconcile makes the running TagIts match services. New services are
+// started, removed ones are stopped and the others get the script, tag-prefix
+// and interval of their config. A service moved to another consul-addr is
+// restarted against that agent. The services that fail keep running as they
+// were, and their errors are joined.
+func (s *supervisor) reconcile(services []serviceConfig) error {
+	var errs []error
+	configured := make(map[string]bool, len(services))
+	for _, service := range services {
+		configured[service.ServiceID] = true
+
+		s.mu.Lock()
+		running, ok := s.services[service.ServiceID]
+		s.mu.Unlock()
+		if ok && running.config.ConsulAddr == service.ConsulAddr {
+			interval, err := parseInterval(service.Interval)
+			if err == nil {
+				err = running.tagIt.Reload(service.Script, service.TagPrefix, interval)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("service %s: %w", service.ServiceID, err))
+				continue
+			}
+			s.mu.Lock()
+			running.config = service
+			s.mu.Unlock()
+			continue
+		}
+
+		t, err := s.newTagIt(service)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", service.ServiceID, err))
+			continue
+		}
+		if ok {
+			s.stop(service.ServiceID)
+		}
+		s.start(service, t)
+	}
+
+	s.mu.Lock()
+	var removed []string
+	for serviceID := range s.services {
+		if !configured[serviceID] {
+			removed = append(removed, serviceID)
+		}
+	}
+	s.mu.Unlock()
+	slices.Sort(removed)
+	for _, serviceID := range removed {
+		running := s.stop(serviceID)
+		if running == nil || !s.cleanupRemoved {
+			continue
+		}
+		if _, err := running.tagIt.CleanupTagsContext(s.ctx); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", serviceID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// wait blocks until the context of the supervisor is done or a TagIt failed,
+// then waits for all TagIts to return and returns the first error.
+func (s *supervisor) wait() error {
+	<-s.ctx.Done()
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.wg.Wait()
+	return s.err
+}
@@ -33,6 +33,9 @@ automatically on boot and can be managed using systemctl.
 
 Example usage:
   tagit systemd --service-id=my-service --script=/path/to/script.sh --tag-prefix=tagit --interval=5s --user=tagit --group=tagit
+
+To order the service after consul:
+  tagit systemd --service-id=my-service --script=/path/to/script.sh --tag-prefix=tagit --interval=5s --user=tagit --group=tagit --after=consul.service --wants=consul.service
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		flags := make(map[string]string)
@@ -45,6 +48,15 @@ Example usage:
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+		fields.After, _ = cmd.Flags().GetStringArray("after")
+		fields.Wants, _ = cmd.Flags().GetStringArray("wants")
+		fields.Requires, _ = cmd.Flags().GetStringArray("requires")
+		fields.NoNetworkOnline, _ = cmd.Flags().GetBool("no-network-online")
+		fields.IOWeight, _ = cmd.Flags().GetInt("io-weight")
+		if cmd.Flags().Changed("nice") {
+			nice, _ := cmd.Flags().GetInt("nice")
+			fields.Nice = &nice
+		}
 
 		serviceFile, err := systemd.RenderTemplate(fields)
 		if err != nil {
@@ -68,6 +80,13 @@ func init() {
 	systemdCmd.Flags().String("consul-addr", "", "Consul address (optional)")
 	systemdCmd.Flags().String("user", "", "User to run the service as (required)")
 	systemdCmd.Flags().String("group", "", "Group to run the service as (required)")
+	systemdCmd.Flags().String("home-dir", systemd.DefaultHomeDir, "Base directory for the HOME of the service (optional)")
+	systemdCmd.Flags().StringArray("after", nil, "Extra unit to order the service after, can be repeated (optional)")
+	systemdCmd.Flags().StringArray("wants", nil, "Extra unit wanted by the service, can be repeated (optional)")
+	systemdCmd.Flags().StringArray("requires", nil, "Extra unit required by the service, can be repeated (optional)")
+	systemdCmd.Flags().Bool("no-network-online", false, "Do not order the service after network-online.target (optional)")
+	systemdCmd.Flags().Int("io-weight", 0, "IO weight of the service between 1 and 10000 (optional)")
+	systemdCmd.Flags().Int("nice", 0, "Nice level of the service between -20 and 19 (optional)")
 
 	// Mark required flags
 	systemdCmd.MarkFlagRequired("service-id")
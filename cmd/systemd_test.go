@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/ncode/tagit/pkg/systemd"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +30,13 @@ func setupSystemdCmd() *cobra.Command {
 	systCmd.Flags().String("consul-addr", "", "Consul address (optional)")
 	systCmd.Flags().String("user", "", "User to run the service as (required)")
 	systCmd.Flags().String("group", "", "Group to run the service as (required)")
+	systCmd.Flags().String("home-dir", systemd.DefaultHomeDir, "Base directory for the HOME of the service (optional)")
+	systCmd.Flags().StringArray("after", nil, "Extra unit to order the service after, can be repeated (optional)")
+	systCmd.Flags().StringArray("wants", nil, "Extra unit wanted by the service, can be repeated (optional)")
+	systCmd.Flags().StringArray("requires", nil, "Extra unit required by the service, can be repeated (optional)")
+	systCmd.Flags().Bool("no-network-online", false, "Do not order the service after network-online.target (optional)")
+	systCmd.Flags().Int("io-weight", 0, "IO weight of the service between 1 and 10000 (optional)")
+	systCmd.Flags().Int("nice", 0, "Nice level of the service between -20 and 19 (optional)")
 
 	systCmd.MarkFlagRequired("service-id")
 	systCmd.MarkFlagRequired("script")
@@ -108,6 +116,45 @@ func TestSystemdCmd(t *testing.T) {
 				"WantedBy=multi-user.target",
 			},
 		},
+		{
+			name: "Custom home dir",
+			args: []string{
+				"--service-id=test-service",
+				"--script=/path/to/script.sh",
+				"--tag-prefix=test",
+				"--interval=30s",
+				"--user=testuser",
+				"--group=testgroup",
+				"--home-dir=/opt/tagit",
+			},
+			expectedOutput: []string{
+				"Environment=HOME=/opt/tagit/test-service",
+			},
+		},
+		{
+			name: "Extra unit dependencies",
+			args: []string{
+				"--service-id=test-service",
+				"--script=/path/to/script.sh",
+				"--tag-prefix=test",
+				"--interval=30s",
+				"--user=testuser",
+				"--group=testgroup",
+				"--after=consul.service",
+				"--after=local-fs.target",
+				"--wants=consul.service",
+				"--requires=docker.service",
+			},
+			expectedOutput: []string{
+				"After=network.target",
+				"After=network-online.target",
+				"Wants=network-online.target",
+				"After=consul.service",
+				"After=local-fs.target",
+				"Wants=consul.service",
+				"Requires=docker.service",
+			},
+		},
 		{
 			name: "Missing required flag",
 			args: []string{
@@ -199,6 +246,7 @@ func TestSystemdCmdFlagDefinitions(t *testing.T) {
 		"interval":    {true, "string"},
 		"token":       {false, "string"},
 		"consul-addr": {false, "string"},
+		"home-dir":    {false, "string"},
 		"user":        {true, "string"},
 		"group":       {true, "string"},
 	}
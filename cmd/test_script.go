@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+)
+
+// testScriptCmd represents the test-script command
+var testScriptCmd = &cobra.Command{
+	Use:   "test-script",
+	Short: "Run the script and print the tags it would generate without connecting to consul",
+	Long: `Run the script and print the tags it would generate, one per line,
+without connecting to consul. Handy to check a script while writing it or in CI.
+
+example: tagit test-script -x '/tmp/tag-role.sh' -p role
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		t, err := scriptTagIt(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := printScriptTags(cmd.OutOrStdout(), t, &tagit.CmdExecutor{}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(testScriptCmd)
+	testScriptCmd.Flags().StringArray("static-tag", nil, "tag added in addition to the script output, can be repeated")
+	testScriptCmd.Flags().Bool("line-mode", false, "use each line of the script output as a tag instead of each word")
+	testScriptCmd.Flags().String("output-filter", "", "regular expression the script output lines must match to be used as tags")
+	testScriptCmd.Flags().String("ignore-line-prefix", "", "ignore script output lines starting with this prefix, such as #")
+	testScriptCmd.Flags().Bool("strip-existing-prefix", false, "do not prefix script output that already carries the tag prefix")
+	testScriptCmd.Flags().String("output-encoding", tagit.OutputEncodingUTF8, "encoding of the script output, utf-8 or latin1")
+	testScriptCmd.Flags().Bool("lowercase-tags", false, "lowercase the tags, as run --lowercase-tags does")
+}
+
+// scriptTagIt builds a TagIt holding the script and output settings of cmd.
+func scriptTagIt(cmd *cobra.Command) (*tagit.TagIt, error) {
+	script, err := requiredFlag(cmd, "script")
+	if err != nil {
+		return nil, err
+	}
+	tagPrefix, err := tagPrefixFlag(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tagit.TagIt{Script: script, TagPrefix: tagPrefix}
+	if t.StaticTags, err = cmd.Flags().GetStringArray("static-tag"); err != nil {
+		return nil, fmt.Errorf("failed to get static-tag flag: %w", err)
+	}
+	if t.LineMode, err = cmd.Flags().GetBool("line-mode"); err != nil {
+		return nil, fmt.Errorf("failed to get line-mode flag: %w", err)
+	}
+	if t.IgnoreLinePrefix, err = cmd.Flags().GetString("ignore-line-prefix"); err != nil {
+		return nil, fmt.Errorf("failed to get ignore-line-prefix flag: %w", err)
+	}
+	if t.StripExistingPrefix, err = cmd.Flags().GetBool("strip-existing-prefix"); err != nil {
+		return nil, fmt.Errorf("failed to get strip-existing-prefix flag: %w", err)
+	}
+	if t.LowercaseTags, err = cmd.Flags().GetBool("lowercase-tags"); err != nil {
+		return nil, fmt.Errorf("failed to get lowercase-tags flag: %w", err)
+	}
+	if t.OutputEncoding, err = cmd.Flags().GetString("output-encoding"); err != nil {
+		return nil, fmt.Errorf("failed to get output-encoding flag: %w", err)
+	}
+	if err := tagit.ValidateOutputEncoding(t.OutputEncoding); err != nil {
+		return nil, err
+	}
+	outputFilter, err := cmd.Flags().GetString("output-filter")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get output-filter flag: %w", err)
+	}
+	if outputFilter != "" {
+		if t.OutputFilter, err = regexp.Compile(outputFilter); err != nil {
+			return nil, fmt.Errorf("invalid output-filter %q: %w", outputFilter, err)
+		}
+	}
+	return t, nil
+}
+
+// printScriptTags runs the script of t with executor and writes the tags it
+// generates to w, one per line.
+func printScriptTags(w io.Writer, t *tagit.TagIt, executor tagit.CommandExecutor) error {
+	tags, err := t.GenerateTags(executor)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := fmt.Fprintln(w, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubExecutor returns a fixed script output.
+type stubExecutor struct {
+	output []byte
+	err    error
+}
+
+func (s *stubExecutor) Execute(command string) ([]byte, error) {
+	return s.output, s.err
+}
+
+func TestTestScriptCommand(t *testing.T) {
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"test-script", "--script", "echo web db", "--tag-prefix", "role", "--static-tag", "managed"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	})
+
+	assert.NoError(t, rootCmd.Execute(), "test-script should not require service-id")
+	assert.Equal(t, "role-web\nrole-db\nrole-managed\n", buf.String())
+}
+
+func TestTestScriptCommandConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tagit.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("script: echo web\ntag-prefix: role\n"), 0o600))
+	reset := func() {
+		resetFlags(testScriptCmd)
+		viper.Reset()
+	}
+	reset()
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"test-script", "--config", path, "--quiet"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+		reset()
+	})
+
+	assert.NoError(t, rootCmd.Execute(), "The script should not be required on the command line when it is in the config file")
+	assert.Equal(t, "role-web\n", buf.String())
+}
+
+func TestTestScriptCommandLowercaseTags(t *testing.T) {
+	resetFlags(testScriptCmd)
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	rootCmd.SetArgs([]string{"test-script", "--script", "echo Web", "--tag-prefix", "Role", "--static-tag", "Managed", "--lowercase-tags"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+		resetFlags(testScriptCmd)
+	})
+
+	assert.NoError(t, rootCmd.Execute())
+	assert.Equal(t, "role-web\nrole-managed\n", buf.String(), "Static tags should be lowercased as well")
+}
+
+func TestPrintScriptTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tagit    *tagit.TagIt
+		output   string
+		expected string
+	}{
+		{
+			name:     "Words",
+			tagit:    &tagit.TagIt{TagPrefix: "tag"},
+			output:   "primary  zone-a\n",
+			expected: "tag-primary\ntag-zone-a\n",
+		},
+		{
+			name:     "Line Mode",
+			tagit:    &tagit.TagIt{TagPrefix: "tag", LineMode: true},
+			output:   "rack 1\nrack 2\n",
+			expected: "tag-rack 1\ntag-rack 2\n",
+		},
+		{
+			name:     "Filtered",
+			tagit:    &tagit.TagIt{TagPrefix: "tag", IgnoreLinePrefix: "#", OutputFilter: regexp.MustCompile(`^zone`)},
+			output:   "# comment\nzone-a\nother\n",
+			expected: "tag-zone-a\n",
+		},
+		{
+			name:     "Existing Prefix Kept",
+			tagit:    &tagit.TagIt{TagPrefix: "tag", StripExistingPrefix: true},
+			output:   "tag-primary replica",
+			expected: "tag-primary\ntag-replica\n",
+		},
+		{
+			name:     "Empty Output",
+			tagit:    &tagit.TagIt{TagPrefix: "tag"},
+			output:   "",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := printScriptTags(&buf, tt.tagit, &stubExecutor{output: []byte(tt.output)})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestPrintScriptTagsError(t *testing.T) {
+	var buf bytes.Buffer
+	err := printScriptTags(&buf, &tagit.TagIt{TagPrefix: "tag"}, &stubExecutor{err: fmt.Errorf("exit status 1")})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error running script")
+	assert.Empty(t, buf.String())
+}
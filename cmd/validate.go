@@ -0,0 +1,239 @@
+/*
+Copyright © 2024 Juliano Martinez <juliano@martinez.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the tagit configuration without connecting to consul",
+	Long: `Validate the tagit configuration without connecting to consul.
+
+The configuration is loaded from the config file and flags, and all problems
+are reported at once.
+
+example: tagit validate --config /etc/tagit/my-service.yaml
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cfgFile != "" {
+			if err := viper.ReadInConfig(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to bind flags: %v\n", err)
+			os.Exit(1)
+		}
+
+		strictConfig, err := cmd.Flags().GetBool("strict-config")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to get strict-config flag: %v\n", err)
+			os.Exit(1)
+		}
+
+		// A zero interval is valid for run, where it means a single update cycle
+		oneShotInterval(viper.GetViper(), cmd.Flag("interval").DefValue)
+		err = validateViperConfig(viper.GetViper())
+		if strictConfig {
+			err = errors.Join(checkConfigKeys(viper.GetViper(), knownConfigKeys(cmd.Root())), err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Configuration is valid")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+// validateViperConfig validates the configuration values held by v.
+func validateViperConfig(v *viper.Viper) error {
+	_, err := loadServiceConfigs(v, tagSource{})
+	return err
+}
+
+// serviceConfigKeys are the keys allowed in the entries of the services list.
+var serviceConfigKeys = []string{"service-id", "script", "tag-prefix", "interval", "consul-addr"}
+
+// knownConfigKeys returns the keys allowed in the config file: the services
+// list, the persistent flags of root and the flags of its run command, which
+// applyConfig sets from the config file. The config flag names the file
+// itself, so it is not a key.
+func knownConfigKeys(root *cobra.Command) map[string]bool {
+	known := map[string]bool{"services": true}
+	addFlag := func(f *pflag.Flag) {
+		if f.Name != "config" {
+			known[f.Name] = true
+		}
+	}
+	root.PersistentFlags().VisitAll(addFlag)
+	for _, cmd := range root.Commands() {
+		if cmd.Name() == "run" {
+			cmd.Flags().VisitAll(addFlag)
+		}
+	}
+	return known
+}
+
+// checkConfigKeys reports the keys of the config file used by v that are not
+// in known, such as typos that would otherwise be silently ignored.
+func checkConfigKeys(v *viper.Viper, known map[string]bool) error {
+	path := v.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+
+	// Read the file on its own so flags and environment variables are not reported
+	file := viper.New()
+	file.SetConfigFile(path)
+	if filepath.Ext(path) == "" {
+		file.SetConfigType("yaml")
+	}
+	if err := file.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var errs []error
+	reported := make(map[string]bool)
+	keys := file.AllKeys()
+	slices.Sort(keys)
+	for _, key := range keys {
+		key, _, _ = strings.Cut(key, ".")
+		if !known[key] && !reported[key] {
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+			reported[key] = true
+		}
+	}
+
+	entries, _ := file.Get("services").([]any)
+	for i, entry := range entries {
+		fields, ok := entry.(map[string]any)
+		if !ok {
+			continue
+		}
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if !slices.Contains(serviceConfigKeys, key) {
+				errs = append(errs, fmt.Errorf("services[%d]: unknown key %q", i, key))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateConfig runs the startup validations and returns all problems found.
+func validateConfig(serviceID, script, tagPrefix, interval string) error {
+	return errors.Join(configErrors(serviceID, script, tagPrefix, interval)...)
+}
+
+// configErrors returns each problem found by the startup validations.
+func configErrors(serviceID, script, tagPrefix, interval string) []error {
+	errs := settingErrors(serviceID, tagPrefix, interval)
+
+	if script == "" {
+		errs = append(errs, fmt.Errorf("script is required"))
+	} else if args, err := shlex.Split(script); err != nil {
+		errs = append(errs, fmt.Errorf("invalid script %q: %w", script, err))
+	} else if len(args) == 0 {
+		errs = append(errs, fmt.Errorf("invalid script %q: no command after splitting", script))
+	}
+
+	return errs
+}
+
+// settingErrors returns each problem found in the service-id, tag-prefix and
+// interval settings, the ones needed whatever the tags come from.
+func settingErrors(serviceID, tagPrefix, interval string) []error {
+	var errs []error
+
+	if serviceID == "" {
+		errs = append(errs, fmt.Errorf("service-id is required"))
+	}
+
+	if err := tagit.ValidateTagPrefix(tagPrefix); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parseInterval(interval); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// validateMetaScript checks that script, taken from the tagit-script meta of a
+// service, is the absolute path of a script in scriptDir, without arguments.
+// The meta is set by whoever registers the service, so nothing else is run.
+func validateMetaScript(scriptDir, script string) error {
+	args, err := shlex.Split(script)
+	if err != nil {
+		return fmt.Errorf("invalid script %q: %w", script, err)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("invalid script %q: must be a single path without arguments", script)
+	}
+	if !filepath.IsAbs(args[0]) {
+		return fmt.Errorf("invalid script %q: must be an absolute path", script)
+	}
+	rel, err := filepath.Rel(scriptDir, filepath.Clean(args[0]))
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return fmt.Errorf("invalid script %q: not in meta-script-dir %q", script, scriptDir)
+	}
+	return nil
+}
+
+// parseInterval parses and validates the interval used to run the script.
+func parseInterval(interval string) (time.Duration, error) {
+	if interval == "" || interval == "0" {
+		return 0, fmt.Errorf("interval is required")
+	}
+
+	validInterval, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %w", interval, err)
+	}
+	if validInterval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q: must be positive", interval)
+	}
+
+	return validInterval, nil
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateViperConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantErrs  []string
+		expectErr bool
+	}{
+		{
+			name: "Valid config",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh --verbose
+tag-prefix: tagged
+interval: 30s
+`,
+			expectErr: false,
+		},
+		{
+			name: "Missing service-id",
+			config: `script: /usr/local/bin/tags.sh
+interval: 30s
+`,
+			wantErrs:  []string{"service-id is required"},
+			expectErr: true,
+		},
+		{
+			name: "Invalid tag prefix",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh
+tag-prefix: my prefix
+interval: 30s
+`,
+			wantErrs:  []string{"invalid tag prefix \"my prefix\""},
+			expectErr: true,
+		},
+		{
+			name: "Invalid interval",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh
+interval: soon
+`,
+			wantErrs:  []string{"invalid interval \"soon\""},
+			expectErr: true,
+		},
+		{
+			name: "Malformed script",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh "unclosed
+interval: 30s
+`,
+			wantErrs:  []string{"invalid script"},
+			expectErr: true,
+		},
+		{
+			name:   "Empty config reports all problems",
+			config: ``,
+			wantErrs: []string{
+				"service-id is required",
+				"script is required",
+				"tag prefix must not be empty",
+				"interval is required",
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tagit.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.config), 0o600))
+
+			v := viper.New()
+			v.SetConfigFile(path)
+			assert.NoError(t, v.ReadInConfig())
+
+			err := validateViperConfig(v)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				for _, want := range tt.wantErrs {
+					assert.Contains(t, err.Error(), want)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckConfigKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantErrs []string
+	}{
+		{
+			name: "Known keys",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh
+tag-prefix: tagged
+interval: 30s
+preserve-order: true
+`,
+		},
+		{
+			name: "Unknown top-level key",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh
+tag_prefix: tagged
+interval: 30s
+`,
+			wantErrs: []string{"unknown key \"tag_prefix\""},
+		},
+		{
+			name: "Unknown nested key",
+			config: `service-id: my-service
+script: /usr/local/bin/tags.sh
+interval: 30s
+consul:
+  addr: 127.0.0.1:8500
+`,
+			wantErrs: []string{"unknown key \"consul\""},
+		},
+		{
+			name: "Unknown key in services",
+			config: `services:
+  - service-id: my-service
+    script: /usr/local/bin/tags.sh
+    intervall: 30s
+`,
+			wantErrs: []string{"services[0]: unknown key \"intervall\""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tagit.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.config), 0o600))
+
+			v := viper.New()
+			v.SetConfigFile(path)
+			assert.NoError(t, v.ReadInConfig())
+
+			err := checkConfigKeys(v, knownConfigKeys(rootCmd))
+
+			if len(tt.wantErrs) > 0 {
+				assert.Error(t, err)
+				for _, want := range tt.wantErrs {
+					assert.Contains(t, err.Error(), want)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUnknownConfigKeysTolerated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tagit.yaml")
+	config := `service-id: my-service
+script: /usr/local/bin/tags.sh
+tag_prefix: typo
+tag-prefix: tagged
+interval: 30s
+`
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	assert.NoError(t, v.ReadInConfig())
+
+	assert.NoError(t, validateViperConfig(v), "Unknown keys should be ignored without strict mode")
+	assert.Error(t, checkConfigKeys(v, knownConfigKeys(rootCmd)), "Unknown keys should be reported in strict mode")
+}
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval string
+		expected time.Duration
+		wantErr  string
+	}{
+		{name: "Valid interval", interval: "5s", expected: 5 * time.Second},
+		{name: "Empty interval", interval: "", wantErr: "interval is required"},
+		{name: "Zero interval", interval: "0", wantErr: "interval is required"},
+		{name: "Negative interval", interval: "-5s", wantErr: "must be positive"},
+		{name: "Invalid interval", interval: "five", wantErr: "invalid interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interval, err := parseInterval(tt.interval)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, interval)
+			}
+		})
+	}
+}
+
+func TestValidateMetaScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "Script in the dir", script: "/opt/tagit/tags.sh"},
+		{name: "Script in a subdir", script: "/opt/tagit/web/tags.sh"},
+		{name: "Quoted path", script: "'/opt/tagit/web tags.sh'"},
+		{name: "Relative path", script: "tags.sh", wantErr: "must be an absolute path"},
+		{name: "Arguments", script: "/opt/tagit/tags.sh --role", wantErr: "without arguments"},
+		{name: "Command", script: "echo role", wantErr: "without arguments"},
+		{name: "Outside the dir", script: "/usr/bin/id", wantErr: "not in meta-script-dir"},
+		{name: "Escaping the dir", script: "/opt/tagit/../../usr/bin/id", wantErr: "not in meta-script-dir"},
+		{name: "Sibling dir", script: "/opt/tagit-other/tags.sh", wantErr: "not in meta-script-dir"},
+		{name: "The dir itself", script: "/opt/tagit", wantErr: "not in meta-script-dir"},
+		{name: "Empty", script: "", wantErr: "without arguments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetaScript("/opt/tagit", tt.script)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKnownConfigKeysApplied(t *testing.T) {
+	// A value other than the default of each flag type
+	values := map[string]any{
+		"bool":        true,
+		"duration":    "7s",
+		"float64":     2.5,
+		"int":         7,
+		"string":      "from-file",
+		"stringArray": []string{"from-file"},
+		"stringSlice": []string{"from-file"},
+	}
+	resetFlags(runCmd)
+	t.Cleanup(func() { resetFlags(runCmd) })
+
+	config := make(map[string]any)
+	known := knownConfigKeys(rootCmd)
+	runCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if known[f.Name] {
+			value, ok := values[f.Value.Type()]
+			if assert.True(t, ok, "No test value for the type of %s", f.Name) {
+				config[f.Name] = value
+			}
+		}
+	})
+	assert.Len(t, config, len(known)-1, "Expected every known key but services to be a flag of run")
+
+	contents, err := yaml.Marshal(config)
+	assert.NoError(t, err)
+	v, _ := loadTestConfig(t, string(contents))
+	assert.NoError(t, applyConfig(runCmd, v))
+	assert.NoError(t, checkConfigKeys(v, known))
+	runCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if known[f.Name] {
+			assert.NotEqual(t, f.DefValue, f.Value.String(), "Expected %s to be read from the config file", f.Name)
+		}
+	})
+}
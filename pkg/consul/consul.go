@@ -0,0 +1,501 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/tagit"
+)
+
+// TLSConfig holds the TLS options used to talk to Consul.
+// Empty fields fall back to the CONSUL_* environment variables.
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// InsecureSkipVerify disables the verification of the Consul certificate.
+	InsecureSkipVerify bool
+}
+
+// Config holds the options used to connect to Consul.
+type Config struct {
+	Address string
+	// Scheme is either http or https. When empty, the scheme is taken from
+	// the address prefix or falls back to the CONSUL_* environment variables.
+	Scheme string
+	Token  string
+	// HTTPAuth is the user:pass of the HTTP basic auth sent with each request,
+	// for agents behind an auth proxy. When empty, CONSUL_HTTP_AUTH applies.
+	HTTPAuth string
+	TLS      TLSConfig
+	// HTTPClient, when set, is used for all requests to Consul as is, so the
+	// TLS settings must be part of its transport.
+	HTTPClient *http.Client
+	// Timeout bounds each HTTP request to Consul when positive. It is ignored
+	// with HTTPClient, whose own timeout applies.
+	Timeout time.Duration
+	// QPS limits the calls to Consul to this many per second on average when
+	// positive, allowing bursts of up to Burst calls. A Burst below 1 means 1.
+	QPS   float64
+	Burst int
+	// UserAgent identifies tagit in the requests to Consul, DefaultUserAgent
+	// when empty.
+	UserAgent string
+	// WriteLimiter, when set, caps the concurrent writes to Consul. Clients
+	// created with the same WriteLimiter share its cap.
+	WriteLimiter *WriteLimiter
+}
+
+// DefaultUserAgent returns tagit/<version> with the module version of the
+// binary, or just tagit when it was built without one.
+func DefaultUserAgent() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "tagit"
+	}
+	return "tagit/" + info.Main.Version
+}
+
+// Client is the Consul client used by tagit.
+type Client = tagit.ConsulClient
+
+// ClientFactory is an interface for creating Consul clients.
+type ClientFactory interface {
+	NewClient(cfg Config) (Client, error)
+}
+
+// DefaultFactory creates Consul clients backed by the Consul API.
+type DefaultFactory struct{}
+
+// NewClient creates a new Consul client from the given configuration.
+func (f *DefaultFactory) NewClient(cfg Config) (Client, error) {
+	address, scheme, err := parseAddress(cfg.Address, cfg.Scheme)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %w", err)
+	}
+	if cfg.QPS < 0 {
+		return nil, fmt.Errorf("failed to create Consul client: qps must not be negative")
+	}
+
+	config := api.DefaultConfig()
+	config.Address = address
+	if scheme != "" {
+		config.Scheme = scheme
+	}
+	config.Token = cfg.Token
+	if cfg.HTTPAuth != "" {
+		config.HttpAuth, err = ParseHTTPAuth(cfg.HTTPAuth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Consul client: %w", err)
+		}
+	}
+	applyTLSConfig(&config.TLSConfig, cfg.TLS)
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient, err = api.NewHttpClient(config.Transport, config.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Consul client: %w", err)
+		}
+		httpClient.Timeout = cfg.Timeout
+	}
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent()
+	}
+	config.HttpClient = withUserAgent(httpClient, userAgent)
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %w", err)
+	}
+	var wrapped Client = tagit.NewConsulAPIWrapper(client)
+	if cfg.WriteLimiter != nil {
+		wrapped = NewWriteLimitedClient(wrapped, cfg.WriteLimiter)
+	}
+	if cfg.QPS > 0 {
+		// Writes wait for the rate limiter before taking a write slot
+		wrapped = NewRateLimitedClient(wrapped, NewRateLimiter(cfg.QPS, cfg.Burst))
+	}
+	return wrapped, nil
+}
+
+// ParseHTTPAuth parses the user:pass of an HTTP basic auth. The user must not
+// be empty, the password may contain colons. The value is left out of the
+// error, as it holds a secret.
+func ParseHTTPAuth(value string) (*api.HttpBasicAuth, error) {
+	username, password, found := strings.Cut(value, ":")
+	if !found || username == "" {
+		return nil, fmt.Errorf("invalid http auth: must be user:pass")
+	}
+	return &api.HttpBasicAuth{Username: username, Password: password}, nil
+}
+
+// userAgentTransport sets the User-Agent header of each request.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// withUserAgent returns a copy of httpClient sending userAgent with each request.
+func withUserAgent(httpClient *http.Client, userAgent string) *http.Client {
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client := *httpClient
+	client.Transport = &userAgentTransport{base: base, userAgent: userAgent}
+	return &client
+}
+
+// RateLimiter is a token bucket limiting the rate of calls.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	// next is the time the bucket is full again, in the past when it is full.
+	next time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing qps calls per second on average
+// and bursts of up to burst calls, at least one. qps must be positive.
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		interval: time.Duration(float64(time.Second) / qps),
+		burst:    max(burst, 1),
+	}
+}
+
+// Wait blocks until a call is allowed, or returns the error of ctx when it is
+// done first. A cancelled call is given back when no call was reserved after
+// it, as the later calls keep their slots.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now) - time.Duration(l.burst-1)*l.interval
+	l.next = l.next.Add(l.interval)
+	reserved := l.next
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		if l.next.Equal(reserved) {
+			l.next = reserved.Add(-l.interval)
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// NewRateLimitedClient wraps client so each call to Consul waits for limiter
+// first, giving up when the context of the call is done.
+func NewRateLimitedClient(client Client, limiter *RateLimiter) Client {
+	return &rateLimitedClient{client: client, limiter: limiter}
+}
+
+type rateLimitedClient struct {
+	client  Client
+	limiter *RateLimiter
+}
+
+func (c *rateLimitedClient) Agent() tagit.ConsulAgent {
+	return &rateLimitedAgent{agent: c.client.Agent(), limiter: c.limiter}
+}
+
+func (c *rateLimitedClient) KV() tagit.ConsulKV {
+	return &rateLimitedKV{kv: c.client.KV(), limiter: c.limiter}
+}
+
+// LockKey is not limited, as the lock spends most of its calls waiting in
+// blocking queries.
+func (c *rateLimitedClient) LockKey(key string) (tagit.ConsulLock, error) {
+	return c.client.LockKey(key)
+}
+
+type rateLimitedAgent struct {
+	agent   tagit.ConsulAgent
+	limiter *RateLimiter
+}
+
+func (a *rateLimitedAgent) Service(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+	if err := a.limiter.Wait(q.Context()); err != nil {
+		return nil, nil, err
+	}
+	return a.agent.Service(serviceID, q)
+}
+
+func (a *rateLimitedAgent) ServiceRegister(reg *api.AgentServiceRegistration) error {
+	if err := a.limiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	return a.agent.ServiceRegister(reg)
+}
+
+func (a *rateLimitedAgent) ServiceRegisterContext(ctx context.Context, reg *api.AgentServiceRegistration, opts api.ServiceRegisterOpts) error {
+	if err := a.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return a.agent.ServiceRegisterContext(ctx, reg, opts)
+}
+
+func (a *rateLimitedAgent) ServiceDeregisterOpts(serviceID string, q *api.QueryOptions) error {
+	if err := a.limiter.Wait(q.Context()); err != nil {
+		return err
+	}
+	return a.agent.ServiceDeregisterOpts(serviceID, q)
+}
+
+func (a *rateLimitedAgent) ServicesWithFilterOpts(filter string, q *api.QueryOptions) (map[string]*api.AgentService, error) {
+	if err := a.limiter.Wait(q.Context()); err != nil {
+		return nil, err
+	}
+	return a.agent.ServicesWithFilterOpts(filter, q)
+}
+
+func (a *rateLimitedAgent) AgentHealthServiceByIDOpts(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+	if err := a.limiter.Wait(q.Context()); err != nil {
+		return "", nil, err
+	}
+	return a.agent.AgentHealthServiceByIDOpts(serviceID, q)
+}
+
+type rateLimitedKV struct {
+	kv      tagit.ConsulKV
+	limiter *RateLimiter
+}
+
+func (k *rateLimitedKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	if err := k.limiter.Wait(q.Context()); err != nil {
+		return nil, err
+	}
+	return k.kv.Put(p, q)
+}
+
+// WriteLimiter caps the number of concurrent writes to Consul, such as
+// service registrations, so a fleet of services changing at once does not
+// flood the agent. It logs a summary of each batch of writes, from the moment
+// one starts until none is left waiting or in flight.
+type WriteLimiter struct {
+	slots  chan struct{}
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// pending counts the writes waiting for a slot or in flight.
+	pending int
+	batch   writeBatch
+}
+
+// writeBatch holds the writes made since pending was last zero.
+type writeBatch struct {
+	start    time.Time
+	writes   int
+	waited   int
+	services []string
+}
+
+// NewWriteLimiter creates a WriteLimiter allowing up to maxConcurrent writes
+// at once, at least one. Batches of more than one write are logged to logger
+// unless it is nil.
+func NewWriteLimiter(maxConcurrent int, logger *slog.Logger) *WriteLimiter {
+	return &WriteLimiter{
+		slots:  make(chan struct{}, max(maxConcurrent, 1)),
+		logger: logger,
+	}
+}
+
+// acquire blocks until a write for service is allowed, or returns the error
+// of ctx when it is done first. A successful acquire must be released.
+func (l *WriteLimiter) acquire(ctx context.Context, service string) error {
+	l.mu.Lock()
+	if l.pending == 0 {
+		l.batch = writeBatch{start: time.Now()}
+	}
+	l.pending++
+	l.batch.writes++
+	if service != "" && !slices.Contains(l.batch.services, service) {
+		l.batch.services = append(l.batch.services, service)
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	l.batch.waited++
+	l.mu.Unlock()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.finish()
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a write.
+func (l *WriteLimiter) release() {
+	<-l.slots
+	l.finish()
+}
+
+// finish ends a write, logging the batch when it was the last one.
+func (l *WriteLimiter) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+	if l.pending > 0 || l.logger == nil || l.batch.writes < 2 {
+		return
+	}
+	slices.Sort(l.batch.services)
+	l.logger.Info("finished batch of consul writes",
+		"writes", l.batch.writes,
+		"waited", l.batch.waited,
+		"services", l.batch.services,
+		"duration", time.Since(l.batch.start))
+}
+
+// NewWriteLimitedClient wraps client so each write to Consul, a service
+// registration, deregistration or KV put, waits for a slot of limiter first.
+// Reads are not limited.
+func NewWriteLimitedClient(client Client, limiter *WriteLimiter) Client {
+	return &writeLimitedClient{client: client, limiter: limiter}
+}
+
+type writeLimitedClient struct {
+	client  Client
+	limiter *WriteLimiter
+}
+
+func (c *writeLimitedClient) Agent() tagit.ConsulAgent {
+	return &writeLimitedAgent{ConsulAgent: c.client.Agent(), limiter: c.limiter}
+}
+
+func (c *writeLimitedClient) KV() tagit.ConsulKV {
+	return &writeLimitedKV{kv: c.client.KV(), limiter: c.limiter}
+}
+
+func (c *writeLimitedClient) LockKey(key string) (tagit.ConsulLock, error) {
+	return c.client.LockKey(key)
+}
+
+// writeLimitedAgent limits the writes of the embedded agent.
+type writeLimitedAgent struct {
+	tagit.ConsulAgent
+	limiter *WriteLimiter
+}
+
+func (a *writeLimitedAgent) ServiceRegister(reg *api.AgentServiceRegistration) error {
+	if err := a.limiter.acquire(context.Background(), reg.ID); err != nil {
+		return err
+	}
+	defer a.limiter.release()
+	return a.ConsulAgent.ServiceRegister(reg)
+}
+
+func (a *writeLimitedAgent) ServiceRegisterContext(ctx context.Context, reg *api.AgentServiceRegistration, opts api.ServiceRegisterOpts) error {
+	if err := a.limiter.acquire(ctx, reg.ID); err != nil {
+		return err
+	}
+	defer a.limiter.release()
+	return a.ConsulAgent.ServiceRegisterContext(ctx, reg, opts)
+}
+
+func (a *writeLimitedAgent) ServiceDeregisterOpts(serviceID string, q *api.QueryOptions) error {
+	if err := a.limiter.acquire(q.Context(), serviceID); err != nil {
+		return err
+	}
+	defer a.limiter.release()
+	return a.ConsulAgent.ServiceDeregisterOpts(serviceID, q)
+}
+
+type writeLimitedKV struct {
+	kv      tagit.ConsulKV
+	limiter *WriteLimiter
+}
+
+func (k *writeLimitedKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	if err := k.limiter.acquire(q.Context(), ""); err != nil {
+		return nil, err
+	}
+	defer k.limiter.release()
+	return k.kv.Put(p, q)
+}
+
+// CreateClient creates a Consul client for the given address and token using the DefaultFactory.
+func CreateClient(address, token string) (Client, error) {
+	return (&DefaultFactory{}).NewClient(Config{Address: address, Token: token})
+}
+
+// parseAddress splits an optional scheme prefix from the address. An explicit
+// scheme must agree with the prefix when both are given. A unix:// address is
+// returned unchanged, as the Consul API dials the socket itself.
+func parseAddress(address, scheme string) (string, string, error) {
+	scheme = strings.ToLower(scheme)
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		return "", "", fmt.Errorf("invalid scheme %q: must be http or https", scheme)
+	}
+
+	prefix, rest, found := strings.Cut(address, "://")
+	if !found {
+		return address, scheme, nil
+	}
+
+	prefix = strings.ToLower(prefix)
+	if prefix == "unix" {
+		return address, scheme, nil
+	}
+	if prefix != "http" && prefix != "https" {
+		return "", "", fmt.Errorf("invalid scheme %q in address %q: must be http, https or unix", prefix, address)
+	}
+	if scheme != "" && scheme != prefix {
+		return "", "", fmt.Errorf("scheme %q conflicts with address %q", scheme, address)
+	}
+	return rest, prefix, nil
+}
+
+// applyTLSConfig overrides the TLS settings with the non-empty fields of tlsConfig.
+func applyTLSConfig(dst *api.TLSConfig, tlsConfig TLSConfig) {
+	if tlsConfig.CAFile != "" {
+		dst.CAFile = tlsConfig.CAFile
+	}
+	if tlsConfig.CertFile != "" {
+		dst.CertFile = tlsConfig.CertFile
+	}
+	if tlsConfig.KeyFile != "" {
+		dst.KeyFile = tlsConfig.KeyFile
+	}
+	if tlsConfig.ServerName != "" {
+		dst.Address = tlsConfig.ServerName
+	}
+	if tlsConfig.InsecureSkipVerify {
+		dst.InsecureSkipVerify = true
+	}
+}
@@ -0,0 +1,550 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/tagit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultFactory_NewClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		tlsConfig TLSConfig
+		wantErr   string
+	}{
+		{
+			name: "No TLS",
+		},
+		{
+			name:      "Missing CA cert",
+			tlsConfig: TLSConfig{CAFile: "/nonexistent/ca.pem"},
+			wantErr:   "failed to create Consul client",
+		},
+		{
+			name:      "Missing client cert and key",
+			tlsConfig: TLSConfig{CertFile: "/nonexistent/client.pem", KeyFile: "/nonexistent/client-key.pem"},
+			wantErr:   "failed to create Consul client",
+		},
+		{
+			name:      "Server name only",
+			tlsConfig: TLSConfig{ServerName: "consul.example.com"},
+		},
+	}
+
+	factory := &DefaultFactory{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := factory.NewClient(Config{
+				Address: "127.0.0.1:8500",
+				Token:   "token",
+				TLS:     tt.tlsConfig,
+			})
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.Nil(t, client)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, client)
+			}
+		})
+	}
+}
+
+func TestCreateClient(t *testing.T) {
+	client, err := CreateClient("127.0.0.1:8500", "token")
+
+	assert.NoError(t, err)
+	assert.NotNil(t, client)
+
+	_, isClient := client.(Client)
+	assert.True(t, isClient, "CreateClient does not return a Client")
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		scheme      string
+		wantAddress string
+		wantScheme  string
+		wantErr     string
+	}{
+		{
+			name:        "Address without scheme",
+			address:     "127.0.0.1:8500",
+			wantAddress: "127.0.0.1:8500",
+		},
+		{
+			name:        "Scheme from flag",
+			address:     "127.0.0.1:8501",
+			scheme:      "https",
+			wantAddress: "127.0.0.1:8501",
+			wantScheme:  "https",
+		},
+		{
+			name:        "Scheme from address",
+			address:     "https://consul.example.com:8501",
+			wantAddress: "consul.example.com:8501",
+			wantScheme:  "https",
+		},
+		{
+			name:        "Matching scheme in flag and address",
+			address:     "HTTP://127.0.0.1:8500",
+			scheme:      "http",
+			wantAddress: "127.0.0.1:8500",
+			wantScheme:  "http",
+		},
+		{
+			name:    "Conflicting scheme in flag and address",
+			address: "http://127.0.0.1:8500",
+			scheme:  "https",
+			wantErr: "conflicts with address",
+		},
+		{
+			name:    "Invalid scheme flag",
+			address: "127.0.0.1:8500",
+			scheme:  "ftp",
+			wantErr: "invalid scheme \"ftp\"",
+		},
+		{
+			name:    "Invalid scheme in address",
+			address: "ftp://127.0.0.1:8500",
+			wantErr: "invalid scheme \"ftp\"",
+		},
+		{
+			name:        "Unix socket",
+			address:     "unix:///var/run/consul.sock",
+			wantAddress: "unix:///var/run/consul.sock",
+		},
+		{
+			name:        "Unix socket keeps the scheme flag",
+			address:     "unix:///var/run/consul.sock",
+			scheme:      "https",
+			wantAddress: "unix:///var/run/consul.sock",
+			wantScheme:  "https",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, scheme, err := parseAddress(tt.address, tt.scheme)
+
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantAddress, address)
+				assert.Equal(t, tt.wantScheme, scheme)
+			}
+		})
+	}
+}
+
+func TestDefaultFactory_NewClientScheme(t *testing.T) {
+	factory := &DefaultFactory{}
+
+	client, err := factory.NewClient(Config{Address: "https://127.0.0.1:8501"})
+	assert.NoError(t, err)
+	assert.NotNil(t, client)
+
+	client, err = factory.NewClient(Config{Address: "http://127.0.0.1:8500", Scheme: "https"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to create Consul client")
+	assert.Nil(t, client)
+}
+
+// countingTransport counts the requests it passes on to the default transport.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDefaultFactory_NewClientHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ID": "web", "Service": "web"}`))
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	client, err := (&DefaultFactory{}).NewClient(Config{
+		Address:    server.URL,
+		HTTPClient: &http.Client{Transport: transport},
+	})
+	assert.NoError(t, err)
+
+	service, _, err := client.Agent().Service("web", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "web", service.ID)
+	assert.Equal(t, int32(1), transport.requests.Load(), "Expected the request to go through the custom HTTP client")
+}
+
+// userAgentRecorder records the User-Agent of the requests and answers with
+// an empty service.
+type userAgentRecorder struct {
+	userAgents []string
+}
+
+func (r *userAgentRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.userAgents = append(r.userAgents, req.Header.Get("User-Agent"))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"ID": "web", "Service": "web"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestDefaultFactory_NewClientUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "Default",
+			expected: DefaultUserAgent(),
+		},
+		{
+			name:      "Override",
+			userAgent: "tagit-db/1.2",
+			expected:  "tagit-db/1.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &userAgentRecorder{}
+			httpClient := &http.Client{Transport: recorder}
+			client, err := (&DefaultFactory{}).NewClient(Config{
+				Address:    "127.0.0.1:8500",
+				HTTPClient: httpClient,
+				UserAgent:  tt.userAgent,
+			})
+			assert.NoError(t, err)
+
+			_, _, err = client.Agent().Service("web", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{tt.expected}, recorder.userAgents)
+			assert.Equal(t, recorder, httpClient.Transport, "Expected the given HTTP client to be left untouched")
+		})
+	}
+}
+
+func TestParseHTTPAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected *api.HttpBasicAuth
+		wantErr  bool
+	}{
+		{name: "User and password", value: "admin:s3cret", expected: &api.HttpBasicAuth{Username: "admin", Password: "s3cret"}},
+		{name: "Colon in password", value: "admin:s3:cr:et", expected: &api.HttpBasicAuth{Username: "admin", Password: "s3:cr:et"}},
+		{name: "Empty password", value: "admin:", expected: &api.HttpBasicAuth{Username: "admin"}},
+		{name: "Missing colon", value: "admin", wantErr: true},
+		{name: "Empty user", value: ":s3cret", wantErr: true},
+		{name: "Empty", value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := ParseHTTPAuth(tt.value)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "must be user:pass")
+				assert.NotContains(t, err.Error(), "s3cret", "The error must not leak the password")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, auth)
+		})
+	}
+}
+
+func TestDefaultFactory_NewClientHTTPAuth(t *testing.T) {
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ID": "web", "Service": "web"}`))
+	}))
+	defer server.Close()
+
+	client, err := (&DefaultFactory{}).NewClient(Config{Address: server.URL, HTTPAuth: "admin:s3cret"})
+	assert.NoError(t, err)
+	_, _, err = client.Agent().Service("web", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", username)
+	assert.Equal(t, "s3cret", password)
+
+	_, err = (&DefaultFactory{}).NewClient(Config{Address: server.URL, HTTPAuth: "admin"})
+	assert.ErrorContains(t, err, "invalid http auth")
+}
+
+func TestDefaultFactory_NewClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := (&DefaultFactory{}).NewClient(Config{Address: server.URL, Timeout: 20 * time.Millisecond})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, _, err = client.Agent().Service("web", nil)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second, "Expected the request to be cut off by the timeout")
+}
+
+func TestDefaultFactory_NewClientQPS(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ID": "web", "Service": "web"}`))
+	}))
+	defer server.Close()
+
+	client, err := (&DefaultFactory{}).NewClient(Config{Address: server.URL, QPS: 20, Burst: 2})
+	assert.NoError(t, err)
+
+	// The burst goes through right away, the other 4 calls are 50ms apart
+	start := time.Now()
+	for range 6 {
+		_, _, err := client.Agent().Service("web", nil)
+		assert.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+	assert.Equal(t, int32(6), requests.Load())
+	assert.GreaterOrEqual(t, elapsed, 190*time.Millisecond, "Expected the calls to be throttled to 20 per second")
+	assert.Less(t, elapsed, time.Second, "Expected the burst to skip the wait")
+
+	_, err = (&DefaultFactory{}).NewClient(Config{Address: server.URL, QPS: -1})
+	assert.ErrorContains(t, err, "qps must not be negative")
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1, 3)
+
+	start := time.Now()
+	for range 3 {
+		assert.NoError(t, limiter.Wait(context.Background()))
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "Expected the burst to go through right away")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := limiter.Wait(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Expected the wait to stop with its context")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.WithinDuration(t, start.Add(3*time.Second), limiter.next, 100*time.Millisecond, "Expected the cancelled wait to give its call back")
+}
+
+func TestRateLimiterConcurrentCancel(t *testing.T) {
+	limiter := NewRateLimiter(10, 1)
+	next := func() time.Time {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return limiter.next
+	}
+	assert.NoError(t, limiter.Wait(context.Background()))
+
+	// The first waiter is cancelled after the second one reserved its call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	reserved := next()
+	go func() { cancelled <- limiter.Wait(ctx) }()
+	assert.Eventually(t, func() bool { return !next().Equal(reserved) }, time.Second, time.Millisecond)
+
+	waited := make(chan time.Time)
+	reserved = next()
+	go func() {
+		assert.NoError(t, limiter.Wait(context.Background()))
+		waited <- time.Now()
+	}()
+	assert.Eventually(t, func() bool { return !next().Equal(reserved) }, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	assert.NoError(t, limiter.Wait(context.Background()))
+	last := time.Now()
+	second := <-waited
+
+	gap := last.Sub(second)
+	if gap < 0 {
+		gap = -gap
+	}
+	assert.GreaterOrEqual(t, gap, 80*time.Millisecond, "Expected the cancelled call not to let two calls through at once")
+}
+
+func TestRateLimitedClientContext(t *testing.T) {
+	limiter := NewRateLimiter(1, 1)
+	assert.NoError(t, limiter.Wait(context.Background()))
+	backend := &concurrencyClient{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := NewRateLimitedClient(backend, limiter).Agent().ServiceRegisterContext(ctx, &api.AgentServiceRegistration{ID: "web"}, api.ServiceRegisterOpts{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Expected the registration to stop waiting with its context")
+	assert.Zero(t, backend.writes.Load())
+}
+
+// concurrencyClient is a Consul client recording the most writes in flight at once.
+type concurrencyClient struct {
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+	writes      atomic.Int32
+}
+
+func (c *concurrencyClient) write() {
+	n := c.inFlight.Add(1)
+	for {
+		highest := c.maxInFlight.Load()
+		if n <= highest || c.maxInFlight.CompareAndSwap(highest, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.writes.Add(1)
+	c.inFlight.Add(-1)
+}
+
+func (c *concurrencyClient) Agent() tagit.ConsulAgent { return c }
+func (c *concurrencyClient) KV() tagit.ConsulKV       { return c }
+func (c *concurrencyClient) LockKey(key string) (tagit.ConsulLock, error) {
+	return nil, nil
+}
+func (c *concurrencyClient) Service(string, *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+	return &api.AgentService{}, nil, nil
+}
+func (c *concurrencyClient) ServiceRegister(*api.AgentServiceRegistration) error {
+	c.write()
+	return nil
+}
+func (c *concurrencyClient) ServiceRegisterContext(context.Context, *api.AgentServiceRegistration, api.ServiceRegisterOpts) error {
+	c.write()
+	return nil
+}
+func (c *concurrencyClient) ServiceDeregisterOpts(string, *api.QueryOptions) error {
+	c.write()
+	return nil
+}
+func (c *concurrencyClient) ServicesWithFilterOpts(string, *api.QueryOptions) (map[string]*api.AgentService, error) {
+	return nil, nil
+}
+func (c *concurrencyClient) AgentHealthServiceByIDOpts(string, *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+	return api.HealthPassing, nil, nil
+}
+func (c *concurrencyClient) Put(*api.KVPair, *api.WriteOptions) (*api.WriteMeta, error) {
+	c.write()
+	return nil, nil
+}
+
+func TestWriteLimiter(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxConcurrent int
+	}{
+		{name: "One", maxConcurrent: 1},
+		{name: "Three", maxConcurrent: 3},
+		{name: "Below One Means One", maxConcurrent: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			limiter := NewWriteLimiter(tt.maxConcurrent, slog.New(slog.NewTextHandler(&logs, nil)))
+			backend := &concurrencyClient{}
+			// Two clients, as for services on different agents, share the cap
+			clients := []Client{NewWriteLimitedClient(backend, limiter), NewWriteLimitedClient(backend, limiter)}
+
+			var wg sync.WaitGroup
+			for i := range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client := clients[i%2]
+					switch i % 4 {
+					case 0:
+						client.Agent().ServiceRegister(&api.AgentServiceRegistration{ID: fmt.Sprintf("service-%d", i)})
+					case 1:
+						client.Agent().ServiceRegisterContext(context.Background(), &api.AgentServiceRegistration{ID: fmt.Sprintf("service-%d", i)}, api.ServiceRegisterOpts{})
+					case 2:
+						client.Agent().ServiceDeregisterOpts(fmt.Sprintf("service-%d", i), nil)
+					default:
+						client.KV().Put(&api.KVPair{Key: "tagit"}, nil)
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(20), backend.writes.Load())
+			assert.LessOrEqual(t, backend.maxInFlight.Load(), int32(max(tt.maxConcurrent, 1)), "Expected the writes in flight to never exceed the cap")
+			assert.Contains(t, logs.String(), "finished batch of consul writes")
+			assert.Contains(t, logs.String(), "writes=")
+		})
+	}
+
+	t.Run("Gives Up With Context", func(t *testing.T) {
+		limiter := NewWriteLimiter(1, nil)
+		assert.NoError(t, limiter.acquire(context.Background(), "service-a"))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := NewWriteLimitedClient(&concurrencyClient{}, limiter).Agent().ServiceDeregisterOpts("service-b", (&api.QueryOptions{}).WithContext(ctx))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		limiter.release()
+		assert.Equal(t, 0, limiter.pending, "Expected the abandoned write to leave the batch")
+	})
+
+	t.Run("Registration Gives Up With Context", func(t *testing.T) {
+		limiter := NewWriteLimiter(1, nil)
+		assert.NoError(t, limiter.acquire(context.Background(), "service-a"))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := NewWriteLimitedClient(&concurrencyClient{}, limiter).Agent().ServiceRegisterContext(ctx, &api.AgentServiceRegistration{ID: "service-b"}, api.ServiceRegisterOpts{})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		limiter.release()
+		assert.Equal(t, 0, limiter.pending, "Expected the abandoned write to leave the batch")
+	})
+}
+
+func TestApplyTLSConfig(t *testing.T) {
+	dst := api.TLSConfig{
+		CAFile:   "/env/ca.pem",
+		CertFile: "/env/client.pem",
+	}
+
+	applyTLSConfig(&dst, TLSConfig{
+		CertFile:           "/flag/client.pem",
+		KeyFile:            "/flag/client-key.pem",
+		ServerName:         "consul.example.com",
+		InsecureSkipVerify: true,
+	})
+
+	assert.Equal(t, "/env/ca.pem", dst.CAFile, "Empty CAFile should keep the existing value")
+	assert.Equal(t, "/flag/client.pem", dst.CertFile)
+	assert.Equal(t, "/flag/client-key.pem", dst.KeyFile)
+	assert.Equal(t, "consul.example.com", dst.Address)
+	assert.True(t, dst.InsecureSkipVerify)
+}
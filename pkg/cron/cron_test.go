@@ -0,0 +1,110 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr string
+	}{
+		{name: "Every minute", spec: "* * * * *"},
+		{name: "Lists, ranges and steps", spec: "0,30 9-17/2 1-15 */3 1-5"},
+		{name: "Sunday as 7", spec: "0 0 * * 7"},
+		{name: "Too few fields", spec: "* * * *", wantErr: "expected 5 fields, got 4"},
+		{name: "Out of range", spec: "60 * * * *", wantErr: "minute 60 out of range 0-59"},
+		{name: "Invalid value", spec: "* noon * * *", wantErr: `invalid value "noon" in hour`},
+		{name: "Invalid step", spec: "*/0 * * * *", wantErr: `invalid step "0" in minute`},
+		{name: "Reversed range", spec: "* * 10-5 * *", wantErr: `invalid range "10-5" in day of month`},
+		{name: "Day of month zero", spec: "* * 0 * *", wantErr: "day of month 0 out of range 1-31"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Nil(t, schedule)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, schedule)
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	date := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04:05", value)
+		assert.NoError(t, err)
+		return parsed
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		from     string
+		expected []string
+	}{
+		{
+			name:     "Every minute",
+			spec:     "* * * * *",
+			from:     "2024-03-01 10:07:30",
+			expected: []string{"2024-03-01 10:08:00", "2024-03-01 10:09:00"},
+		},
+		{
+			name:     "Every 15 minutes",
+			spec:     "*/15 * * * *",
+			from:     "2024-03-01 10:07:30",
+			expected: []string{"2024-03-01 10:15:00", "2024-03-01 10:30:00", "2024-03-01 10:45:00", "2024-03-01 11:00:00"},
+		},
+		{
+			name:     "Exact time is skipped",
+			spec:     "30 10 * * *",
+			from:     "2024-03-01 10:30:00",
+			expected: []string{"2024-03-02 10:30:00"},
+		},
+		{
+			name:     "Weekdays",
+			spec:     "0 9 * * 1-5",
+			from:     "2024-03-01 12:00:00", // a Friday
+			expected: []string{"2024-03-04 09:00:00", "2024-03-05 09:00:00"},
+		},
+		{
+			name:     "Day of month or day of week",
+			spec:     "0 0 13 * 5",
+			from:     "2024-09-01 00:00:00",
+			expected: []string{"2024-09-06 00:00:00", "2024-09-13 00:00:00", "2024-09-20 00:00:00"},
+		},
+		{
+			name:     "Leap day",
+			spec:     "0 0 29 2 *",
+			from:     "2024-03-01 00:00:00",
+			expected: []string{"2028-02-29 00:00:00"},
+		},
+		{
+			name:     "Never",
+			spec:     "0 0 31 2 *",
+			from:     "2024-01-01 00:00:00",
+			expected: []string{"0001-01-01 00:00:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			assert.NoError(t, err)
+
+			now := date(tt.from)
+			for _, expected := range tt.expected {
+				now = schedule.Next(now)
+				assert.Equal(t, date(expected), now)
+			}
+		})
+	}
+}
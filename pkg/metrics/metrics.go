@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Metrics counts the tags changed by tagit per service and serves them in
+// the Prometheus text format.
+type Metrics struct {
+	mu      sync.Mutex
+	added   map[string]uint64
+	removed map[string]uint64
+}
+
+// New creates an empty Metrics.
+func New() *Metrics {
+	return &Metrics{
+		added:   make(map[string]uint64),
+		removed: make(map[string]uint64),
+	}
+}
+
+// RecordTagChanges adds the number of tags added to and removed from the
+// service to the counters.
+func (m *Metrics) RecordTagChanges(serviceID string, added, removed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.added[serviceID] += uint64(added)
+	m.removed[serviceID] += uint64(removed)
+}
+
+// ServeHTTP writes the counters in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the counters in the Prometheus text format to w.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeCounter(&b, "tagit_tags_added_total", "Number of tags added to the service.", m.added)
+	writeCounter(&b, "tagit_tags_removed_total", "Number of tags removed from the service.", m.removed)
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeCounter writes a counter labeled by service, sorted by service.
+func writeCounter(b *strings.Builder, name, help string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	services := make([]string, 0, len(values))
+	for service := range values {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	for _, service := range services {
+		fmt.Fprintf(b, "%s{service=\"%s\"} %d\n", name, escapeLabel(service), values[service])
+	}
+}
+
+// escapeLabel escapes a label value as required by the Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.RecordTagChanges("web", 2, 1)
+	m.RecordTagChanges("db", 1, 0)
+	m.RecordTagChanges("web", 1, 3)
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	expected := `# HELP tagit_tags_added_total Number of tags added to the service.
+# TYPE tagit_tags_added_total counter
+tagit_tags_added_total{service="db"} 1
+tagit_tags_added_total{service="web"} 3
+# HELP tagit_tags_removed_total Number of tags removed from the service.
+# TYPE tagit_tags_removed_total counter
+tagit_tags_removed_total{service="db"} 0
+tagit_tags_removed_total{service="web"} 4
+`
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, expected, string(body))
+}
+
+func TestEscapeLabel(t *testing.T) {
+	assert.Equal(t, `web\"1\\2\n`, escapeLabel("web\"1\\2\n"))
+}
@@ -3,26 +3,47 @@ package systemd
 import (
 	"bytes"
 	"fmt"
+	"path"
 	"strings"
 	"text/template"
 )
 
+// DefaultHomeDir is the base directory for the HOME of the service when none is given.
+const DefaultHomeDir = "/var/run/tagit"
+
 const (
 	templateName     = "serviceTemplate"
 	templateContents = `
 [Unit]
 Description=Tagit {{ .ServiceID }}
 After=network.target
+{{- if not .NoNetworkOnline }}
 After=network-online.target
 Wants=network-online.target
+{{- end }}
+{{- range .After }}
+After={{ . }}
+{{- end }}
+{{- range .Wants }}
+Wants={{ . }}
+{{- end }}
+{{- range .Requires }}
+Requires={{ . }}
+{{- end }}
 
 [Service]
 Type=simple
 ExecStart=/usr/bin/tagit run -s {{ .ServiceID }} -x {{ .Script }} -p {{ .TagPrefix }} -i {{ .Interval }}{{ if .Token }} -t {{ .Token }}{{ end }}{{ if .ConsulAddr }} -c {{ .ConsulAddr }}{{ end }}
-Environment=HOME=/var/run/tagit/{{ .ServiceID }}
+Environment=HOME={{ .Home }}
 Restart=always
 User={{ .User }}
 Group={{ .Group }}
+{{- if .IOWeight }}
+IOWeight={{ .IOWeight }}
+{{- end }}
+{{- if .Nice }}
+Nice={{ .Nice }}
+{{- end }}
 
 [Install]
 WantedBy=multi-user.target
@@ -39,6 +60,27 @@ type Fields struct {
 	ConsulAddr string
 	User       string
 	Group      string
+	HomeDir    string
+	// After, Wants and Requires are extra unit dependencies, rendered in
+	// addition to the default network ordering.
+	After    []string
+	Wants    []string
+	Requires []string
+	// NoNetworkOnline drops the network-online.target ordering, for hosts without it.
+	NoNetworkOnline bool
+	// IOWeight and Nice tune the scheduling priority of the service. They are
+	// omitted when IOWeight is 0 or Nice is nil.
+	IOWeight int
+	Nice     *int
+}
+
+// Home returns the HOME of the service, under HomeDir or DefaultHomeDir.
+func (f *Fields) Home() string {
+	homeDir := f.HomeDir
+	if homeDir == "" {
+		homeDir = DefaultHomeDir
+	}
+	return path.Join(homeDir, f.ServiceID)
 }
 
 var parsedTemplate *template.Template
@@ -92,6 +134,18 @@ func validateFields(fields *Fields) error {
 		return fmt.Errorf("missing required fields: %s", strings.Join(missingFields, ", "))
 	}
 
+	if fields.HomeDir != "" && !path.IsAbs(fields.HomeDir) {
+		return fmt.Errorf("HomeDir must be an absolute path: %s", fields.HomeDir)
+	}
+
+	if fields.IOWeight != 0 && (fields.IOWeight < 1 || fields.IOWeight > 10000) {
+		return fmt.Errorf("IOWeight must be between 1 and 10000: %d", fields.IOWeight)
+	}
+
+	if fields.Nice != nil && (*fields.Nice < -20 || *fields.Nice > 19) {
+		return fmt.Errorf("Nice must be between -20 and 19: %d", *fields.Nice)
+	}
+
 	return nil
 }
 
@@ -106,6 +160,7 @@ func NewFieldsFromFlags(flags map[string]string) (*Fields, error) {
 		ConsulAddr: flags["consul-addr"],
 		User:       flags["user"],
 		Group:      flags["group"],
+		HomeDir:    flags["home-dir"],
 	}
 
 	if err := validateFields(fields); err != nil {
@@ -122,5 +177,5 @@ func GetRequiredFlags() []string {
 
 // GetOptionalFlags returns a list of optional flag names.
 func GetOptionalFlags() []string {
-	return []string{"token", "consul-addr"}
+	return []string{"token", "consul-addr", "home-dir"}
 }
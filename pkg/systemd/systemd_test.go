@@ -172,6 +172,22 @@ func TestValidateFields(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Absolute HomeDir",
+			fields: Fields{
+				ServiceID: "test", Script: "test", TagPrefix: "test",
+				Interval: "test", User: "test", Group: "test", HomeDir: "/opt/tagit",
+			},
+			wantErr: false,
+		},
+		{
+			name: "Relative HomeDir",
+			fields: Fields{
+				ServiceID: "test", Script: "test", TagPrefix: "test",
+				Interval: "test", User: "test", Group: "test", HomeDir: "opt/tagit",
+			},
+			wantErr: true,
+		},
 		{
 			name: "Missing multiple fields including Script",
 			fields: Fields{
@@ -244,6 +260,151 @@ func TestNewFieldsFromFlags(t *testing.T) {
 	}
 }
 
+func TestFieldsHome(t *testing.T) {
+	tests := []struct {
+		name    string
+		homeDir string
+		want    string
+	}{
+		{name: "Default HomeDir", homeDir: "", want: "/var/run/tagit/test-service"},
+		{name: "Custom HomeDir", homeDir: "/opt/tagit", want: "/opt/tagit/test-service"},
+		{name: "Custom HomeDir with trailing slash", homeDir: "/opt/tagit/", want: "/opt/tagit/test-service"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := Fields{
+				ServiceID: "test-service", Script: "test", TagPrefix: "test",
+				Interval: "test", User: "test", Group: "test", HomeDir: tt.homeDir,
+			}
+			if got := fields.Home(); got != tt.want {
+				t.Errorf("Home() = %v, want %v", got, tt.want)
+			}
+
+			rendered, err := RenderTemplate(&fields)
+			if err != nil {
+				t.Fatalf("RenderTemplate() error = %v", err)
+			}
+			if !strings.Contains(rendered, "Environment=HOME="+tt.want+"\n") {
+				t.Errorf("RenderTemplate() output does not contain HOME=%s:\n%s", tt.want, rendered)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateDependencies(t *testing.T) {
+	fields := Fields{
+		ServiceID: "test-service", Script: "test", TagPrefix: "test",
+		Interval: "test", User: "test", Group: "test",
+	}
+
+	rendered, err := RenderTemplate(&fields)
+	if err != nil {
+		t.Fatalf("RenderTemplate() error = %v", err)
+	}
+	defaultUnit := "[Unit]\nDescription=Tagit test-service\nAfter=network.target\nAfter=network-online.target\nWants=network-online.target\n\n[Service]"
+	if !strings.Contains(rendered, defaultUnit) {
+		t.Errorf("RenderTemplate() default [Unit] section changed:\n%s", rendered)
+	}
+
+	fields.After = []string{"consul.service", "local-fs.target"}
+	fields.Wants = []string{"consul.service"}
+	fields.Requires = []string{"docker.service"}
+
+	rendered, err = RenderTemplate(&fields)
+	if err != nil {
+		t.Fatalf("RenderTemplate() error = %v", err)
+	}
+	expectedUnit := "[Unit]\nDescription=Tagit test-service\nAfter=network.target\nAfter=network-online.target\nWants=network-online.target\n" +
+		"After=consul.service\nAfter=local-fs.target\nWants=consul.service\nRequires=docker.service\n\n[Service]"
+	if !strings.Contains(rendered, expectedUnit) {
+		t.Errorf("RenderTemplate() [Unit] section does not contain the extra dependencies:\n%s", rendered)
+	}
+}
+
+func TestRenderTemplateNoNetworkOnline(t *testing.T) {
+	fields := Fields{
+		ServiceID: "test-service", Script: "test", TagPrefix: "test",
+		Interval: "test", User: "test", Group: "test", NoNetworkOnline: true,
+	}
+
+	rendered, err := RenderTemplate(&fields)
+	if err != nil {
+		t.Fatalf("RenderTemplate() error = %v", err)
+	}
+	if strings.Contains(rendered, "network-online.target") {
+		t.Errorf("RenderTemplate() output should not contain network-online.target:\n%s", rendered)
+	}
+	expectedUnit := "[Unit]\nDescription=Tagit test-service\nAfter=network.target\n\n[Service]"
+	if !strings.Contains(rendered, expectedUnit) {
+		t.Errorf("RenderTemplate() output should keep network.target:\n%s", rendered)
+	}
+}
+
+func TestRenderTemplateScheduling(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	tests := []struct {
+		name        string
+		ioWeight    int
+		nice        *int
+		wantErr     bool
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:        "Unset",
+			notContains: []string{"IOWeight=", "Nice="},
+		},
+		{
+			name:     "IOWeight And Nice",
+			ioWeight: 50,
+			nice:     intPtr(10),
+			contains: []string{"Group=test\nIOWeight=50\nNice=10\n"},
+		},
+		{
+			name:        "Zero Nice",
+			nice:        intPtr(0),
+			contains:    []string{"Nice=0"},
+			notContains: []string{"IOWeight="},
+		},
+		{
+			name:     "Lowest Nice",
+			nice:     intPtr(-20),
+			contains: []string{"Nice=-20"},
+		},
+		{name: "Nice Too Low", nice: intPtr(-21), wantErr: true},
+		{name: "Nice Too High", nice: intPtr(20), wantErr: true},
+		{name: "IOWeight Too Low", ioWeight: -1, wantErr: true},
+		{name: "IOWeight Too High", ioWeight: 10001, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := Fields{
+				ServiceID: "test-service", Script: "test", TagPrefix: "test",
+				Interval: "test", User: "test", Group: "test",
+				IOWeight: tt.ioWeight, Nice: tt.nice,
+			}
+
+			rendered, err := RenderTemplate(&fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenderTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("RenderTemplate() output should contain %q:\n%s", want, rendered)
+				}
+			}
+			for _, unwanted := range tt.notContains {
+				if strings.Contains(rendered, unwanted) {
+					t.Errorf("RenderTemplate() output should not contain %q:\n%s", unwanted, rendered)
+				}
+			}
+		})
+	}
+}
+
 func TestGetRequiredFlags(t *testing.T) {
 	required := GetRequiredFlags()
 	expected := []string{"service-id", "script", "tag-prefix", "interval", "user", "group"}
@@ -254,7 +415,7 @@ func TestGetRequiredFlags(t *testing.T) {
 
 func TestGetOptionalFlags(t *testing.T) {
 	optional := GetOptionalFlags()
-	expected := []string{"token", "consul-addr"}
+	expected := []string{"token", "consul-addr", "home-dir"}
 	if !stringSlicesEqual(optional, expected) {
 		t.Errorf("GetOptionalFlags() = %v, want %v", optional, expected)
 	}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package tagit
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// credential is never set, as running a command as another user is only
+// supported on Unix.
+type credential struct{}
+
+// lookupCredential fails when a user or group is given, as running a
+// command as another user is only supported on Unix.
+func lookupCredential(username, group string) (*credential, error) {
+	if username == "" && group == "" {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("running the script as another user is not supported on %s", runtime.GOOS)
+}
+
+// setCredential does nothing, cred is always nil.
+func setCredential(cmd *exec.Cmd, cred *credential) {}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package tagit
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential is the user and group a command runs as.
+type credential = syscall.Credential
+
+// lookupCredential resolves the given user and group, each either a name or
+// a numeric ID. Without a group the primary group of the user is used, and
+// without a user the current one. It returns nil when neither is given.
+func lookupCredential(username, group string) (*credential, error) {
+	if username == "" && group == "" {
+		return nil, nil
+	}
+
+	uid, gid := uint32(syscall.Getuid()), uint32(syscall.Getgid())
+	if username != "" {
+		u, err := user.Lookup(username)
+		var unknownUser user.UnknownUserError
+		if errors.As(err, &unknownUser) {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid run-as user %q: %w", username, err)
+		}
+		if uid, err = parseID(u.Uid); err != nil {
+			return nil, fmt.Errorf("invalid run-as user %q: %w", username, err)
+		}
+		if gid, err = parseID(u.Gid); err != nil {
+			return nil, fmt.Errorf("invalid run-as user %q: %w", username, err)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		var unknownGroup user.UnknownGroupError
+		if errors.As(err, &unknownGroup) {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid run-as group %q: %w", group, err)
+		}
+		if gid, err = parseID(g.Gid); err != nil {
+			return nil, fmt.Errorf("invalid run-as group %q: %w", group, err)
+		}
+	}
+	return &credential{Uid: uid, Gid: gid}, nil
+}
+
+// setCredential makes cmd run with cred, or as the current user when nil.
+func setCredential(cmd *exec.Cmd, cred *credential) {
+	if cred == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+}
+
+// parseID parses a numeric user or group ID.
+func parseID(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q: %w", id, err)
+	}
+	return uint32(value), nil
+}
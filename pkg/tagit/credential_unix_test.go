@@ -0,0 +1,93 @@
+//go:build unix
+
+package tagit
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCredential(t *testing.T) {
+	current, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+
+	tests := []struct {
+		name        string
+		user        string
+		group       string
+		expectedUID uint32
+		expectedGID uint32
+		wantErr     string
+	}{
+		{name: "User By Name", user: current.Username, expectedUID: uint32(uid), expectedGID: uint32(gid)},
+		{name: "User By ID", user: current.Uid, expectedUID: uint32(uid), expectedGID: uint32(gid)},
+		{name: "Group Only", group: current.Gid, expectedUID: uint32(os.Getuid()), expectedGID: uint32(gid)},
+		{name: "Unknown User", user: "tagit-no-such-user", wantErr: `invalid run-as user "tagit-no-such-user"`},
+		{name: "Unknown Group", user: current.Username, group: "tagit-no-such-group", wantErr: `invalid run-as group "tagit-no-such-group"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := lookupCredential(tt.user, tt.group)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			cmd := exec.Command("true")
+			setCredential(cmd, cred)
+			assert.Equal(t, tt.expectedUID, cmd.SysProcAttr.Credential.Uid)
+			assert.Equal(t, tt.expectedGID, cmd.SysProcAttr.Credential.Gid)
+		})
+	}
+
+	t.Run("Not Set", func(t *testing.T) {
+		cred, err := lookupCredential("", "")
+		assert.NoError(t, err)
+		cmd := exec.Command("true")
+		setCredential(cmd, cred)
+		assert.Nil(t, cmd.SysProcAttr, "Expected no credential without a user or group")
+	})
+}
+
+func TestCmdExecutor_ResolveCredential(t *testing.T) {
+	current, err := user.Current()
+	assert.NoError(t, err)
+
+	executor := &CmdExecutor{RunAsUser: current.Username}
+	assert.NoError(t, executor.ResolveCredential())
+	// The user is only looked up once, a later change has no effect
+	executor.RunAsUser = "tagit-no-such-user"
+	assert.NoError(t, executor.ResolveCredential())
+
+	executor = &CmdExecutor{RunAsUser: "tagit-no-such-user"}
+	assert.ErrorContains(t, executor.ResolveCredential(), `invalid run-as user "tagit-no-such-user"`)
+	_, err = executor.Execute("true")
+	assert.ErrorContains(t, err, `invalid run-as user "tagit-no-such-user"`, "Expected Execute to fail with the lookup error")
+}
+
+func TestCmdExecutor_RunAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running a command as another user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user to run the command as")
+	}
+
+	executor := &CmdExecutor{RunAsUser: "nobody"}
+	output, err := executor.Execute("id -u")
+	assert.NoError(t, err)
+	assert.Equal(t, nobody.Uid, strings.TrimSpace(string(output)))
+
+	_, err = (&CmdExecutor{RunAsUser: "tagit-no-such-user"}).Execute("id -u")
+	assert.ErrorContains(t, err, "invalid run-as user")
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package tagit
+
+import "os/exec"
+
+// setProcessGroup does nothing, process groups are only supported on Unix.
+// The processes started by the command are left to CmdExecutor's WaitDelay.
+func setProcessGroup(cmd *exec.Cmd) {}
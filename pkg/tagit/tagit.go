@@ -1,38 +1,408 @@
 package tagit
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/google/shlex"
 	"github.com/hashicorp/consul/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// TagSeparator separates the prefix from the script output in managed tags.
+const TagSeparator = "-"
+
+// PrefixMetaKey is the service meta key that overrides the tag prefix of a service.
+const PrefixMetaKey = "tagit-prefix"
+
+// ManagedPrefixMetaKey is the service meta key where TagIt records the prefix
+// of the tags it registered when that is not TagPrefix or comes from
+// PrefixMetaKey. When PrefixMetaKey changes, the tags of the recorded prefix
+// are replaced, even after a restart.
+const ManagedPrefixMetaKey = "tagit-managed-prefix"
+
+// Service meta keys giving the script and interval of a service whose
+// configuration comes from its meta, see the run --config-from-meta flag.
+const (
+	ScriptMetaKey   = "tagit-script"
+	IntervalMetaKey = "tagit-interval"
+)
+
+// Service meta keys written by TagIt with AuditMeta. They are only written,
+// never read back, so they do not affect the tags.
+const (
+	// LastUpdatedMetaKey holds the RFC 3339 time of the last tag change.
+	LastUpdatedMetaKey = "tagit-last-updated"
+	// ManagedTagsMetaKey holds the managed tags after the last change,
+	// separated by commas.
+	ManagedTagsMetaKey = "tagit-managed-tags"
+)
+
+// maxMetaValueLength is the longest service meta value Consul accepts.
+const maxMetaValueLength = 512
+
+// ValidateTagPrefix checks that prefix can tell the managed tags apart from
+// the others. The separator is allowed, so prefixes such as my-app keep
+// working.
+func ValidateTagPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("tag prefix must not be empty")
+	}
+	if strings.IndexFunc(prefix, unicode.IsSpace) != -1 {
+		return fmt.Errorf("invalid tag prefix %q: must not contain whitespace", prefix)
+	}
+	return nil
+}
+
+// Policies for a script output without tags, see TagIt.EmptyOutput.
+const (
+	// EmptyOutputClear removes all managed tags from the service.
+	EmptyOutputClear = "clear"
+	// EmptyOutputKeep leaves the service tags as they are.
+	EmptyOutputKeep = "keep"
+	// EmptyOutputError fails the update cycle.
+	EmptyOutputError = "error"
+)
+
+// ValidateEmptyOutput checks that policy is one of the EmptyOutput policies.
+func ValidateEmptyOutput(policy string) error {
+	switch policy {
+	case EmptyOutputClear, EmptyOutputKeep, EmptyOutputError:
+		return nil
+	}
+	return fmt.Errorf("invalid empty output policy %q: must be %s, %s or %s", policy, EmptyOutputClear, EmptyOutputKeep, EmptyOutputError)
+}
+
+// Encodings of the script output, see TagIt.OutputEncoding.
+const (
+	// OutputEncodingUTF8 takes the output as is, which also covers ASCII.
+	OutputEncodingUTF8 = "utf-8"
+	// OutputEncodingLatin1 transcodes the output from ISO-8859-1 to UTF-8.
+	OutputEncodingLatin1 = "latin1"
+)
+
+// ValidateOutputEncoding checks that encoding is one of the OutputEncoding values.
+func ValidateOutputEncoding(encoding string) error {
+	switch encoding {
+	case OutputEncodingUTF8, OutputEncodingLatin1:
+		return nil
+	}
+	return fmt.Errorf("invalid output encoding %q: must be %s or %s", encoding, OutputEncodingUTF8, OutputEncodingLatin1)
+}
+
+// ParseTagTemplate parses a TagTemplates entry, such as region-{{ .Meta.region }},
+// rendered against an *api.AgentService. A missing map key fails the rendering.
+func ParseTagTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New(text).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag template %q: %w", text, err)
+	}
+	return tmpl, nil
+}
+
+// ErrPermissionDenied is wrapped by the errors of the Consul calls that the
+// ACL token is not allowed to make.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// ErrServiceNotFound is wrapped by the errors of the lookups of services that
+// are not registered with the agent.
+var ErrServiceNotFound = errors.New("service not found")
+
+// ErrEmptyOutput fails the cycles whose script output has no tags when
+// EmptyOutput is EmptyOutputError.
+var ErrEmptyOutput = errors.New("script output has no tags")
+
+// errKeepTags is returned when generating tags to leave the service tags untouched.
+var errKeepTags = errors.New("keeping the current tags")
+
 // TagIt is the main struct for the tagit flow.
 type TagIt struct {
-	ServiceID       string
-	Script          string
-	Interval        time.Duration
-	TagPrefix       string
+	ServiceID string
+	Script    string
+	Interval  time.Duration
+	TagPrefix string
+	// PreserveOrder keeps the order of the script output for the managed tags
+	// instead of sorting them alphabetically.
+	PreserveOrder bool
+	// CaseInsensitiveSort sorts the tags ignoring case, so Zone-a follows
+	// az-b. Ties are broken case-sensitively to keep the order stable.
+	CaseInsensitiveSort bool
+	// GroupManagedTags keeps the unmanaged tags first and the managed tags
+	// after them, each group sorted on its own, so the order of one group
+	// never moves the tags of the other.
+	GroupManagedTags bool
+	// ExcludeTags is a list of tags or glob patterns that are never added or
+	// removed by tagit, even if they carry the prefix.
+	ExcludeTags []string
+	// ProtectTags is a list of exact tags that are never removed by tagit,
+	// even if they carry the prefix. Unlike ExcludeTags they may still be added.
+	ProtectTags []string
+	// RemoveTags is a list of exact tags that are always removed from the
+	// service, with or without the prefix, even when the script outputs them.
+	// ProtectTags take precedence.
+	RemoveTags []string
+	// StripExistingPrefix keeps script tokens that already carry the prefix
+	// as they are instead of prefixing them again.
+	StripExistingPrefix bool
+	// LineMode uses each non-empty line of the script output as a tag instead
+	// of each word, so tags may contain spaces.
+	LineMode bool
+	// LowercaseTags lowercases every managed tag, prefix included: the ones
+	// from the script output as well as the static, port, hostname, address,
+	// probe, template and change marker tags. This suits discovery that
+	// lowercases tags such as DNS. The prefix is then matched regardless of
+	// case, so cleanup and updates still find the managed tags.
+	LowercaseTags bool
+	// OutputFilter, when set, keeps only the script output lines matching it.
+	OutputFilter *regexp.Regexp
+	// IgnoreLinePrefix, when set, drops the script output lines starting with
+	// it, such as comments or log banners.
+	IgnoreLinePrefix string
+	// TagTransform, when set, is applied to each script tag after it was
+	// prefixed. Returning an empty string drops the tag. Tags that no longer
+	// carry the prefix are not removed by later updates or cleanup.
+	TagTransform func(tag string) string
+	// OnlyIfHealthy skips updates while the service health is critical.
+	OnlyIfHealthy bool
+	// SkipInMaintenance skips updates while the service or its node is in
+	// maintenance mode, as enabled with consul maint -service or consul maint.
+	SkipInMaintenance bool
+	// ByName treats ServiceID as a service name and updates the tags of every
+	// instance of it registered on the agent. An update fails when there is no
+	// instance. Cleanup is not affected.
+	ByName bool
+	// AllowStale and UseCache let the agent answer the service lookups from
+	// a stale or cached view, reducing the load on the Consul servers at the
+	// cost of possibly acting on tags that are slightly out of date.
+	AllowStale bool
+	UseCache   bool
+	// ForceReregister deregisters and registers the service again when the
+	// agent rejects an update as invalid, with a 400 response. The service is
+	// briefly absent from the catalog. A service with health checks is never
+	// re-registered, as the checks would be lost with it.
+	ForceReregister bool
+	// StaticTags are added to the script output every cycle. They get the
+	// prefix like any other managed tag, so cleanup removes them as well.
+	StaticTags []string
+	// PortTag adds a port-<port> tag built from the port of the service every
+	// cycle. Like the static tags it gets the prefix and is removed by cleanup.
+	PortTag bool
+	// HostnameTag adds a host-<hostname> tag with the hostname of the machine
+	// every cycle, managed like the port tag. It is skipped when the hostname
+	// cannot be looked up.
+	HostnameTag bool
+	// AddressTag adds an addr-<address> tag with the address of the service
+	// every cycle, managed like the port tag. Dots and colons in the address
+	// become separators, so 10.0.0.1 is tagged addr-10-0-0-1. It is skipped
+	// when the service has no address.
+	AddressTag bool
+	// ProbeCommand, when set, is run every cycle to add ProbeUpTag when it
+	// exits with 0 and ProbeDownTag when it exits with another code, managed
+	// like the port tag. A probe that cannot be run fails the cycle. Its
+	// output is ignored.
+	ProbeCommand string
+	// ProbeUpTag and ProbeDownTag are the tags of the probe result,
+	// DefaultProbeUpTag and DefaultProbeDownTag when empty.
+	ProbeUpTag   string
+	ProbeDownTag string
+	// ProbeExecutor runs ProbeCommand, a CmdExecutor when nil.
+	ProbeExecutor CommandExecutor
+	// TagTemplates are rendered against the service every cycle, each adding
+	// the result as a tag managed like the port tag. An empty result adds no
+	// tag and a failed rendering fails the cycle.
+	TagTemplates []*template.Template
+	// ChangeMarker, when set, is added as a prefixed tag on the cycles whose
+	// script output differs from the previous cycle, and removed on the next
+	// cycle with unchanged output.
+	ChangeMarker string
+	// LogTagSeparator, when set, logs the updated tags as a single string
+	// joined by it instead of a list.
+	LogTagSeparator string
+	// Metrics, when set, records the number of tags added and removed.
+	Metrics MetricsRecorder
+	// Tracer, when set, records a span for each update cycle, with child
+	// spans for the script run and the service registration. Failed spans
+	// carry the error.
+	Tracer trace.Tracer
+	// ConsulTimeout bounds each call to the Consul agent when positive, so a
+	// hung agent fails the update cycle instead of blocking it.
+	ConsulTimeout time.Duration
+	// WaitForFile makes Run wait for the file to exist before the first update,
+	// for at most WaitForFileTimeout when it is positive. Run goes on with the
+	// updates once the timeout passed.
+	WaitForFile        string
+	WaitForFileTimeout time.Duration
+	// ScriptJitter delays each script run by a random duration below it, to
+	// spread the load of a fleet running the same script on a shared source.
+	ScriptJitter time.Duration
+	// ScriptBreakerThreshold, when positive, opens a circuit breaker after
+	// this many consecutive script failures: the script is skipped and the
+	// cycles fail with ErrScriptBreakerOpen for ScriptBreakerCooldown, then a
+	// single run decides whether the breaker closes again or stays open.
+	ScriptBreakerThreshold int
+	// ScriptBreakerCooldown is how long the breaker stays open,
+	// DefaultScriptBreakerCooldown when zero.
+	ScriptBreakerCooldown time.Duration
+	// FailFast makes Run return the error of the first update cycle instead
+	// of logging it. Errors of later cycles are always only logged.
+	FailFast bool
+	// HistorySize is how many results of the latest update cycles of Run are
+	// kept for History, DefaultHistorySize when zero.
+	HistorySize int
+	// KVPath, when set, is the Consul KV key the managed tags are written to
+	// as a JSON array every time the service tags change, on the first cycle
+	// and after a failed write. The key is not per service, so it must not be
+	// set with ByName or shared between TagIts.
+	KVPath string
+	// TagsOutputFile, when set, is the local file the managed tags are
+	// written to as a JSON array every time the service tags change, on the
+	// first cycle and after a failed write. The file is replaced atomically,
+	// so readers never see a partial write. Like KVPath it is not per
+	// service, so it must not be set with ByName or shared between TagIts.
+	TagsOutputFile string
+	// AuditMeta records each tag change in the service meta, under
+	// LastUpdatedMetaKey and ManagedTagsMetaKey, as part of the same
+	// registration.
+	AuditMeta bool
+	// LockKey, when set, is the Consul KV key locked through a session so only
+	// one TagIt updates the service at a time. The others wait for the lock
+	// and take over when the holder stops or loses it.
+	LockKey string
+	// Exclusive makes TagIt own the whole tag list: every tag that is neither
+	// generated, excluded nor protected is removed on update, including tags
+	// without the prefix set by other tools or by hand. Dangerous on services
+	// whose tags are also used by others.
+	Exclusive bool
+	// Replace rebuilds the managed tags from scratch on every update: all
+	// prefixed tags are dropped and the new set is added in the same
+	// registration, which is sent whenever the resulting tag list differs in
+	// any way from the registered one, including duplicates and order.
+	Replace bool
+	// Schedule, when set, drives the updates instead of Interval, for example
+	// a cron expression updating at the top of each minute.
+	Schedule Schedule
+	// OutputEncoding is the encoding of the script output: OutputEncodingUTF8
+	// (the default when empty) or OutputEncodingLatin1.
+	OutputEncoding string
+	// EmptyOutput is the policy applied when the script output yields no tags:
+	// EmptyOutputClear (the default when empty), EmptyOutputKeep or
+	// EmptyOutputError.
+	EmptyOutput string
+	// OnUpdate is called after the service tags were successfully changed in
+	// Consul, with the context of the update cycle, which is done when Run stops.
+	OnUpdate        func(ctx context.Context, added, removed []string)
 	client          ConsulClient
 	commandExecutor CommandExecutor
 	logger          *slog.Logger
+	newTicker       func(time.Duration) Ticker
+	// now returns the time recorded by AuditMeta and used by the script
+	// breaker, time.Now when nil.
+	now func() time.Time
+	// hostname looks up the hostname for HostnameTag, os.Hostname when nil.
+	hostname func() (string, error)
+	// waitPollInterval is how often Run checks for WaitForFile, defaultWaitPollInterval when zero.
+	waitPollInterval time.Duration
+	// lockRetryInterval is how long Run waits after failing to acquire the
+	// lock, defaultLockRetryInterval when zero.
+	lockRetryInterval time.Duration
+	// mu guards the fields that can be changed by Reload while Run is active.
+	mu       sync.RWMutex
+	reloaded chan struct{}
+	// triggered requests an update outside the normal interval.
+	triggered chan struct{}
+	// stateMu guards the state kept between update cycles.
+	stateMu       sync.Mutex
+	lastOutput    []byte
+	hasLastOutput bool
+	// kvWritten and tagsFileWritten tell whether KVPath and TagsOutputFile
+	// hold the managed tags of the latest cycle, so they are written again
+	// after a failure.
+	kvWritten       bool
+	tagsFileWritten bool
+	// scriptFailures counts the consecutive script failures for the breaker,
+	// which is open since breakerOpenedAt while in breakerOpen.
+	scriptFailures  int
+	breaker         breakerState
+	breakerOpenedAt time.Time
+	// historyMu guards history, a ring of the latest run results whose
+	// oldest entry is at historyNext once it is full.
+	historyMu   sync.Mutex
+	history     []RunResult
+	historyNext int
+}
+
+// Default tags of the probe result, see TagIt.ProbeCommand.
+const (
+	DefaultProbeUpTag   = "up"
+	DefaultProbeDownTag = "down"
+)
+
+// DefaultHistorySize is the number of run results kept when
+// TagIt.HistorySize is not set.
+const DefaultHistorySize = 20
+
+// RunResult is the outcome of an update cycle of Run.
+type RunResult struct {
+	Time    time.Time `json:"time"`
+	Changed bool      `json:"changed"`
+	// Error is the error of a failed cycle, empty when it succeeded.
+	Error string `json:"error,omitempty"`
 }
 
 // ConsulClient is an interface for the Consul client.
 type ConsulClient interface {
 	Agent() ConsulAgent
+	KV() ConsulKV
+	LockKey(key string) (ConsulLock, error)
 }
 
 // ConsulAgent is an interface for the Consul agent.
 type ConsulAgent interface {
 	Service(string, *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error)
 	ServiceRegister(*api.AgentServiceRegistration) error
+	// ServiceRegisterContext is ServiceRegisterOpts with the context of the
+	// call given apart, as ServiceRegisterOpts does not expose its own.
+	ServiceRegisterContext(context.Context, *api.AgentServiceRegistration, api.ServiceRegisterOpts) error
+	ServiceDeregisterOpts(string, *api.QueryOptions) error
+	ServicesWithFilterOpts(string, *api.QueryOptions) (map[string]*api.AgentService, error)
+	AgentHealthServiceByIDOpts(string, *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error)
+}
+
+// ConsulKV is an interface for the Consul KV store.
+type ConsulKV interface {
+	Put(*api.KVPair, *api.WriteOptions) (*api.WriteMeta, error)
+}
+
+// ConsulLock is an interface for a Consul lock held through a session, as
+// implemented by api.Lock.
+type ConsulLock interface {
+	// Lock blocks until the lock is acquired and returns a channel closed
+	// when it is lost, or a nil channel when stopCh was closed first.
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	Unlock() error
 }
 
 // ConsulAPIWrapper wraps the Consul API client to conform to the ConsulClient interface.
@@ -47,7 +417,118 @@ func NewConsulAPIWrapper(client *api.Client) *ConsulAPIWrapper {
 
 // Agent returns an object that conforms to the ConsulAgent interface.
 func (w *ConsulAPIWrapper) Agent() ConsulAgent {
-	return w.client.Agent()
+	return consulAgent{w.client.Agent()}
+}
+
+// consulAgent adds ServiceRegisterContext to the Consul API agent.
+type consulAgent struct {
+	*api.Agent
+}
+
+func (a consulAgent) ServiceRegisterContext(ctx context.Context, reg *api.AgentServiceRegistration, opts api.ServiceRegisterOpts) error {
+	return a.ServiceRegisterOpts(reg, opts.WithContext(ctx))
+}
+
+// KV returns an object that conforms to the ConsulKV interface.
+func (w *ConsulAPIWrapper) KV() ConsulKV {
+	return w.client.KV()
+}
+
+// LockKey returns a lock on the given KV key that conforms to the ConsulLock interface.
+func (w *ConsulAPIWrapper) LockKey(key string) (ConsulLock, error) {
+	lock, err := w.client.LockKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Ticker is an interface for the ticker driving the Run loop.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(time.Duration)
+	Stop()
+}
+
+// timeTicker wraps time.Ticker to conform to the Ticker interface.
+type timeTicker struct {
+	ticker *time.Ticker
+}
+
+func newTimeTicker(d time.Duration) Ticker {
+	return &timeTicker{ticker: time.NewTicker(d)}
+}
+
+func (t *timeTicker) C() <-chan time.Time   { return t.ticker.C }
+func (t *timeTicker) Reset(d time.Duration) { t.ticker.Reset(d) }
+func (t *timeTicker) Stop()                 { t.ticker.Stop() }
+
+// Schedule returns the time of the next update after a given time, such as a
+// parsed cron expression. A zero time means there is no next update.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// scheduleTicker ticks at the times of a Schedule. Like time.Ticker it drops
+// ticks when the previous one was not received yet.
+type scheduleTicker struct {
+	c        chan time.Time
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newScheduleTicker starts a scheduleTicker reading the time from now and
+// waiting with after.
+func newScheduleTicker(schedule Schedule, now func() time.Time, after func(time.Duration) <-chan time.Time) *scheduleTicker {
+	t := &scheduleTicker{
+		c:    make(chan time.Time, 1),
+		done: make(chan struct{}),
+	}
+	go t.run(schedule, now, after)
+	return t
+}
+
+func (t *scheduleTicker) run(schedule Schedule, now func() time.Time, after func(time.Duration) <-chan time.Time) {
+	var last time.Time
+	for {
+		// A timer firing a bit early must not yield the same time twice
+		current := now()
+		from := current
+		if from.Before(last) {
+			from = last
+		}
+		next := schedule.Next(from)
+		if next.IsZero() {
+			return
+		}
+		last = next
+		select {
+		case <-t.done:
+			return
+		case tick := <-after(next.Sub(current)):
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			select {
+			case t.c <- tick:
+			default:
+			}
+		}
+	}
+}
+
+func (t *scheduleTicker) C() <-chan time.Time { return t.c }
+
+// Reset does nothing, the ticks only depend on the schedule.
+func (t *scheduleTicker) Reset(time.Duration) {}
+
+func (t *scheduleTicker) Stop() { t.stopOnce.Do(func() { close(t.done) }) }
+
+// MetricsRecorder records the tag changes made by tagit.
+type MetricsRecorder interface {
+	RecordTagChanges(serviceID string, added, removed int)
 }
 
 // CommandExecutor is an interface for running commands.
@@ -55,9 +536,88 @@ type CommandExecutor interface {
 	Execute(command string) ([]byte, error)
 }
 
-type CmdExecutor struct{}
+// ContextCommandExecutor is a CommandExecutor that can also be interrupted.
+// TagIt runs the script through ExecuteContext when the executor implements
+// it, so a cancelled Run stops the script instead of waiting for it.
+type ContextCommandExecutor interface {
+	CommandExecutor
+	ExecuteContext(ctx context.Context, command string) ([]byte, error)
+}
+
+// DefaultMaxOutputBytes is the script output limit used when CmdExecutor.MaxOutputBytes is not set.
+const DefaultMaxOutputBytes = 1 << 20
+
+// ErrScriptNotFound is returned by CmdExecutor when the script does not exist.
+var ErrScriptNotFound = errors.New("script not found")
+
+// ErrScriptNotExecutable is returned by CheckScript when the script is not an
+// executable file.
+var ErrScriptNotExecutable = errors.New("script is not executable")
+
+// ErrScriptTimeout is returned by CmdExecutor when the script ran longer than
+// its Timeout and was killed.
+var ErrScriptTimeout = errors.New("script timed out")
+
+// ScriptExitError is returned by CmdExecutor when the script exits with a
+// non-zero code. It wraps the *exec.ExitError of the script.
+type ScriptExitError struct {
+	Code   int
+	Stderr []byte
+	Err    *exec.ExitError
+}
+
+func (e *ScriptExitError) Error() string {
+	return fmt.Sprintf("script exited with code %d", e.Code)
+}
+
+func (e *ScriptExitError) Unwrap() error {
+	return e.Err
+}
+
+// CmdExecutor runs commands on the local system.
+type CmdExecutor struct {
+	// MaxOutputBytes limits the size of the command output, defaults to DefaultMaxOutputBytes.
+	MaxOutputBytes int64
+	// Timeout kills the command once it ran this long, when positive. On Unix
+	// the processes it started, such as the commands of a shell script, are
+	// killed with it.
+	Timeout time.Duration
+	// RunAsUser and RunAsGroup run the command as this user and group, given
+	// by name or numeric ID, which usually requires running as root. Without
+	// RunAsGroup the primary group of RunAsUser is used. Only supported on Unix.
+	// They are looked up once, see ResolveCredential.
+	RunAsUser  string
+	RunAsGroup string
+	// Env holds variables added to the environment of the command, replacing
+	// inherited ones of the same name.
+	Env map[string]string
+
+	credentialOnce sync.Once
+	credential     *credential
+	credentialErr  error
+}
+
+// ResolveCredential looks up RunAsUser and RunAsGroup, failing when they do
+// not exist. The result is kept for every later command, so calling it at
+// startup catches a mistyped user before the first run. Execute calls it
+// when it was not called before.
+func (e *CmdExecutor) ResolveCredential() error {
+	e.credentialOnce.Do(func() {
+		e.credential, e.credentialErr = lookupCredential(e.RunAsUser, e.RunAsGroup)
+	})
+	return e.credentialErr
+}
 
+// Execute runs command and returns its output. Besides the errors of the
+// command setup, it fails with ErrScriptNotFound, ErrScriptTimeout or a
+// *ScriptExitError, which still comes with the output.
 func (e *CmdExecutor) Execute(command string) ([]byte, error) {
+	return e.ExecuteContext(context.Background(), command)
+}
+
+// ExecuteContext is Execute, killing the command, and on Unix the processes
+// it started, when ctx is done.
+func (e *CmdExecutor) ExecuteContext(parent context.Context, command string) ([]byte, error) {
 	if command == "" {
 		return nil, fmt.Errorf("failed to execute: empty command")
 	}
@@ -68,182 +628,1829 @@ func (e *CmdExecutor) Execute(command string) ([]byte, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("failed to execute: no command after splitting")
 	}
-	return exec.Command(args[0], args[1:]...).Output()
-}
 
-// New creates a new TagIt struct.
-func New(consulClient ConsulClient, commandExecutor CommandExecutor, serviceID string, script string, interval time.Duration, tagPrefix string, logger *slog.Logger) *TagIt {
-	return &TagIt{
-		ServiceID:       serviceID,
-		Script:          script,
-		Interval:        interval,
-		TagPrefix:       tagPrefix,
-		client:          consulClient,
-		commandExecutor: commandExecutor,
-		logger:          logger,
+	maxOutputBytes := e.MaxOutputBytes
+	if maxOutputBytes <= 0 {
+		maxOutputBytes = DefaultMaxOutputBytes
 	}
-}
 
-// Run will run the tagit flow and tag consul services based on the script output
-func (t *TagIt) Run(ctx context.Context) {
-	ticker := time.NewTicker(t.Interval)
-	defer ticker.Stop()
+	// Only one child of parent is created, so the deferred cancel releases it
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if e.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, e.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if err := e.ResolveCredential(); err != nil {
+		return nil, err
+	}
+	setCredential(cmd, e.credential)
+	setProcessGroup(cmd)
+	// Stop waiting for the output once the command is gone, even when a
+	// process it left behind still holds it open
+	cmd.WaitDelay = commandWaitDelay
+	if len(e.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, key := range slices.Sorted(maps.Keys(e.Env)) {
+			cmd.Env = append(cmd.Env, key+"="+e.Env[key])
+		}
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout := &limitedBuffer{limit: maxOutputBytes, overflow: cancel}
+	cmd.Stdout = stdout
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrScriptNotFound, err)
+		}
+		return nil, err
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			if err := t.updateServiceTags(); err != nil {
-				t.logger.Error("error updating service tags",
-					"service", t.ServiceID,
-					"error", err)
-			}
+	waitErr := cmd.Wait()
+	if stdout.overflowed {
+		return nil, fmt.Errorf("failed to execute: output exceeds %d bytes", maxOutputBytes)
+	}
+	if errors.Is(waitErr, exec.ErrWaitDelay) && cmd.ProcessState.Success() {
+		// The command itself succeeded, only a process it left behind did not
+		// close the output
+		waitErr = nil
+	}
+	if waitErr != nil {
+		if err := parent.Err(); err != nil {
+			return nil, fmt.Errorf("failed to execute: %w", err)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s", ErrScriptTimeout, e.Timeout)
 		}
+		var exitErr *exec.ExitError
+		if errors.As(waitErr, &exitErr) {
+			exitErr.Stderr = stderr.Bytes()
+			return stdout.Bytes(), &ScriptExitError{Code: exitErr.ExitCode(), Stderr: exitErr.Stderr, Err: exitErr}
+		}
+		return stdout.Bytes(), waitErr
+	}
+	return stdout.Bytes(), nil
+}
+
+// commandWaitDelay is how long CmdExecutor waits for the output of a command
+// to be closed after it exited or was killed.
+const commandWaitDelay = time.Second
+
+// limitedBuffer holds the first limit bytes written to it. Writing more
+// marks it as overflowed and calls overflow, which ends the command.
+type limitedBuffer struct {
+	buf        bytes.Buffer
+	limit      int64
+	overflow   func()
+	overflowed bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflowed {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.overflowed = true
+		b.overflow()
+		return len(p), nil
 	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the bytes written so far.
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
 }
 
-// CleanupTags removes all tags with the given prefix from the service.
-func (t *TagIt) CleanupTags() error {
-	service, err := t.getService()
+// CheckScript verifies that the program of command exists and is executable,
+// failing with ErrScriptNotFound or ErrScriptNotExecutable. Only programs given
+// as a path are checked; bare names such as sh or bash are looked up in PATH
+// when run, so shell-mode commands like sh -c '...' are skipped.
+func CheckScript(command string) error {
+	args, err := shlex.Split(command)
 	if err != nil {
-		return fmt.Errorf("error getting service: %w", err)
+		return fmt.Errorf("failed to split command: %w", err)
+	}
+	if len(args) == 0 || !strings.ContainsRune(args[0], filepath.Separator) {
+		return nil
 	}
 
-	// Filter out tags with the specified prefix
-	cleanedTags := make([]string, 0)
-	for _, tag := range service.Tags {
-		if !strings.HasPrefix(tag, t.TagPrefix+"-") {
-			cleanedTags = append(cleanedTags, tag)
+	info, err := os.Stat(args[0])
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %w", ErrScriptNotFound, err)
 		}
+		return fmt.Errorf("failed to check script: %w", err)
 	}
-
-	// Update the service with the cleaned tags
-	if err := t.updateConsulService(service, cleanedTags); err != nil {
-		return fmt.Errorf("error cleaning up tags: %w", err)
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("%w: %s", ErrScriptNotExecutable, args[0])
 	}
-
 	return nil
 }
 
-// runScript runs a command and returns the output.
-func (t *TagIt) runScript() ([]byte, error) {
-	t.logger.Info("running command",
-		"service", t.ServiceID,
-		"command", t.Script)
-	return t.commandExecutor.Execute(t.Script)
+// StdinExecutor reads the tags from standard input, such as a pipe, instead
+// of running a command. The input is read in full on the first Execute and
+// returned again by later calls, so it suits single update cycles.
+type StdinExecutor struct {
+	// Reader is read instead of os.Stdin when set.
+	Reader io.Reader
+	// MaxOutputBytes limits the size of the input, defaults to DefaultMaxOutputBytes.
+	MaxOutputBytes int64
+
+	once   sync.Once
+	output []byte
+	err    error
+}
+
+// Execute returns the whole input, ignoring command.
+func (e *StdinExecutor) Execute(command string) ([]byte, error) {
+	e.once.Do(func() {
+		reader := e.Reader
+		if reader == nil {
+			reader = os.Stdin
+		}
+		maxOutputBytes := e.MaxOutputBytes
+		if maxOutputBytes <= 0 {
+			maxOutputBytes = DefaultMaxOutputBytes
+		}
+		e.output, e.err = io.ReadAll(&io.LimitedReader{R: reader, N: maxOutputBytes + 1})
+		if e.err != nil {
+			e.err = fmt.Errorf("failed to read stdin: %w", e.err)
+		} else if int64(len(e.output)) > maxOutputBytes {
+			e.output, e.err = nil, fmt.Errorf("failed to read stdin: input exceeds %d bytes", maxOutputBytes)
+		}
+	})
+	return e.output, e.err
+}
+
+// HTTPExecutor fetches the tags from an HTTP endpoint, such as a local sidecar,
+// taking the command as the URL to GET.
+type HTTPExecutor struct {
+	// Client is used for the requests, defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds each request when positive.
+	Timeout time.Duration
+	// MaxOutputBytes limits the size of the response body, defaults to DefaultMaxOutputBytes.
+	MaxOutputBytes int64
 }
 
-// updateServiceTags updates the service tags.
-func (t *TagIt) updateServiceTags() error {
-	service, err := t.getService()
+func (e *HTTPExecutor) Execute(command string) ([]byte, error) {
+	return e.ExecuteContext(context.Background(), command)
+}
+
+// ExecuteContext is Execute, aborting the request when ctx is done.
+func (e *HTTPExecutor) ExecuteContext(ctx context.Context, command string) ([]byte, error) {
+	if command == "" {
+		return nil, fmt.Errorf("failed to fetch tags: empty url")
+	}
+
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, command, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tags: %w", err)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error getting service: %w", err)
+		return nil, fmt.Errorf("failed to fetch tags: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch tags from %s: unexpected status %s", command, resp.Status)
 	}
 
-	newTags, err := t.generateNewTags()
+	maxOutputBytes := e.MaxOutputBytes
+	if maxOutputBytes <= 0 {
+		maxOutputBytes = DefaultMaxOutputBytes
+	}
+	output, err := io.ReadAll(&io.LimitedReader{R: resp.Body, N: maxOutputBytes + 1})
 	if err != nil {
-		return fmt.Errorf("error generating new tags: %w", err)
+		return nil, fmt.Errorf("failed to fetch tags from %s: %w", command, err)
 	}
+	if int64(len(output)) > maxOutputBytes {
+		return nil, fmt.Errorf("failed to fetch tags from %s: response exceeds %d bytes", command, maxOutputBytes)
+	}
+	return output, nil
+}
 
-	if err := t.updateConsulService(service, newTags); err != nil {
-		return fmt.Errorf("error updating service in Consul: %w", err)
+// New creates a new TagIt struct. It fails when the Consul client is nil or
+// the service ID is empty. A nil logger discards all logs.
+func New(consulClient ConsulClient, commandExecutor CommandExecutor, serviceID string, script string, interval time.Duration, tagPrefix string, logger *slog.Logger) (*TagIt, error) {
+	if consulClient == nil {
+		return nil, fmt.Errorf("consul client must not be nil")
+	}
+	if serviceID == "" {
+		return nil, fmt.Errorf("service id must not be empty")
+	}
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
+	return &TagIt{
+		ServiceID:       serviceID,
+		Script:          script,
+		Interval:        interval,
+		TagPrefix:       tagPrefix,
+		client:          consulClient,
+		commandExecutor: commandExecutor,
+		logger:          logger,
+		newTicker:       newTimeTicker,
+		reloaded:        make(chan struct{}, 1),
+		triggered:       make(chan struct{}, 1),
+	}, nil
+}
 
-	return nil
+// Config holds the settings of Start.
+type Config struct {
+	// Client is the Consul client to use. When nil, it is created with NewClient,
+	// for example the NewClient method of a consul.ClientFactory.
+	Client    ConsulClient
+	NewClient func() (ConsulClient, error)
+	// Executor runs the script, a CmdExecutor when nil.
+	Executor  CommandExecutor
+	ServiceID string
+	Script    string
+	Interval  time.Duration
+	TagPrefix string
+	// Logger receives the logs of the run, which are discarded when nil.
+	Logger *slog.Logger
+	// FailFast stops Start with an error when the first update fails.
+	FailFast bool
 }
 
-// generateNewTags runs the script and generates new tags.
-func (t *TagIt) generateNewTags() ([]string, error) {
-	out, err := t.runScript()
+// Start validates cfg, creates the Consul client when needed and runs a TagIt
+// until ctx is done. It returns an error when the TagIt cannot be started or,
+// with FailFast, when its first update fails.
+func Start(ctx context.Context, cfg Config) error {
+	if cfg.Script == "" {
+		return fmt.Errorf("script must not be empty")
+	}
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("invalid interval %s: must be positive", cfg.Interval)
+	}
+	if err := ValidateTagPrefix(cfg.TagPrefix); err != nil {
+		return err
+	}
+
+	client := cfg.Client
+	if client == nil {
+		if cfg.NewClient == nil {
+			return fmt.Errorf("either a consul client or a way to create one is required")
+		}
+		var err error
+		client, err = cfg.NewClient()
+		if err != nil {
+			return fmt.Errorf("error creating consul client: %w", err)
+		}
+	}
+	executor := cfg.Executor
+	if executor == nil {
+		executor = &CmdExecutor{}
+	}
+
+	t, err := New(client, executor, cfg.ServiceID, cfg.Script, cfg.Interval, cfg.TagPrefix, cfg.Logger)
 	if err != nil {
-		return nil, fmt.Errorf("error running script: %w", err)
+		return err
 	}
-	return t.parseScriptOutput(out), nil
+	t.FailFast = cfg.FailFast
+	return t.Run(ctx)
 }
 
-// updateConsulService updates the service in Consul with the new tags.
-func (t *TagIt) updateConsulService(service *api.AgentService, newTags []string) error {
-	registration := t.copyServiceToRegistration(service)
-	updatedTags, shouldTag := t.needsTag(registration.Tags, newTags)
-	if shouldTag {
-		registration.Tags = updatedTags
-		if err := t.client.Agent().ServiceRegister(registration); err != nil {
-			return fmt.Errorf("error registering service: %w", err)
-		}
-		t.logger.Info("updated service tags",
-			"service", t.ServiceID,
-			"tags", updatedTags)
+// Reload replaces the script, tag prefix and interval of a running TagIt.
+// These are the only fields that are safe to change while Run is active;
+// the new values are used from the next update cycle on, an update in
+// progress keeps the ones it started with.
+func (t *TagIt) Reload(script string, tagPrefix string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %s: must be positive", interval)
+	}
+	if err := ValidateTagPrefix(tagPrefix); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.Script = script
+	t.TagPrefix = tagPrefix
+	t.Interval = interval
+	t.mu.Unlock()
+
+	select {
+	case t.reloaded <- struct{}{}:
+	default:
 	}
 	return nil
 }
 
-// parseScriptOutput parses the script output and generates tags.
-func (t *TagIt) parseScriptOutput(output []byte) []string {
-	var tags []string
-	for _, tag := range strings.Fields(string(output)) {
-		tags = append(tags, fmt.Sprintf("%s-%s", t.TagPrefix, tag))
+// TriggerUpdate makes a running TagIt update the service tags right away,
+// without waiting for the next interval, as run does on SIGUSR1. It is the
+// trigger channel of Run: it is safe to call from any goroutine, so library
+// users with their own channel forward it with
+//
+//	for range ch {
+//		t.TriggerUpdate()
+//	}
+//
+// Triggers made while an update is pending, or before Run starts, are merged
+// into a single update.
+func (t *TagIt) TriggerUpdate() {
+	select {
+	case t.triggered <- struct{}{}:
+	default:
 	}
-	return tags
 }
 
-// copyServiceToRegistration copies *api.AgentService to *api.AgentServiceRegistration
-func (t *TagIt) copyServiceToRegistration(service *api.AgentService) *api.AgentServiceRegistration {
-	registration := &api.AgentServiceRegistration{
-		ID:      service.ID,
-		Name:    service.Service,
-		Tags:    service.Tags,
-		Port:    service.Port,
-		Address: service.Address,
-		Kind:    service.Kind,
-		Meta:    service.Meta,
-		Weights: &api.AgentWeights{
-			Passing: service.Weights.Passing,
-			Warning: service.Weights.Warning,
-		},
+// Run will run the tagit flow and tag consul services based on the script output
+// until ctx is done. Besides every interval, it updates the service whenever
+// TriggerUpdate is called. With LockKey it only updates the service while
+// holding the lock. It only returns an error when FailFast is set and the
+// first update cycle failed, or when the lock cannot be created.
+func (t *TagIt) Run(ctx context.Context) error {
+	if t.WaitForFile != "" && !t.waitForFile(ctx) {
+		return nil
 	}
-	return registration
+	if t.LockKey != "" {
+		return t.runLocked(ctx)
+	}
+	return t.runLoop(ctx)
 }
 
-// getService returns the registered service.
-// getService returns the registered service.
-func (t *TagIt) getService() (*api.AgentService, error) {
-	agent := t.client.Agent()
-	service, _, err := agent.Service(t.ServiceID, nil)
+// defaultLockRetryInterval is how long Run waits after failing to acquire
+// the lock before trying again.
+const defaultLockRetryInterval = 10 * time.Second
+
+// runLocked runs the update loop while holding the LockKey lock and waits to
+// acquire it again whenever it is lost, until ctx is done.
+func (t *TagIt) runLocked(ctx context.Context) error {
+	lock, err := t.client.LockKey(t.LockKey)
 	if err != nil {
-		return nil, fmt.Errorf("error getting service %s: %w", t.ServiceID, err)
+		return fmt.Errorf("error creating lock %s: %w", t.LockKey, err)
 	}
-	if service == nil {
-		return nil, fmt.Errorf("service %s not found", t.ServiceID)
+	retryInterval := t.lockRetryInterval
+	if retryInterval <= 0 {
+		retryInterval = defaultLockRetryInterval
 	}
-	return service, nil
-}
 
-// needsTag checks if the service needs to be tagged. Based on the diff of the current and updated tags, filtering out tags that are already tagged.
-// but we never override the original tags from the consul service registration
-func (t *TagIt) needsTag(current []string, update []string) (updatedTags []string, shouldTag bool) {
-	diff := t.diffTags(current, update)
-	if len(diff) == 0 {
-		return nil, false
+	for {
+		t.logger.Info("waiting for lock", "service", t.ServiceID, "key", t.LockKey)
+		lost, err := lock.Lock(ctx.Done())
+		if err != nil {
+			t.logger.Error("error acquiring lock",
+				"service", t.ServiceID,
+				"key", t.LockKey,
+				"error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+		if lost == nil {
+			// Lock was stopped by the end of ctx
+			return nil
+		}
+
+		t.logger.Info("acquired lock, updating service tags", "service", t.ServiceID, "key", t.LockKey)
+		leaderCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-lost:
+				cancel()
+			case <-leaderCtx.Done():
+			}
+		}()
+		err = t.runLoop(leaderCtx)
+		cancel()
+		if unlockErr := lock.Unlock(); unlockErr != nil && !errors.Is(unlockErr, api.ErrLockNotHeld) {
+			t.logger.Warn("error releasing lock",
+				"service", t.ServiceID,
+				"key", t.LockKey,
+				"error", unlockErr)
+		}
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		t.logger.Warn("lost lock, stopped updating service tags", "service", t.ServiceID, "key", t.LockKey)
 	}
-	currentFiltered, _ := t.excludeTagged(current)
-	updatedTags = append(currentFiltered, update...)
-	slices.Sort(updatedTags)
-	updatedTags = slices.Compact(updatedTags)
-	return updatedTags, true
 }
 
-// excludeTagged filters out tags that are already tagged with the prefix.
-func (t *TagIt) excludeTagged(tags []string) (filteredTags []string, tagged bool) {
-	filteredTags = make([]string, 0) // Initialize with empty slice instead of nil
-	for _, tag := range tags {
-		if strings.HasPrefix(tag, t.TagPrefix+"-") {
-			tagged = true
-		} else {
-			filteredTags = append(filteredTags, tag)
+// runLoop updates the service tags on every tick, reload and trigger until
+// ctx is done.
+func (t *TagIt) runLoop(ctx context.Context) error {
+	t.mu.RLock()
+	interval := t.Interval
+	t.mu.RUnlock()
+
+	var ticker Ticker
+	if t.Schedule != nil {
+		ticker = newScheduleTicker(t.Schedule, time.Now, time.After)
+	} else {
+		newTicker := t.newTicker
+		if newTicker == nil {
+			newTicker = newTimeTicker
 		}
+		ticker = newTicker(interval)
 	}
-	return filteredTags, tagged
+	defer ticker.Stop()
+
+	first := true
+	update := func() error {
+		err := t.runUpdate(ctx, first)
+		first = false
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.reloaded:
+			t.mu.RLock()
+			interval = t.Interval
+			t.mu.RUnlock()
+			ticker.Reset(interval)
+		case <-t.triggered:
+			t.logger.Info("forced update of service tags", "service", t.ServiceID)
+			if err := update(); err != nil {
+				return err
+			}
+		case <-ticker.C():
+			if err := update(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// defaultWaitPollInterval is how often Run checks for WaitForFile.
+const defaultWaitPollInterval = time.Second
+
+// waitForFile blocks until WaitForFile exists or WaitForFileTimeout passed,
+// and reports whether Run should go on, which is not the case once ctx is done.
+func (t *TagIt) waitForFile(ctx context.Context) bool {
+	if _, err := os.Stat(t.WaitForFile); err == nil {
+		return true
+	}
+	t.logger.Info("waiting for file before the first update",
+		"service", t.ServiceID,
+		"file", t.WaitForFile,
+		"timeout", t.WaitForFileTimeout)
+
+	pollInterval := t.waitPollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultWaitPollInterval
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var timeout <-chan time.Time
+	if t.WaitForFileTimeout > 0 {
+		timer := time.NewTimer(t.WaitForFileTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timeout:
+			t.logger.Warn("file did not appear in time, starting the updates anyway",
+				"service", t.ServiceID,
+				"file", t.WaitForFile)
+			return true
+		case <-ticker.C:
+			_, err := os.Stat(t.WaitForFile)
+			if err == nil {
+				t.logger.Info("file found, starting the updates", "service", t.ServiceID, "file", t.WaitForFile)
+				return true
+			}
+			t.logger.Debug("still waiting for file", "service", t.ServiceID, "file", t.WaitForFile, "error", err)
+		}
+	}
+}
+
+// runUpdate runs a single update cycle of Run, logging any error. With
+// FailFast the error of the first cycle is returned instead.
+func (t *TagIt) runUpdate(ctx context.Context, first bool) error {
+	changed, err := t.updateServiceTagsContext(ctx, t.currentSettings())
+	if ctx.Err() != nil {
+		// An update cut short by the end of Run is not an error
+		return nil
+	}
+	t.recordRun(changed, err)
+	if err == nil {
+		return nil
+	}
+	if first && t.FailFast {
+		return fmt.Errorf("first update of service %s failed: %w", t.ServiceID, err)
+	}
+	t.logger.Error("error updating service tags",
+		"service", t.ServiceID,
+		"error", err)
+	return nil
+}
+
+// recordRun adds the result of an update cycle to the history, dropping the
+// oldest result once HistorySize results are kept.
+func (t *TagIt) recordRun(changed bool, err error) {
+	result := RunResult{Time: t.currentTime(), Changed: changed}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	size := t.HistorySize
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	if len(t.history) < size {
+		t.history = append(t.history, result)
+		return
+	}
+	t.history[t.historyNext] = result
+	t.historyNext = (t.historyNext + 1) % len(t.history)
+}
+
+// History returns the results of the latest update cycles of Run, oldest
+// first, at most HistorySize of them.
+func (t *TagIt) History() []RunResult {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	history := make([]RunResult, 0, len(t.history))
+	history = append(history, t.history[t.historyNext:]...)
+	return append(history, t.history[:t.historyNext]...)
+}
+
+// CleanupTags removes all tags with the given prefix from the service and
+// returns the removed tags.
+func (t *TagIt) CleanupTags() ([]string, error) {
+	return t.CleanupTagsContext(context.Background())
+}
+
+// CleanupTagsContext removes all tags with the given prefix from the service,
+// aborting the Consul calls when ctx is done. It returns the removed tags.
+func (t *TagIt) CleanupTagsContext(ctx context.Context) ([]string, error) {
+	s := t.currentSettings()
+	service, err := t.getService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting service: %w", err)
+	}
+
+	prefix, stalePrefix := t.resolvePrefix(service, s.tagPrefix)
+	cleanedTags, removedTags := t.cleanupServiceTags(prefix, stalePrefix, service.Tags)
+
+	// Update the service with the cleaned tags
+	if _, err := t.updateConsulService(ctx, s, service, prefix, stalePrefix, cleanedTags); err != nil {
+		return nil, fmt.Errorf("error cleaning up tags: %w", err)
+	}
+
+	return removedTags, nil
+}
+
+// CleanupTagsDryRun returns the tags CleanupTagsContext would remove from the
+// service, without updating it.
+func (t *TagIt) CleanupTagsDryRun(ctx context.Context) ([]string, error) {
+	s := t.currentSettings()
+	service, err := t.getService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting service: %w", err)
+	}
+
+	prefix, stalePrefix := t.resolvePrefix(service, s.tagPrefix)
+	_, removedTags := t.cleanupServiceTags(prefix, stalePrefix, service.Tags)
+	return removedTags, nil
+}
+
+// cleanupServiceTags splits the tags into the ones kept and the ones removed
+// by a cleanup of prefix and, when set, of stalePrefix.
+func (t *TagIt) cleanupServiceTags(prefix, stalePrefix string, tags []string) (keptTags []string, removedTags []string) {
+	keptTags, removedTags = t.cleanupTags(prefix, tags)
+	if stalePrefix != "" {
+		var staleTags []string
+		keptTags, staleTags = t.cleanupTags(stalePrefix, keptTags)
+		removedTags = append(removedTags, staleTags...)
+	}
+	return keptTags, removedTags
+}
+
+// CurrentTags returns the registered tags of the service split into the ones
+// managed by TagIt, which carry the prefix and are neither excluded nor
+// protected, and the unmanaged ones. It does not update the service.
+func (t *TagIt) CurrentTags(ctx context.Context) (managed []string, unmanaged []string, err error) {
+	s := t.currentSettings()
+	service, err := t.getService(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting service: %w", err)
+	}
+
+	prefix := t.servicePrefix(service, s.tagPrefix)
+	unmanaged, managed = t.cleanupTags(prefix, service.Tags)
+	return managed, unmanaged, nil
+}
+
+// Service returns the service as registered with the agent, the way the
+// update cycle sees it. It does not update the service.
+func (t *TagIt) Service(ctx context.Context) (*api.AgentService, error) {
+	service, err := t.getService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting service: %w", err)
+	}
+	return service, nil
+}
+
+// Check is the outcome of one of the checks run by Doctor. Err is nil when
+// the check passed.
+type Check struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// ErrCheckSkipped is the error of a Doctor check that did not run because a
+// check it depends on failed.
+var ErrCheckSkipped = errors.New("skipped")
+
+// Doctor checks the setup: that the script runs and generates tags, that the
+// Consul agent answers and that the service is registered, only reading from
+// Consul. With writeCheck it also checks that the token may register the
+// service, by registering it again as it is, which leaves its tags untouched
+// but is a write all the same. Checks depending on a failed one are skipped.
+func (t *TagIt) Doctor(ctx context.Context, writeCheck bool) []Check {
+	s := t.currentSettings()
+	script := Check{Name: "script"}
+	out, err := t.execute(ctx, s.script)
+	if err == nil {
+		var tags []string
+		tags, err = t.buildTags(s.tagPrefix, out, false)
+		if errors.Is(err, errKeepTags) {
+			err = nil
+		}
+		script.Detail = fmt.Sprintf("%d tags generated", len(tags))
+	}
+	if err != nil {
+		script.Err = fmt.Errorf("error running script: %w", err)
+	}
+
+	consul := Check{Name: "consul"}
+	var services map[string]*api.AgentService
+	consul.Err = t.consulCall(ctx, func(ctx context.Context) error {
+		var err error
+		services, err = t.client.Agent().ServicesWithFilterOpts("", (&api.QueryOptions{}).WithContext(ctx))
+		return err
+	})
+	if consul.Err != nil {
+		consul.Err = fmt.Errorf("error reaching the consul agent: %w", consul.Err)
+	} else {
+		consul.Detail = fmt.Sprintf("%d services visible", len(services))
+	}
+
+	service := Check{Name: "service", Err: ErrCheckSkipped}
+	write := Check{Name: "write permission", Err: ErrCheckSkipped}
+	if consul.Err == nil {
+		var registered *api.AgentService
+		registered, service.Err = t.getService(ctx)
+		if service.Err == nil {
+			service.Detail = fmt.Sprintf("%d tags registered", len(registered.Tags))
+		}
+		if service.Err == nil && writeCheck {
+			registration := t.copyServiceToRegistration(registered)
+			write.Err = t.consulCall(ctx, func(ctx context.Context) error {
+				return t.client.Agent().ServiceRegisterContext(ctx, registration, api.ServiceRegisterOpts{})
+			})
+			if write.Err != nil && isPermissionDenied(write.Err) {
+				write.Err = permissionError("service:write", registration.Name, write.Err)
+			} else if write.Err != nil {
+				write.Err = fmt.Errorf("error registering service: %w", write.Err)
+			}
+		}
+	}
+
+	if !writeCheck {
+		return []Check{script, consul, service}
+	}
+	return []Check{script, consul, service, write}
+}
+
+// cleanupTags splits the tags into the ones kept and the ones removed by a cleanup of prefix.
+func (t *TagIt) cleanupTags(prefix string, tags []string) (keptTags []string, removedTags []string) {
+	keptTags = make([]string, 0)
+	removedTags = make([]string, 0)
+	for _, tag := range tags {
+		if t.isRemoved(tag) || t.hasPrefix(prefix, tag) && !t.isExcluded(tag) && !t.isProtected(tag) {
+			removedTags = append(removedTags, tag)
+		} else {
+			keptTags = append(keptTags, tag)
+		}
+	}
+	return keptTags, removedTags
+}
+
+// runScript runs script and returns the output. With ScriptJitter it waits
+// for a random delay first, giving up when ctx is done.
+func (t *TagIt) runScript(ctx context.Context, script string) ([]byte, error) {
+	if err := t.allowScript(); err != nil {
+		return nil, err
+	}
+	if delay := t.scriptDelay(); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	t.logger.Info("running command",
+		"service", t.ServiceID,
+		"command", script)
+	out, err := t.execute(ctx, script)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// A cancelled cycle says nothing about the health of the script
+		return nil, ctxErr
+	}
+	t.recordScriptResult(err)
+	return out, err
+}
+
+// execute runs script with the command executor, through ExecuteContext
+// when it implements ContextCommandExecutor.
+func (t *TagIt) execute(ctx context.Context, script string) ([]byte, error) {
+	return executeContext(ctx, t.commandExecutor, script)
+}
+
+// executeContext runs command with executor, through ExecuteContext when it
+// implements ContextCommandExecutor.
+func executeContext(ctx context.Context, executor CommandExecutor, command string) ([]byte, error) {
+	if executor, ok := executor.(ContextCommandExecutor); ok {
+		return executor.ExecuteContext(ctx, command)
+	}
+	return executor.Execute(command)
+}
+
+// DefaultScriptBreakerCooldown is how long the script breaker stays open
+// when ScriptBreakerCooldown is not set.
+const DefaultScriptBreakerCooldown = 5 * time.Minute
+
+// ErrScriptBreakerOpen is returned instead of running the script while the
+// script breaker is open.
+var ErrScriptBreakerOpen = errors.New("script circuit breaker is open")
+
+// breakerState is the state of the script circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed runs the script as usual.
+	breakerClosed breakerState = iota
+	// breakerOpen skips the script until the cooldown is over.
+	breakerOpen
+	// breakerHalfOpen runs the script once to decide the next state.
+	breakerHalfOpen
+)
+
+// allowScript returns ErrScriptBreakerOpen while the script breaker is open,
+// and moves it to half-open once the cooldown is over.
+func (t *TagIt) allowScript() error {
+	if t.ScriptBreakerThreshold <= 0 {
+		return nil
+	}
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	if t.breaker != breakerOpen {
+		return nil
+	}
+	if retryAt := t.breakerOpenedAt.Add(t.scriptBreakerCooldown()); t.currentTime().Before(retryAt) {
+		return fmt.Errorf("%w, retrying at %s", ErrScriptBreakerOpen, retryAt.Format(time.RFC3339))
+	}
+	t.breaker = breakerHalfOpen
+	t.logger.Info("script circuit breaker half-open, retrying the script once", "service", t.ServiceID)
+	return nil
+}
+
+// recordScriptResult counts the script failures for the breaker, opening it
+// once they reach ScriptBreakerThreshold or when the half-open retry failed,
+// and closing it on success.
+func (t *TagIt) recordScriptResult(err error) {
+	if t.ScriptBreakerThreshold <= 0 {
+		return
+	}
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	if err == nil {
+		if t.breaker != breakerClosed {
+			t.logger.Info("script circuit breaker closed, the script succeeded again", "service", t.ServiceID)
+		}
+		t.breaker = breakerClosed
+		t.scriptFailures = 0
+		return
+	}
+
+	t.scriptFailures++
+	if t.breaker == breakerHalfOpen || t.scriptFailures >= t.ScriptBreakerThreshold {
+		t.breaker = breakerOpen
+		t.breakerOpenedAt = t.currentTime()
+		t.logger.Warn("script circuit breaker opened, skipping the script",
+			"service", t.ServiceID,
+			"failures", t.scriptFailures,
+			"cooldown", t.scriptBreakerCooldown())
+	}
+}
+
+// scriptBreakerCooldown returns ScriptBreakerCooldown, or
+// DefaultScriptBreakerCooldown when it is not set.
+func (t *TagIt) scriptBreakerCooldown() time.Duration {
+	if t.ScriptBreakerCooldown > 0 {
+		return t.ScriptBreakerCooldown
+	}
+	return DefaultScriptBreakerCooldown
+}
+
+// tracer returns Tracer, or a tracer recording nothing when it is nil.
+func (t *TagIt) tracer() trace.Tracer {
+	if t.Tracer == nil {
+		return noop.NewTracerProvider().Tracer("")
+	}
+	return t.Tracer
+}
+
+// endSpan records err on span, when not nil, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// currentTime returns the time from now, or time.Now when it is not set.
+func (t *TagIt) currentTime() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// scriptDelay returns a random delay in [0, ScriptJitter).
+func (t *TagIt) scriptDelay() time.Duration {
+	if t.ScriptJitter <= 0 {
+		return 0
+	}
+	return rand.N(t.ScriptJitter)
+}
+
+// RunOnce runs a single update cycle and reports whether the service tags changed.
+func (t *TagIt) RunOnce() (changed bool, err error) {
+	return t.RunOnceContext(context.Background())
+}
+
+// RunOnceContext is RunOnce, aborting the cycle when ctx is done.
+func (t *TagIt) RunOnceContext(ctx context.Context) (changed bool, err error) {
+	return t.updateServiceTagsContext(ctx, t.currentSettings())
+}
+
+// settings holds the fields Reload may change, read once for an update cycle
+// so the cycle runs without holding mu.
+type settings struct {
+	script    string
+	tagPrefix string
+}
+
+// currentSettings returns the fields Reload may change.
+func (t *TagIt) currentSettings() settings {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return settings{script: t.Script, tagPrefix: t.TagPrefix}
+}
+
+// updateServiceTags updates the service tags and reports whether they changed.
+// With ByName every instance of the service is updated with the same script
+// output, and the errors of the instances are joined.
+func (t *TagIt) updateServiceTags() (bool, error) {
+	return t.updateServiceTagsContext(context.Background(), t.currentSettings())
+}
+
+// updateServiceTagsContext is updateServiceTags with the settings s, aborting
+// the script, its delay and the Consul calls when ctx is done. A cycle
+// cancelled before the registration leaves the service as it was.
+func (t *TagIt) updateServiceTagsContext(ctx context.Context, s settings) (changed bool, err error) {
+	ctx, span := t.tracer().Start(ctx, "tagit.update", trace.WithAttributes(
+		attribute.String("tagit.service_id", t.ServiceID),
+		attribute.Bool("tagit.by_name", t.ByName)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("tagit.changed", changed))
+		endSpan(span, err)
+	}()
+	return t.updateTags(ctx, s)
+}
+
+// updateTags does the work of updateServiceTagsContext within its span.
+func (t *TagIt) updateTags(ctx context.Context, s settings) (bool, error) {
+	if !t.ByName {
+		return t.updateInstanceTags(ctx, s, t.ServiceID, nil)
+	}
+
+	serviceIDs, err := t.getServiceIDsByName(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting service instances: %w", err)
+	}
+
+	// The script runs once per cycle, for the first instance that needs it
+	var (
+		changed       bool
+		ran           bool
+		output        []byte
+		outputChanged bool
+		runErr        error
+		errs          []error
+	)
+	generate := func(prefix string) ([]string, error) {
+		if !ran {
+			output, outputChanged, runErr = t.runScriptOutput(ctx, s.script)
+			ran = true
+		}
+		if runErr != nil {
+			return nil, runErr
+		}
+		return t.buildTags(prefix, output, outputChanged)
+	}
+	for _, serviceID := range serviceIDs {
+		instanceChanged, err := t.updateInstanceTags(ctx, s, serviceID, generate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", serviceID, err))
+		}
+		changed = changed || instanceChanged
+	}
+	return changed, errors.Join(errs...)
+}
+
+// updateInstanceTags updates the tags of the service instance with the given
+// ID and reports whether they changed. The new tags come from generate, or
+// from generateNewTags when it is nil. When the prefix of the service meta
+// changed since the tags were registered, the tags of the previous prefix are
+// replaced in the same registration.
+func (t *TagIt) updateInstanceTags(ctx context.Context, s settings, serviceID string, generate func(prefix string) ([]string, error)) (bool, error) {
+	if generate == nil {
+		generate = func(prefix string) ([]string, error) {
+			return t.generateNewTags(ctx, s.script, prefix)
+		}
+	}
+
+	if t.OnlyIfHealthy || t.SkipInMaintenance {
+		status, checks, err := t.getServiceHealth(ctx, serviceID)
+		if err != nil {
+			return false, fmt.Errorf("error getting service health: %w", err)
+		}
+		if t.SkipInMaintenance && inMaintenance(serviceID, checks) {
+			t.logger.Info("skipping update of service in maintenance",
+				"service", serviceID)
+			return false, nil
+		}
+		if t.OnlyIfHealthy && status == api.HealthCritical {
+			t.logger.Warn("skipping update of unhealthy service",
+				"service", serviceID,
+				"health", status)
+			return false, nil
+		}
+	}
+
+	service, err := t.getServiceByID(ctx, serviceID)
+	if err != nil {
+		return false, fmt.Errorf("error getting service: %w", err)
+	}
+
+	prefix, stalePrefix := t.resolvePrefix(service, s.tagPrefix)
+	newTags, err := generate(prefix)
+	if errors.Is(err, errKeepTags) {
+		t.logger.Info("script output has no tags, keeping the current tags", "service", service.ID)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error generating new tags: %w", err)
+	}
+	if t.PortTag && service.Port > 0 {
+		newTags = append(newTags, prefixTag(prefix, fmt.Sprintf("port-%d", service.Port)))
+	}
+	if t.HostnameTag {
+		if tag, ok := t.hostnameTag(prefix, service.ID); ok {
+			newTags = append(newTags, tag)
+		}
+	}
+	if t.AddressTag && service.Address != "" {
+		newTags = append(newTags, prefixTag(prefix, "addr-"+sanitizeAddress(service.Address)))
+	}
+	if t.ProbeCommand != "" {
+		tag, err := t.probeTag(ctx, service.ID)
+		if err != nil {
+			return false, err
+		}
+		newTags = append(newTags, prefixTag(prefix, tag))
+	}
+	for _, tmpl := range t.TagTemplates {
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, service); err != nil {
+			return false, fmt.Errorf("error rendering tag template %q: %w", tmpl.Name(), err)
+		}
+		if tag := strings.TrimSpace(rendered.String()); tag != "" {
+			newTags = append(newTags, prefixTag(prefix, tag))
+		}
+	}
+
+	// Lowercased once all tags are known, whatever they come from
+	newTags = t.lowercase(newTags)
+
+	if stalePrefix != "" {
+		t.logger.Info("replacing tags of the previous prefix",
+			"service", service.ID,
+			"prefix", stalePrefix)
+	}
+	changed, err := t.updateConsulService(ctx, s, service, prefix, stalePrefix, newTags)
+	if err != nil {
+		return false, fmt.Errorf("error updating service in Consul: %w", err)
+	}
+
+	return changed, nil
+}
+
+// lowercase lowercases tags in place with LowercaseTags and returns them.
+func (t *TagIt) lowercase(tags []string) []string {
+	if t.LowercaseTags {
+		for i, tag := range tags {
+			tags[i] = strings.ToLower(tag)
+		}
+	}
+	return tags
+}
+
+// hostnameTag returns the host-<hostname> tag with prefix, logging and
+// reporting false when the hostname cannot be looked up.
+func (t *TagIt) hostnameTag(prefix, serviceID string) (string, bool) {
+	hostname := t.hostname
+	if hostname == nil {
+		hostname = os.Hostname
+	}
+	name, err := hostname()
+	if err == nil && name == "" {
+		err = fmt.Errorf("empty hostname")
+	}
+	if err != nil {
+		t.logger.Warn("skipping hostname tag, hostname lookup failed",
+			"service", serviceID,
+			"error", err)
+		return "", false
+	}
+	return prefixTag(prefix, "host-"+name), true
+}
+
+// probeTag runs ProbeCommand and returns ProbeUpTag when it exited with 0 and
+// ProbeDownTag when it exited with another code. Any other error, such as a
+// missing command, fails the cycle rather than marking the service down.
+func (t *TagIt) probeTag(ctx context.Context, serviceID string) (string, error) {
+	executor := t.ProbeExecutor
+	if executor == nil {
+		executor = &CmdExecutor{}
+	}
+	_, err := executeContext(ctx, executor, t.ProbeCommand)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", ctxErr
+	}
+	var exitErr *ScriptExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("error running probe command: %w", err)
+	}
+	if err != nil {
+		t.logger.Info("probe command failed, tagging service as down",
+			"service", serviceID,
+			"command", t.ProbeCommand,
+			"code", exitErr.Code)
+		if t.ProbeDownTag == "" {
+			return DefaultProbeDownTag, nil
+		}
+		return t.ProbeDownTag, nil
+	}
+	if t.ProbeUpTag == "" {
+		return DefaultProbeUpTag, nil
+	}
+	return t.ProbeUpTag, nil
+}
+
+// sanitizeAddress turns an IPv4 or IPv6 address into a tag value, dropping the
+// brackets around an IPv6 address and replacing dots, colons and the zone
+// separator with TagSeparator.
+func sanitizeAddress(address string) string {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return strings.NewReplacer(".", TagSeparator, ":", TagSeparator, "%", TagSeparator).Replace(strings.ToLower(address))
+}
+
+// servicePrefix returns the tag prefix of service, which is the value of its
+// PrefixMetaKey meta when that is a valid prefix and defaultPrefix otherwise.
+func (t *TagIt) servicePrefix(service *api.AgentService, defaultPrefix string) string {
+	metaPrefix := service.Meta[PrefixMetaKey]
+	if metaPrefix == "" {
+		return defaultPrefix
+	}
+	if err := ValidateTagPrefix(metaPrefix); err != nil {
+		t.logger.Warn("ignoring invalid tag prefix in service meta",
+			"service", service.ID,
+			"error", err)
+		return defaultPrefix
+	}
+	return metaPrefix
+}
+
+// resolvePrefix returns the tag prefix of service and, when the registered
+// tags were managed under another prefix, that prefix as recorded in
+// ManagedPrefixMetaKey, defaultPrefix when nothing is recorded.
+func (t *TagIt) resolvePrefix(service *api.AgentService, defaultPrefix string) (prefix, stalePrefix string) {
+	prefix = t.servicePrefix(service, defaultPrefix)
+	stalePrefix = service.Meta[ManagedPrefixMetaKey]
+	if stalePrefix == "" {
+		stalePrefix = defaultPrefix
+	}
+	if stalePrefix == prefix {
+		return prefix, ""
+	}
+	return prefix, stalePrefix
+}
+
+// generateNewTags runs script and generates new tags with prefix.
+func (t *TagIt) generateNewTags(ctx context.Context, script, prefix string) ([]string, error) {
+	out, changed, err := t.runScriptOutput(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+	return t.buildTags(prefix, out, changed)
+}
+
+// GenerateTags runs the script with executor and returns the tags an update
+// would set from its output, including the static tags, without talking to
+// Consul. Unlike the other methods it also works on a TagIt not created by New.
+func (t *TagIt) GenerateTags(executor CommandExecutor) ([]string, error) {
+	out, err := executor.Execute(t.Script)
+	if err != nil {
+		return nil, fmt.Errorf("error running script: %w", err)
+	}
+	tags, err := t.buildTags(t.TagPrefix, out, false)
+	if errors.Is(err, errKeepTags) {
+		return nil, nil
+	}
+	return t.lowercase(tags), err
+}
+
+// runScriptOutput runs script and, when ChangeMarker is set, reports
+// whether its output changed since the previous run.
+func (t *TagIt) runScriptOutput(ctx context.Context, script string) (out []byte, changed bool, err error) {
+	ctx, span := t.tracer().Start(ctx, "tagit.script", trace.WithAttributes(attribute.String("tagit.command", script)))
+	out, err = t.runScript(ctx, script)
+	endSpan(span, err)
+	if err != nil {
+		return nil, false, fmt.Errorf("error running script: %w", err)
+	}
+	return out, t.ChangeMarker != "" && t.outputChanged(out), nil
+}
+
+// buildTags generates the tags with prefix from the script output, adding
+// the static tags and, when changed, the change marker. An output without
+// tags is handled according to EmptyOutput.
+func (t *TagIt) buildTags(prefix string, out []byte, changed bool) ([]string, error) {
+	tags := t.parseScriptOutput(prefix, t.filterOutput(t.decodeOutput(out)))
+	if len(tags) == 0 {
+		switch t.EmptyOutput {
+		case EmptyOutputKeep:
+			return nil, errKeepTags
+		case EmptyOutputError:
+			return nil, ErrEmptyOutput
+		}
+	}
+	for _, tag := range t.StaticTags {
+		tags = append(tags, prefixTag(prefix, tag))
+	}
+	if changed {
+		tags = append(tags, prefixTag(prefix, t.ChangeMarker))
+	}
+	return tags, nil
+}
+
+// outputChanged records output as the latest script output and reports
+// whether it differs from the previous one. The first output is not a change.
+func (t *TagIt) outputChanged(output []byte) bool {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	changed := t.hasLastOutput && !bytes.Equal(t.lastOutput, output)
+	t.lastOutput = output
+	t.hasLastOutput = true
+	return changed
+}
+
+// updateConsulService updates the service in Consul with the new tags managed
+// under prefix, removing the ones of stalePrefix when set, and reports whether
+// it had to.
+func (t *TagIt) updateConsulService(ctx context.Context, s settings, service *api.AgentService, prefix, stalePrefix string, newTags []string) (bool, error) {
+	registration := t.copyServiceToRegistration(service)
+	updatedTags, shouldTag := t.needsTag(prefix, stalePrefix, registration.Tags, newTags)
+	if shouldTag {
+		registration.Tags = updatedTags
+		setManagedPrefix(registration, prefix, s.tagPrefix)
+		if t.AuditMeta {
+			t.setAuditMeta(registration, prefix)
+		}
+		// Give up before writing when the cycle was cancelled meanwhile
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		registerCtx, span := t.tracer().Start(ctx, "consul.service_register",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("tagit.service_id", service.ID)))
+		err := t.registerService(registerCtx, registration)
+		endSpan(span, err)
+		if err != nil {
+			return false, err
+		}
+		added, removed := changedTags(service.Tags, updatedTags)
+		t.logger.Info("updated service tags",
+			"service", service.ID,
+			"tags", t.formatTags(updatedTags),
+			"added", len(added),
+			"removed", len(removed))
+		if t.Metrics != nil {
+			t.Metrics.RecordTagChanges(service.ID, len(added), len(removed))
+		}
+		if t.OnUpdate != nil {
+			t.OnUpdate(ctx, added, removed)
+		}
+	}
+	// registration now holds the registered tags, changed or not
+	if err := t.syncKV(ctx, prefix, registration.Tags, shouldTag); err != nil {
+		if shouldTag {
+			return true, fmt.Errorf("service tags updated but writing them to kv %s failed: %w", t.KVPath, err)
+		}
+		return false, fmt.Errorf("error writing tags to kv %s: %w", t.KVPath, err)
+	}
+	if err := t.syncTagsFile(prefix, registration.Tags, shouldTag); err != nil {
+		if shouldTag {
+			return true, fmt.Errorf("service tags updated but writing them to %s failed: %w", t.TagsOutputFile, err)
+		}
+		return false, fmt.Errorf("error writing tags to %s: %w", t.TagsOutputFile, err)
+	}
+	return shouldTag, nil
+}
+
+// syncKV writes the managed tags under prefix of tags to KVPath when they
+// changed, on the first cycle and after a failed write, so the key catches up
+// with the service.
+func (t *TagIt) syncKV(ctx context.Context, prefix string, tags []string, changed bool) error {
+	if t.KVPath == "" {
+		return nil
+	}
+	t.stateMu.Lock()
+	written := t.kvWritten
+	t.stateMu.Unlock()
+	if written && !changed {
+		return nil
+	}
+
+	_, managed := t.cleanupTags(prefix, tags)
+	err := t.writeKV(ctx, managed)
+	t.stateMu.Lock()
+	t.kvWritten = err == nil
+	t.stateMu.Unlock()
+	return err
+}
+
+// setManagedPrefix records prefix under ManagedPrefixMetaKey in the meta of
+// registration when it is not defaultPrefix or the service sets
+// PrefixMetaKey, and removes the key otherwise, without touching the meta of
+// the service it was copied from.
+func setManagedPrefix(registration *api.AgentServiceRegistration, prefix, defaultPrefix string) {
+	record := prefix != defaultPrefix || registration.Meta[PrefixMetaKey] != ""
+	recorded, ok := registration.Meta[ManagedPrefixMetaKey]
+	if (record && recorded == prefix) || (!record && !ok) {
+		return
+	}
+	meta := maps.Clone(registration.Meta)
+	if meta == nil {
+		meta = make(map[string]string, 1)
+	}
+	if record {
+		meta[ManagedPrefixMetaKey] = prefix
+	} else {
+		delete(meta, ManagedPrefixMetaKey)
+	}
+	registration.Meta = meta
+}
+
+// setAuditMeta records the time of the change and the managed tags under
+// prefix in the meta of registration, without touching the meta of the
+// service it was copied from. Tags that do not fit in a meta value are left
+// out of it.
+func (t *TagIt) setAuditMeta(registration *api.AgentServiceRegistration, prefix string) {
+	_, managed := t.cleanupTags(prefix, registration.Tags)
+	meta := maps.Clone(registration.Meta)
+	if meta == nil {
+		meta = make(map[string]string, 2)
+	}
+	meta[LastUpdatedMetaKey] = t.currentTime().UTC().Format(time.RFC3339)
+	managedValue := strings.Join(managed, ",")
+	for len(managedValue) > maxMetaValueLength {
+		managed = managed[:len(managed)-1]
+		managedValue = strings.Join(managed, ",")
+	}
+	meta[ManagedTagsMetaKey] = managedValue
+	registration.Meta = meta
+}
+
+// syncTagsFile writes the managed tags under prefix of tags to TagsOutputFile
+// when they changed, on the first cycle and after a failed write, so the file
+// catches up with the service.
+func (t *TagIt) syncTagsFile(prefix string, tags []string, changed bool) error {
+	if t.TagsOutputFile == "" {
+		return nil
+	}
+	t.stateMu.Lock()
+	written := t.tagsFileWritten
+	t.stateMu.Unlock()
+	if written && !changed {
+		return nil
+	}
+
+	_, managed := t.cleanupTags(prefix, tags)
+	err := t.writeTagsFile(managed)
+	t.stateMu.Lock()
+	t.tagsFileWritten = err == nil
+	t.stateMu.Unlock()
+	return err
+}
+
+// writeKV writes tags as a JSON array to KVPath.
+func (t *TagIt) writeKV(ctx context.Context, tags []string) error {
+	value, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return t.consulCall(ctx, func(ctx context.Context) error {
+		_, err := t.client.KV().Put(&api.KVPair{Key: t.KVPath, Value: value}, (&api.WriteOptions{}).WithContext(ctx))
+		return err
+	})
+}
+
+// writeTagsFile writes tags as a JSON array to TagsOutputFile, through a
+// temporary file in the same directory synced to disk and renamed over it.
+func (t *TagIt) writeTagsFile(tags []string) error {
+	value, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(t.TagsOutputFile), "."+filepath.Base(t.TagsOutputFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(value, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	// CreateTemp only lets the owner read the file, unlike a file written in place
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	// Without a sync a crash after the rename can leave an empty file behind
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), t.TagsOutputFile)
+}
+
+// registerService registers the service with the agent. When ForceReregister
+// is set and the agent rejects the registration, the service is deregistered
+// and registered again.
+func (t *TagIt) registerService(ctx context.Context, registration *api.AgentServiceRegistration) error {
+	agent := t.client.Agent()
+	register := func(ctx context.Context) error {
+		return agent.ServiceRegisterContext(ctx, registration, api.ServiceRegisterOpts{})
+	}
+	err := t.consulCall(ctx, register)
+	if err == nil {
+		return nil
+	}
+	if isPermissionDenied(err) {
+		return permissionError("service:write", registration.Name, err)
+	}
+
+	var statusErr api.StatusError
+	if !t.ForceReregister || !errors.As(err, &statusErr) || statusErr.Code != http.StatusBadRequest {
+		return fmt.Errorf("error registering service: %w", err)
+	}
+	// The registration carries no checks, so re-registering would drop them
+	_, checks, healthErr := t.getServiceHealth(ctx, registration.ID)
+	if healthErr != nil {
+		return fmt.Errorf("error registering service: %w, not re-registering it: %w", err, healthErr)
+	}
+	if checks != nil && len(checks.Checks) > 0 {
+		return fmt.Errorf("error registering service: %w, not re-registering it as that would drop its %d health checks", err, len(checks.Checks))
+	}
+
+	t.logger.Warn("re-registering service after rejected update",
+		"service", registration.ID,
+		"error", err)
+	err = t.consulCall(ctx, func(ctx context.Context) error {
+		return agent.ServiceDeregisterOpts(registration.ID, (&api.QueryOptions{}).WithContext(ctx))
+	})
+	if err != nil {
+		return fmt.Errorf("error deregistering service: %w", err)
+	}
+	if err := t.consulCall(ctx, register); err != nil {
+		return fmt.Errorf("error re-registering service: %w", err)
+	}
+	return nil
+}
+
+// isPermissionDenied reports whether err is an ACL denial of the Consul agent.
+func isPermissionDenied(err error) bool {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusForbidden
+	}
+	return strings.Contains(err.Error(), "Permission denied")
+}
+
+// isNotFound reports whether err is the answer of the Consul agent to a
+// lookup of something it does not have.
+func isNotFound(err error) bool {
+	var statusErr api.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
+
+// permissionError wraps err with the ACL permission the token is missing on service.
+func permissionError(permission, service string, err error) error {
+	return fmt.Errorf("%w: the consul token needs %s on service %s: %w", ErrPermissionDenied, permission, service, err)
+}
+
+// formatTags returns the tags in the form used for logging.
+func (t *TagIt) formatTags(tags []string) any {
+	if t.LogTagSeparator == "" {
+		return tags
+	}
+	return strings.Join(tags, t.LogTagSeparator)
+}
+
+// changedTags returns the tags added to and removed from current to get to updated.
+func changedTags(current, updated []string) (added, removed []string) {
+	for _, tag := range updated {
+		if !slices.Contains(current, tag) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range current {
+		if !slices.Contains(updated, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	return added, removed
+}
+
+// filterOutput drops the lines of the script output starting with
+// IgnoreLinePrefix or not matching OutputFilter.
+func (t *TagIt) filterOutput(output []byte) []byte {
+	if t.OutputFilter == nil && t.IgnoreLinePrefix == "" {
+		return output
+	}
+	var filtered bytes.Buffer
+	for _, line := range strings.Split(string(output), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if t.IgnoreLinePrefix != "" && strings.HasPrefix(trimmed, t.IgnoreLinePrefix) {
+			continue
+		}
+		if t.OutputFilter != nil && !t.OutputFilter.MatchString(line) {
+			continue
+		}
+		filtered.WriteString(line)
+		filtered.WriteByte('\n')
+	}
+	return filtered.Bytes()
+}
+
+// decodeOutput converts the script output to UTF-8 according to
+// OutputEncoding and turns CRLF line endings into LF, so Windows-style
+// scripts do not leave a carriage return in line mode or filters.
+func (t *TagIt) decodeOutput(output []byte) []byte {
+	if t.OutputEncoding == OutputEncodingLatin1 {
+		// Each ISO-8859-1 byte is the code point of the same value
+		decoded := make([]rune, len(output))
+		for i, b := range output {
+			decoded[i] = rune(b)
+		}
+		output = []byte(string(decoded))
+	}
+	return bytes.ReplaceAll(output, []byte("\r\n"), []byte("\n"))
+}
+
+// parseScriptOutput parses the script output and generates tags with prefix.
+func (t *TagIt) parseScriptOutput(prefix string, output []byte) []string {
+	var tags []string
+	for _, tag := range t.splitScriptOutput(output) {
+		if !t.StripExistingPrefix || !t.hasPrefix(prefix, tag) {
+			tag = prefixTag(prefix, tag)
+		}
+		if t.TagTransform != nil {
+			tag = t.TagTransform(tag)
+			if tag == "" {
+				continue
+			}
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// splitScriptOutput splits the script output into words, or into trimmed
+// non-empty lines when LineMode is set.
+func (t *TagIt) splitScriptOutput(output []byte) []string {
+	if !t.LineMode {
+		return strings.Fields(string(output))
+	}
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// copyServiceToRegistration copies *api.AgentService to *api.AgentServiceRegistration
+func (t *TagIt) copyServiceToRegistration(service *api.AgentService) *api.AgentServiceRegistration {
+	registration := &api.AgentServiceRegistration{
+		ID:       service.ID,
+		Name:     service.Service,
+		Tags:     service.Tags,
+		Port:     service.Port,
+		Address:  service.Address,
+		Kind:     service.Kind,
+		Meta:     service.Meta,
+		Locality: service.Locality,
+	}
+	// Zero weights mean the service never set them, leave them to the agent defaults
+	if service.Weights != (api.AgentWeights{}) {
+		registration.Weights = &api.AgentWeights{
+			Passing: service.Weights.Passing,
+			Warning: service.Weights.Warning,
+		}
+	}
+	return registration
+}
+
+// getService returns the registered service.
+func (t *TagIt) getService(ctx context.Context) (*api.AgentService, error) {
+	return t.getServiceByID(ctx, t.ServiceID)
+}
+
+// getServiceByID returns the registered service with the given ID.
+func (t *TagIt) getServiceByID(ctx context.Context, serviceID string) (*api.AgentService, error) {
+	var service *api.AgentService
+	err := t.consulCall(ctx, func(ctx context.Context) error {
+		opts := (&api.QueryOptions{
+			AllowStale: t.AllowStale,
+			UseCache:   t.UseCache,
+		}).WithContext(ctx)
+		var err error
+		service, _, err = t.client.Agent().Service(serviceID, opts)
+		return err
+	})
+	if err != nil && isPermissionDenied(err) {
+		return nil, permissionError("service:read", serviceID, err)
+	}
+	if err != nil && isNotFound(err) {
+		return nil, fmt.Errorf("%w: %s: %w", ErrServiceNotFound, serviceID, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting service %s: %w", serviceID, err)
+	}
+	if service == nil {
+		return nil, fmt.Errorf("%w: %s", ErrServiceNotFound, serviceID)
+	}
+	return service, nil
+}
+
+// getServiceIDsByName returns the sorted IDs of the agent services named
+// ServiceID. It fails when there is no such service.
+func (t *TagIt) getServiceIDsByName(ctx context.Context) ([]string, error) {
+	var services map[string]*api.AgentService
+	err := t.consulCall(ctx, func(ctx context.Context) error {
+		var err error
+		services, err = t.client.Agent().ServicesWithFilterOpts("", (&api.QueryOptions{}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services: %w", err)
+	}
+	var serviceIDs []string
+	for id, service := range services {
+		if service.Service == t.ServiceID {
+			serviceIDs = append(serviceIDs, id)
+		}
+	}
+	if len(serviceIDs) == 0 {
+		return nil, fmt.Errorf("%w: no instances of service %s found", ErrServiceNotFound, t.ServiceID)
+	}
+	slices.Sort(serviceIDs)
+	return serviceIDs, nil
+}
+
+// getServiceHealth returns the aggregated health status of the service with
+// the given ID, along with its checks.
+func (t *TagIt) getServiceHealth(ctx context.Context, serviceID string) (string, *api.AgentServiceChecksInfo, error) {
+	var status string
+	var checks *api.AgentServiceChecksInfo
+	err := t.consulCall(ctx, func(ctx context.Context) error {
+		var err error
+		status, checks, err = t.client.Agent().AgentHealthServiceByIDOpts(serviceID, (&api.QueryOptions{}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting health of service %s: %w", serviceID, err)
+	}
+	return status, checks, nil
+}
+
+// IDs of the checks the agent registers while a service, or the whole node,
+// is in maintenance mode. The service check ID ends with the service ID.
+const (
+	serviceMaintenanceCheckPrefix = "_service_maintenance:"
+	nodeMaintenanceCheckID        = "_node_maintenance"
+)
+
+// inMaintenance reports whether checks hold the maintenance check of the
+// service with the given ID or of its node.
+func inMaintenance(serviceID string, checks *api.AgentServiceChecksInfo) bool {
+	if checks == nil {
+		return false
+	}
+	return slices.ContainsFunc(checks.Checks, func(check *api.HealthCheck) bool {
+		return check.CheckID == serviceMaintenanceCheckPrefix+serviceID || check.CheckID == nodeMaintenanceCheckID
+	})
+}
+
+// consulCall runs call with a context bounded by ConsulTimeout, when set, and
+// reports a timeout as such.
+func (t *TagIt) consulCall(ctx context.Context, call func(ctx context.Context) error) error {
+	if t.ConsulTimeout <= 0 {
+		return call(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, t.ConsulTimeout)
+	defer cancel()
+	err := call(callCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("consul call timed out after %s: %w", t.ConsulTimeout, err)
+	}
+	return err
+}
+
+// needsTag checks if the service needs to be tagged. Based on the diff of the current and updated tags, filtering out tags that are already tagged.
+// but we never override the original tags from the consul service registration.
+// With Replace or PreserveOrder the order and duplicates count as well, so
+// the service is tagged whenever the tag list differs in any way. The tags
+// of stalePrefix, when set, are dropped like the ones of prefix.
+func (t *TagIt) needsTag(prefix, stalePrefix string, current []string, update []string) (updatedTags []string, shouldTag bool) {
+	update = slices.DeleteFunc(slices.Clone(update), func(tag string) bool {
+		return t.isExcluded(tag) || t.isRemoved(tag)
+	})
+	currentFiltered, _ := t.excludeTagged(prefix, current)
+	if stalePrefix != "" {
+		currentFiltered, _ = t.excludeTagged(stalePrefix, currentFiltered)
+	}
+	switch {
+	case t.PreserveOrder:
+		updatedTags = orderedTags(currentFiltered, update)
+	case t.GroupManagedTags:
+		updatedTags = t.groupTags(currentFiltered, update)
+	default:
+		updatedTags = t.sortTags(append(currentFiltered, update...))
+	}
+	if t.Replace || t.PreserveOrder {
+		if slices.Equal(current, updatedTags) {
+			return nil, false
+		}
+		return updatedTags, true
+	}
+	if len(t.diffTags(current, updatedTags)) == 0 {
+		return nil, false
+	}
+	return updatedTags, true
+}
+
+// sortTags sorts tags in place, honoring CaseInsensitiveSort, and returns
+// them without duplicates.
+func (t *TagIt) sortTags(tags []string) []string {
+	if t.CaseInsensitiveSort {
+		slices.SortFunc(tags, compareFold)
+	} else {
+		slices.Sort(tags)
+	}
+	return slices.Compact(tags)
+}
+
+// groupTags returns the unmanaged tags followed by the managed ones missing
+// from them, each group sorted on its own. The result only depends on the
+// two sets of tags, not on their order.
+func (t *TagIt) groupTags(unmanaged, managed []string) []string {
+	unmanaged = t.sortTags(slices.Clone(unmanaged))
+	managed = slices.DeleteFunc(t.sortTags(slices.Clone(managed)), func(tag string) bool {
+		return slices.Contains(unmanaged, tag)
+	})
+	return append(unmanaged, managed...)
+}
+
+// compareFold compares a and b ignoring case, falling back to a case-sensitive
+// comparison when they only differ in case.
+func compareFold(a, b string) int {
+	if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// orderedTags returns the unmanaged tags followed by the managed ones in the
+// given order, dropping duplicates.
+func orderedTags(unmanaged, managed []string) []string {
+	tags := make([]string, 0, len(unmanaged)+len(managed))
+	seen := make(map[string]bool)
+	for _, tag := range append(slices.Clone(unmanaged), managed...) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// excludeTagged filters out the RemoveTags and the tags that are already tagged with the prefix, or all tags with Exclusive, keeping the excluded and protected ones.
+func (t *TagIt) excludeTagged(prefix string, tags []string) (filteredTags []string, tagged bool) {
+	filteredTags = make([]string, 0) // Initialize with empty slice instead of nil
+	for _, tag := range tags {
+		if t.isRemoved(tag) || (t.Exclusive || t.hasPrefix(prefix, tag)) && !t.isExcluded(tag) && !t.isProtected(tag) {
+			tagged = true
+		} else {
+			filteredTags = append(filteredTags, tag)
+		}
+	}
+	return filteredTags, tagged
+}
+
+// prefixTag returns the tag with the prefix added.
+func prefixTag(prefix, tag string) string {
+	return prefix + TagSeparator + tag
+}
+
+// hasPrefix reports whether the tag carries the prefix.
+func hasPrefix(prefix, tag string) bool {
+	return strings.HasPrefix(tag, prefix+TagSeparator)
+}
+
+// hasPrefix reports whether the tag carries the prefix, in any case with
+// LowercaseTags.
+func (t *TagIt) hasPrefix(prefix, tag string) bool {
+	if t.LowercaseTags {
+		return hasPrefix(strings.ToLower(prefix), strings.ToLower(tag))
+	}
+	return hasPrefix(prefix, tag)
+}
+
+// isExcluded reports whether the tag matches any of the ExcludeTags patterns.
+func (t *TagIt) isExcluded(tag string) bool {
+	for _, pattern := range t.ExcludeTags {
+		if matched, err := path.Match(pattern, tag); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtected reports whether the tag is one of the ProtectTags.
+func (t *TagIt) isProtected(tag string) bool {
+	return slices.Contains(t.ProtectTags, tag)
+}
+
+// isRemoved reports whether the tag is one of the RemoveTags and not protected.
+func (t *TagIt) isRemoved(tag string) bool {
+	return slices.Contains(t.RemoveTags, tag) && !t.isProtected(tag)
 }
 
 // diffTags compares two slices of strings and returns the difference.
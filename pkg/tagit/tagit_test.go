@@ -1,32 +1,122 @@
 package tagit
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/ncode/tagit/pkg/cron"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // MockConsulClient implements the ConsulClient interface for testing.
 type MockConsulClient struct {
-	MockAgent *MockAgent
+	MockAgent   *MockAgent
+	MockKV      *MockKV
+	LockKeyFunc func(key string) (ConsulLock, error)
 }
 
 func (m *MockConsulClient) Agent() ConsulAgent {
 	return m.MockAgent
 }
 
+func (m *MockConsulClient) KV() ConsulKV {
+	return m.MockKV
+}
+
+func (m *MockConsulClient) LockKey(key string) (ConsulLock, error) {
+	return m.LockKeyFunc(key)
+}
+
+// MockLock simulates a Consul lock on a key shared through sem, so only one
+// of the MockLocks using the same sem is held at a time.
+type MockLock struct {
+	sem  chan struct{}
+	mu   sync.Mutex
+	lost chan struct{}
+}
+
+func NewMockLock(sem chan struct{}) *MockLock {
+	return &MockLock{sem: sem}
+}
+
+func (m *MockLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	select {
+	case m.sem <- struct{}{}:
+	case <-stopCh:
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lost = make(chan struct{})
+	return m.lost, nil
+}
+
+func (m *MockLock) Unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lost == nil {
+		return api.ErrLockNotHeld
+	}
+	m.lost = nil
+	<-m.sem
+	return nil
+}
+
+// Held reports whether the lock is currently held.
+func (m *MockLock) Held() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost != nil
+}
+
+// Lose simulates losing the held lock, for example to an invalidated session.
+func (m *MockLock) Lose() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	close(m.lost)
+}
+
+// MockKV simulates the KV part of the Consul client.
+type MockKV struct {
+	PutFunc func(p *api.KVPair) error
+}
+
+func (m *MockKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	return nil, m.PutFunc(p)
+}
+
 // MockAgent simulates the Agent part of the Consul client.
 type MockAgent struct {
-	ServiceFunc         func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error)
-	ServiceRegisterFunc func(reg *api.AgentServiceRegistration) error
+	ServiceFunc           func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error)
+	ServiceRegisterFunc   func(reg *api.AgentServiceRegistration) error
+	ServiceDeregisterFunc func(serviceID string) error
+	ServicesFunc          func() (map[string]*api.AgentService, error)
+	HealthFunc            func(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error)
 }
 
 func (m *MockAgent) Service(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
@@ -37,6 +127,43 @@ func (m *MockAgent) ServiceRegister(reg *api.AgentServiceRegistration) error {
 	return m.ServiceRegisterFunc(reg)
 }
 
+func (m *MockAgent) ServiceRegisterContext(ctx context.Context, reg *api.AgentServiceRegistration, opts api.ServiceRegisterOpts) error {
+	return m.ServiceRegisterFunc(reg)
+}
+
+func (m *MockAgent) ServiceDeregisterOpts(serviceID string, q *api.QueryOptions) error {
+	return m.ServiceDeregisterFunc(serviceID)
+}
+
+func (m *MockAgent) ServicesWithFilterOpts(filter string, q *api.QueryOptions) (map[string]*api.AgentService, error) {
+	return m.ServicesFunc()
+}
+
+func (m *MockAgent) AgentHealthServiceByIDOpts(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+	return m.HealthFunc(serviceID, q)
+}
+
+// MockTicker implements the Ticker interface, ticking only when told to.
+type MockTicker struct {
+	ch      chan time.Time
+	stopped atomic.Bool
+}
+
+func NewMockTicker() *MockTicker {
+	return &MockTicker{ch: make(chan time.Time)}
+}
+
+func (m *MockTicker) C() <-chan time.Time   { return m.ch }
+func (m *MockTicker) Reset(d time.Duration) {}
+func (m *MockTicker) Stop()                 { m.stopped.Store(true) }
+
+// Tick delivers n ticks, each one only after the previous was picked up by Run.
+func (m *MockTicker) Tick(n int) {
+	for i := 0; i < n; i++ {
+		m.ch <- time.Now()
+	}
+}
+
 type MockCommandExecutor struct {
 	MockOutput []byte
 	MockError  error
@@ -46,6 +173,45 @@ func (m *MockCommandExecutor) Execute(command string) ([]byte, error) {
 	return m.MockOutput, m.MockError
 }
 
+// DynamicMockExecutor returns its outputs in turn, starting over after the last one.
+type DynamicMockExecutor struct {
+	Outputs []string
+	calls   int
+}
+
+func (m *DynamicMockExecutor) Execute(command string) ([]byte, error) {
+	output := m.Outputs[m.calls%len(m.Outputs)]
+	m.calls++
+	return []byte(output), nil
+}
+
+func TestValidateTagPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		wantErr string
+	}{
+		{name: "Valid Prefix", prefix: "tagged"},
+		{name: "Valid Prefix With Underscore", prefix: "tag_it"},
+		{name: "Empty Prefix", prefix: "", wantErr: "must not be empty"},
+		{name: "Prefix With Space", prefix: "tag it", wantErr: "must not contain whitespace"},
+		{name: "Prefix With Tab", prefix: "tag\t", wantErr: "must not contain whitespace"},
+		{name: "Prefix With Separator", prefix: "my-app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTagPrefix(tt.prefix)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestDiffTags(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -144,7 +310,7 @@ func TestExcludeTagged(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tagit := TagIt{TagPrefix: tt.tagPrefix}
-			filteredTags, tagged := tagit.excludeTagged(tt.tags)
+			filteredTags, tagged := tagit.excludeTagged(tagit.TagPrefix, tt.tags)
 			assert.Equal(t, tt.expected, filteredTags, "excludeTagged() returned unexpected filtered tags")
 			assert.Equal(t, tt.shouldTag, tagged, "excludeTagged() returned unexpected shouldTag value")
 		})
@@ -187,6 +353,13 @@ func TestNeedsTag(t *testing.T) {
 			expectedTags:   []string{"tag2", "tag3"},
 			expectedShould: true,
 		},
+		{
+			name:           "Unmanaged Tags Unchanged",
+			current:        []string{"other", "tag-tag1", "tag-tag2"},
+			update:         []string{"tag-tag2", "tag-tag1"},
+			expectedTags:   nil,
+			expectedShould: false,
+		},
 		{
 			name:           "Mixed Changes",
 			current:        []string{"tag-tag1", "tag2", "tag4"},
@@ -199,13 +372,366 @@ func TestNeedsTag(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tagit := TagIt{TagPrefix: "tag"}
-			filteredTags, shouldTag := tagit.needsTag(tt.current, tt.update)
+			filteredTags, shouldTag := tagit.needsTag(tagit.TagPrefix, "", tt.current, tt.update)
 			assert.Equal(t, tt.expectedTags, filteredTags, "needsTag() returned unexpected filtered tags")
 			assert.Equal(t, tt.expectedShould, shouldTag, "needsTag() returned unexpected shouldTag value")
 		})
 	}
 }
 
+func TestNeedsTagPreserveOrder(t *testing.T) {
+	tests := []struct {
+		name           string
+		current        []string
+		update         []string
+		expectedSorted []string
+		expectedTags   []string
+		expectedShould bool
+	}{
+		{
+			name:           "Script Order Kept",
+			current:        []string{"web", "alpha"},
+			update:         []string{"tag-zeta", "tag-beta", "tag-alpha"},
+			expectedSorted: []string{"alpha", "tag-alpha", "tag-beta", "tag-zeta", "web"},
+			expectedTags:   []string{"web", "alpha", "tag-zeta", "tag-beta", "tag-alpha"},
+			expectedShould: true,
+		},
+		{
+			name:           "Duplicates Removed",
+			current:        []string{"web"},
+			update:         []string{"tag-zeta", "tag-beta", "tag-zeta"},
+			expectedSorted: []string{"tag-beta", "tag-zeta", "web"},
+			expectedTags:   []string{"web", "tag-zeta", "tag-beta"},
+			expectedShould: true,
+		},
+		{
+			name:           "Reordered Script Output",
+			current:        []string{"web", "tag-beta", "tag-zeta"},
+			update:         []string{"tag-zeta", "tag-beta"},
+			expectedTags:   []string{"web", "tag-zeta", "tag-beta"},
+			expectedSorted: nil,
+			expectedShould: true,
+		},
+		{
+			name:           "No Update Needed",
+			current:        []string{"web", "tag-zeta", "tag-beta"},
+			update:         []string{"tag-zeta", "tag-beta"},
+			expectedSorted: nil,
+			expectedTags:   nil,
+			expectedShould: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted := TagIt{TagPrefix: "tag"}
+			sortedTags, _ := sorted.needsTag(sorted.TagPrefix, "", tt.current, tt.update)
+			assert.Equal(t, tt.expectedSorted, sortedTags, "needsTag() returned unexpected sorted tags")
+
+			preserved := TagIt{TagPrefix: "tag", PreserveOrder: true}
+			preservedTags, shouldTag := preserved.needsTag(preserved.TagPrefix, "", tt.current, tt.update)
+			assert.Equal(t, tt.expectedTags, preservedTags, "needsTag() returned unexpected preserved tags")
+			assert.Equal(t, tt.expectedShould, shouldTag, "needsTag() returned unexpected shouldTag value")
+		})
+	}
+}
+
+func TestNeedsTagCaseInsensitiveSort(t *testing.T) {
+	tests := []struct {
+		name                string
+		current             []string
+		update              []string
+		expectedSorted      []string
+		expectedInsensitive []string
+	}{
+		{
+			name:                "Mixed Case",
+			current:             []string{"Zone-a", "web"},
+			update:              []string{"tag-b", "tag-A"},
+			expectedSorted:      []string{"Zone-a", "tag-A", "tag-b", "web"},
+			expectedInsensitive: []string{"tag-A", "tag-b", "web", "Zone-a"},
+		},
+		{
+			name:                "Differ Only In Case",
+			current:             []string{"web", "Web"},
+			update:              []string{"tag-x", "tag-X"},
+			expectedSorted:      []string{"Web", "tag-X", "tag-x", "web"},
+			expectedInsensitive: []string{"tag-X", "tag-x", "Web", "web"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted := TagIt{TagPrefix: "tag"}
+			sortedTags, _ := sorted.needsTag(sorted.TagPrefix, "", tt.current, tt.update)
+			assert.Equal(t, tt.expectedSorted, sortedTags, "needsTag() returned unexpected sorted tags")
+
+			insensitive := TagIt{TagPrefix: "tag", CaseInsensitiveSort: true}
+			insensitiveTags, shouldTag := insensitive.needsTag(insensitive.TagPrefix, "", tt.current, tt.update)
+			assert.Equal(t, tt.expectedInsensitive, insensitiveTags, "needsTag() returned unexpected case-insensitive tags")
+			assert.True(t, shouldTag)
+		})
+	}
+}
+
+func TestNeedsTagGroupManagedTags(t *testing.T) {
+	tests := []struct {
+		name            string
+		tagIt           *TagIt
+		current         []string
+		update          []string
+		expected        []string
+		expectShouldTag bool
+	}{
+		{
+			name:            "Groups Sorted Separately",
+			tagIt:           &TagIt{TagPrefix: "tag"},
+			current:         []string{"web", "tag-old", "alpha", "zulu"},
+			update:          []string{"tag-b", "tag-a"},
+			expected:        []string{"alpha", "web", "zulu", "tag-a", "tag-b"},
+			expectShouldTag: true,
+		},
+		{
+			name:            "Case Insensitive",
+			tagIt:           &TagIt{TagPrefix: "tag", CaseInsensitiveSort: true},
+			current:         []string{"Web", "alpha"},
+			update:          []string{"tag-B", "tag-a"},
+			expected:        []string{"alpha", "Web", "tag-a", "tag-B"},
+			expectShouldTag: true,
+		},
+		{
+			name:            "Protected Managed Tag Kept Once",
+			tagIt:           &TagIt{TagPrefix: "tag", ProtectTags: []string{"tag-keep"}},
+			current:         []string{"web", "tag-keep"},
+			update:          []string{"tag-keep", "tag-a"},
+			expected:        []string{"tag-keep", "web", "tag-a"},
+			expectShouldTag: true,
+		},
+		{
+			name:     "Already Up To Date",
+			tagIt:    &TagIt{TagPrefix: "tag"},
+			current:  []string{"alpha", "web", "tag-a", "tag-b"},
+			update:   []string{"tag-b", "tag-a"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tagIt.GroupManagedTags = true
+			updatedTags, shouldTag := tt.tagIt.needsTag(tt.tagIt.TagPrefix, "", tt.current, tt.update)
+			assert.Equal(t, tt.expected, updatedTags)
+			assert.Equal(t, tt.expectShouldTag, shouldTag)
+
+			// Any order of the same inputs must give the very same slice
+			r := rand.New(rand.NewPCG(1, 2))
+			for range 20 {
+				current := slices.Clone(tt.current)
+				update := slices.Clone(tt.update)
+				r.Shuffle(len(current), func(i, j int) { current[i], current[j] = current[j], current[i] })
+				r.Shuffle(len(update), func(i, j int) { update[i], update[j] = update[j], update[i] })
+				shuffledTags, _ := tt.tagIt.needsTag(tt.tagIt.TagPrefix, "", current, update)
+				assert.Equal(t, strings.Join(updatedTags, "\x00"), strings.Join(shuffledTags, "\x00"))
+			}
+		})
+	}
+}
+
+func TestParseScriptOutput(t *testing.T) {
+	tests := []struct {
+		name                string
+		output              string
+		stripExistingPrefix bool
+		tagTransform        func(string) string
+		expected            []string
+	}{
+		{
+			name:     "Plain Tokens",
+			output:   "db primary",
+			expected: []string{"tag-db", "tag-primary"},
+		},
+		{
+			name:     "Prefixed Tokens Without Strip",
+			output:   "tag-db primary",
+			expected: []string{"tag-tag-db", "tag-primary"},
+		},
+		{
+			name:                "Prefixed Tokens With Strip",
+			output:              "tag-db primary",
+			stripExistingPrefix: true,
+			expected:            []string{"tag-db", "tag-primary"},
+		},
+		{
+			name:                "Prefix Without Separator With Strip",
+			output:              "tagdb",
+			stripExistingPrefix: true,
+			expected:            []string{"tag-tagdb"},
+		},
+		{
+			name:                "Empty Output",
+			output:              "",
+			stripExistingPrefix: true,
+			expected:            nil,
+		},
+		{
+			name:         "Uppercase Transform",
+			output:       "db primary",
+			tagTransform: strings.ToUpper,
+			expected:     []string{"TAG-DB", "TAG-PRIMARY"},
+		},
+		{
+			name:   "Dropping Transform",
+			output: "db primary debug",
+			tagTransform: func(tag string) string {
+				if strings.HasPrefix(tag, "tag-d") {
+					return ""
+				}
+				return tag
+			},
+			expected: []string{"tag-primary"},
+		},
+		{
+			name:                "Transform After Strip",
+			output:              "tag-db primary",
+			stripExistingPrefix: true,
+			tagTransform:        strings.ToUpper,
+			expected:            []string{"TAG-DB", "TAG-PRIMARY"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagit := TagIt{TagPrefix: "tag", StripExistingPrefix: tt.stripExistingPrefix, TagTransform: tt.tagTransform}
+			tags := tagit.parseScriptOutput(tagit.TagPrefix, []byte(tt.output))
+			assert.Equal(t, tt.expected, tags, "parseScriptOutput() returned unexpected tags")
+		})
+	}
+}
+
+func TestParseScriptOutputLineMode(t *testing.T) {
+	output := "owner team platform\n\n  role primary  \nzone-a\n"
+
+	tests := []struct {
+		name     string
+		lineMode bool
+		expected []string
+	}{
+		{
+			name:     "Field Mode",
+			lineMode: false,
+			expected: []string{"tag-owner", "tag-team", "tag-platform", "tag-role", "tag-primary", "tag-zone-a"},
+		},
+		{
+			name:     "Line Mode",
+			lineMode: true,
+			expected: []string{"tag-owner team platform", "tag-role primary", "tag-zone-a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagit := TagIt{TagPrefix: "tag", LineMode: tt.lineMode}
+			tags := tagit.parseScriptOutput(tagit.TagPrefix, []byte(output))
+			assert.Equal(t, tt.expected, tags, "parseScriptOutput() returned unexpected tags")
+		})
+	}
+}
+
+func TestFilterOutput(t *testing.T) {
+	output := "# generated by tag-role.sh\nprimary\n  # role detection done\nwest zone-a\nINFO: finished\n"
+
+	tests := []struct {
+		name             string
+		outputFilter     *regexp.Regexp
+		ignoreLinePrefix string
+		expected         []string
+	}{
+		{
+			name:     "No Filter",
+			expected: []string{"tag-#", "tag-generated", "tag-by", "tag-tag-role.sh", "tag-primary", "tag-#", "tag-role", "tag-detection", "tag-done", "tag-west", "tag-zone-a", "tag-INFO:", "tag-finished"},
+		},
+		{
+			name:             "Ignore Comment Lines",
+			ignoreLinePrefix: "#",
+			expected:         []string{"tag-primary", "tag-west", "tag-zone-a", "tag-INFO:", "tag-finished"},
+		},
+		{
+			name:         "Keep Matching Lines",
+			outputFilter: regexp.MustCompile(`^[a-z][a-z0-9 -]*$`),
+			expected:     []string{"tag-primary", "tag-west", "tag-zone-a"},
+		},
+		{
+			name:             "Ignore Prefix And Filter",
+			outputFilter:     regexp.MustCompile(`^\s*[^A-Z]`),
+			ignoreLinePrefix: "#",
+			expected:         []string{"tag-primary", "tag-west", "tag-zone-a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagit := TagIt{TagPrefix: "tag", OutputFilter: tt.outputFilter, IgnoreLinePrefix: tt.ignoreLinePrefix}
+			tags := tagit.parseScriptOutput(tagit.TagPrefix, tagit.filterOutput([]byte(output)))
+			assert.Equal(t, tt.expected, tags, "Unexpected tags after filtering the output")
+		})
+	}
+}
+
+func TestDecodeOutput(t *testing.T) {
+	tests := []struct {
+		name           string
+		output         []byte
+		outputEncoding string
+		lineMode       bool
+		outputFilter   *regexp.Regexp
+		expected       []string
+	}{
+		{
+			name:     "CRLF Field Mode",
+			output:   []byte("primary\r\nzone-a west\r\n"),
+			expected: []string{"tag-primary", "tag-zone-a", "tag-west"},
+		},
+		{
+			name:     "CRLF Line Mode",
+			output:   []byte("role primary\r\nzone-a\r\n"),
+			lineMode: true,
+			expected: []string{"tag-role primary", "tag-zone-a"},
+		},
+		{
+			name:         "CRLF With Anchored Filter",
+			output:       []byte("primary\r\nINFO: done\r\nzone-a\r\n"),
+			outputFilter: regexp.MustCompile(`^[a-z-]+$`),
+			expected:     []string{"tag-primary", "tag-zone-a"},
+		},
+		{
+			name:           "Latin1",
+			output:         []byte("caf\xe9\r\nzone-a\r\n"),
+			outputEncoding: OutputEncodingLatin1,
+			expected:       []string{"tag-café", "tag-zone-a"},
+		},
+		{
+			name:           "UTF-8 Is Kept",
+			output:         []byte("café\n"),
+			outputEncoding: OutputEncodingUTF8,
+			expected:       []string{"tag-café"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagit := TagIt{TagPrefix: "tag", OutputEncoding: tt.outputEncoding, LineMode: tt.lineMode, OutputFilter: tt.outputFilter}
+			tags := tagit.parseScriptOutput(tagit.TagPrefix, tagit.filterOutput(tagit.decodeOutput(tt.output)))
+			assert.Equal(t, tt.expected, tags, "Unexpected tags after decoding the output")
+		})
+	}
+}
+
+func TestValidateOutputEncoding(t *testing.T) {
+	assert.NoError(t, ValidateOutputEncoding(OutputEncodingUTF8))
+	assert.NoError(t, ValidateOutputEncoding(OutputEncodingLatin1))
+	assert.ErrorContains(t, ValidateOutputEncoding("utf-16"), `invalid output encoding "utf-16"`)
+}
+
 func TestCopyServiceToRegistration(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -241,6 +767,57 @@ func TestCopyServiceToRegistration(t *testing.T) {
 				Meta: map[string]string{"version": "1.0"},
 			},
 		},
+		{
+			name: "Copy Locality",
+			service: &api.AgentService{
+				ID:       "service-1",
+				Service:  "test-service",
+				Locality: &api.Locality{Region: "us-east-1", Zone: "us-east-1a"},
+			},
+			expectedReg: &api.AgentServiceRegistration{
+				ID:       "service-1",
+				Name:     "test-service",
+				Locality: &api.Locality{Region: "us-east-1", Zone: "us-east-1a"},
+			},
+		},
+		{
+			name: "Zero Weights",
+			service: &api.AgentService{
+				ID:      "service-1",
+				Service: "test-service",
+				Weights: api.AgentWeights{},
+			},
+			expectedReg: &api.AgentServiceRegistration{
+				ID:   "service-1",
+				Name: "test-service",
+			},
+		},
+		{
+			name: "Explicit Weights",
+			service: &api.AgentService{
+				ID:      "service-1",
+				Service: "test-service",
+				Weights: api.AgentWeights{Passing: 1, Warning: 0},
+			},
+			expectedReg: &api.AgentServiceRegistration{
+				ID:      "service-1",
+				Name:    "test-service",
+				Weights: &api.AgentWeights{Passing: 1, Warning: 0},
+			},
+		},
+		{
+			name: "Warning Weight Only",
+			service: &api.AgentService{
+				ID:      "service-1",
+				Service: "test-service",
+				Weights: api.AgentWeights{Passing: 0, Warning: 1},
+			},
+			expectedReg: &api.AgentServiceRegistration{
+				ID:      "service-1",
+				Name:    "test-service",
+				Weights: &api.AgentWeights{Passing: 0, Warning: 1},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -292,7 +869,7 @@ func TestRunScript(t *testing.T) {
 			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 			tagit := TagIt{Script: tt.script, commandExecutor: mockExecutor, logger: logger}
 
-			output, err := tagit.runScript()
+			output, err := tagit.runScript(context.Background(), tagit.Script)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -304,13 +881,129 @@ func TestRunScript(t *testing.T) {
 	}
 }
 
-func TestNew(t *testing.T) {
-	mockConsulClient := &MockConsulClient{}
-	mockCommandExecutor := &MockCommandExecutor{}
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+func TestScriptJitter(t *testing.T) {
+	tagit := TagIt{ScriptJitter: 20 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		delay := tagit.scriptDelay()
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, tagit.ScriptJitter, "Expected the delay to stay below the jitter")
+	}
+	assert.Zero(t, (&TagIt{}).scriptDelay(), "Expected no delay without jitter")
 
-	tagit := New(mockConsulClient, mockCommandExecutor, "test-service", "echo test", 30*time.Second, "test-prefix", logger)
+	t.Run("Delays The Script", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit := TagIt{Script: "echo test", ScriptJitter: 20 * time.Millisecond, commandExecutor: &MockCommandExecutor{MockOutput: []byte("primary")}, logger: logger}
 
+		start := time.Now()
+		output, err := tagit.runScript(context.Background(), tagit.Script)
+		assert.NoError(t, err)
+		assert.Equal(t, "primary", string(output))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		mockExecutor := &DynamicMockExecutor{Outputs: []string{"primary"}}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit := TagIt{Script: "echo test", ScriptJitter: time.Hour, commandExecutor: mockExecutor, logger: logger}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := tagit.runScript(ctx, tagit.Script)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second, "Expected the delay to end with the context")
+		assert.Zero(t, mockExecutor.calls, "Expected the script not to run after cancellation")
+	})
+}
+
+// countingExecutor fails with err when it is set and counts its calls.
+type countingExecutor struct {
+	err   error
+	calls int
+}
+
+func (e *countingExecutor) Execute(command string) ([]byte, error) {
+	e.calls++
+	if e.err != nil {
+		return nil, e.err
+	}
+	return []byte("primary"), nil
+}
+
+func TestScriptBreaker(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	executor := &countingExecutor{err: fmt.Errorf("script exited with code 1")}
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tagit := &TagIt{
+		Script:                 "echo test",
+		ScriptBreakerThreshold: 3,
+		ScriptBreakerCooldown:  time.Minute,
+		commandExecutor:        executor,
+		logger:                 logger,
+		now:                    func() time.Time { return now },
+	}
+	run := func() error {
+		_, err := tagit.runScript(context.Background(), tagit.Script)
+		return err
+	}
+
+	// Failures below the threshold keep running the script
+	for range 2 {
+		err := run()
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrScriptBreakerOpen)
+	}
+	assert.Equal(t, 2, executor.calls)
+	assert.NotContains(t, logs.String(), "script circuit breaker opened")
+
+	// The third consecutive failure opens the breaker
+	assert.NotErrorIs(t, run(), ErrScriptBreakerOpen)
+	assert.Contains(t, logs.String(), "script circuit breaker opened")
+	assert.ErrorIs(t, run(), ErrScriptBreakerOpen)
+	now = now.Add(30 * time.Second)
+	assert.ErrorIs(t, run(), ErrScriptBreakerOpen)
+	assert.Equal(t, 3, executor.calls, "Expected the script to be skipped while the breaker is open")
+
+	// A failed retry after the cooldown opens it again right away
+	now = now.Add(31 * time.Second)
+	assert.NotErrorIs(t, run(), ErrScriptBreakerOpen)
+	assert.Contains(t, logs.String(), "script circuit breaker half-open")
+	assert.Equal(t, 4, executor.calls)
+	assert.ErrorIs(t, run(), ErrScriptBreakerOpen)
+
+	// A successful retry closes it and resets the failures
+	now = now.Add(time.Minute)
+	executor.err = nil
+	output, err := tagit.runScript(context.Background(), tagit.Script)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(output))
+	assert.Contains(t, logs.String(), "script circuit breaker closed")
+	executor.err = fmt.Errorf("script exited with code 1")
+	for range 2 {
+		assert.NotErrorIs(t, run(), ErrScriptBreakerOpen)
+	}
+	assert.Equal(t, 7, executor.calls, "Expected the failures to be counted from zero after closing")
+
+	t.Run("Disabled", func(t *testing.T) {
+		executor := &countingExecutor{err: fmt.Errorf("script exited with code 1")}
+		tagit := &TagIt{Script: "echo test", commandExecutor: executor, logger: logger}
+		for range 10 {
+			_, err := tagit.runScript(context.Background(), tagit.Script)
+			assert.NotErrorIs(t, err, ErrScriptBreakerOpen)
+		}
+		assert.Equal(t, 10, executor.calls)
+	})
+}
+
+func TestNew(t *testing.T) {
+	mockConsulClient := &MockConsulClient{}
+	mockCommandExecutor := &MockCommandExecutor{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tagit, err := New(mockConsulClient, mockCommandExecutor, "test-service", "echo test", 30*time.Second, "test-prefix", logger)
+
+	assert.NoError(t, err)
 	assert.NotNil(t, tagit, "New() returned nil")
 	assert.NotNil(t, tagit.client, "TagIt client is nil")
 	assert.NotNil(t, tagit.commandExecutor, "TagIt commandExecutor is nil")
@@ -320,6 +1013,65 @@ func TestNew(t *testing.T) {
 	assert.Equal(t, "test-prefix", tagit.TagPrefix, "Unexpected TagPrefix")
 }
 
+func TestNewInvalidInput(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name      string
+		client    ConsulClient
+		serviceID string
+		logger    *slog.Logger
+		wantErr   string
+	}{
+		{
+			name:      "Nil Client",
+			serviceID: "test-service",
+			logger:    logger,
+			wantErr:   "consul client must not be nil",
+		},
+		{
+			name:    "Empty Service ID",
+			client:  &MockConsulClient{},
+			logger:  logger,
+			wantErr: "service id must not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagit, err := New(tt.client, &MockCommandExecutor{}, tt.serviceID, "echo test", 30*time.Second, "tag", tt.logger)
+
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+			assert.Nil(t, tagit, "New() should not return a TagIt on error")
+		})
+	}
+}
+
+func TestNewNilLogger(t *testing.T) {
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{ID: "test-service", Tags: []string{"other-tag"}}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, tagit.logger, "A nil logger should be replaced")
+
+	assert.NotPanics(t, func() {
+		changed, err := tagit.updateServiceTags()
+		assert.NoError(t, err)
+		assert.True(t, changed)
+	})
+}
+
 func TestGetService(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -375,9 +1127,10 @@ func TestGetService(t *testing.T) {
 				},
 			}
 			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-			tagit := New(mockConsulClient, nil, tt.serviceID, "", time.Duration(0), "", logger)
+			tagit, err := New(mockConsulClient, nil, tt.serviceID, "", time.Duration(0), "", logger)
+			assert.NoError(t, err)
 
-			service, err := tagit.getService()
+			service, err := tagit.getService(context.Background())
 
 			if tt.expectErr {
 				assert.Error(t, err)
@@ -390,6 +1143,74 @@ func TestGetService(t *testing.T) {
 	}
 }
 
+func TestConsulTimeout(t *testing.T) {
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				// Block like a hung agent until the call is abandoned
+				<-q.Context().Done()
+				return nil, nil, q.Context().Err()
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.ConsulTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	_, err = tagit.updateServiceTags()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "consul call timed out after 20ms")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "Expected the call to return after the timeout")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tagit.CleanupTagsContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotContains(t, err.Error(), "timed out", "A cancelled context is not a timeout")
+}
+
+func TestGetServiceQueryOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowStale bool
+		useCache   bool
+	}{
+		{name: "Default"},
+		{name: "Allow Stale", allowStale: true},
+		{name: "Use Cache", useCache: true},
+		{name: "Allow Stale And Use Cache", allowStale: true, useCache: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query *api.QueryOptions
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						query = q
+						return &api.AgentService{ID: serviceID}, nil, nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, nil, "test-service", "", time.Duration(0), "", logger)
+			assert.NoError(t, err)
+			tagit.AllowStale = tt.allowStale
+			tagit.UseCache = tt.useCache
+
+			_, err = tagit.getService(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.allowStale, query.AllowStale, "Unexpected AllowStale")
+			assert.Equal(t, tt.useCache, query.UseCache, "Unexpected UseCache")
+		})
+	}
+}
+
 func TestUpdateServiceTags(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -439,9 +1260,10 @@ func TestUpdateServiceTags(t *testing.T) {
 				},
 			}
 			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-			tagit := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
 
-			err := tagit.updateServiceTags()
+			_, err = tagit.updateServiceTags()
 			if tt.expectError {
 				assert.Error(t, err)
 			} else {
@@ -451,196 +1273,3372 @@ func TestUpdateServiceTags(t *testing.T) {
 	}
 }
 
-func TestCleanupTags(t *testing.T) {
+func TestOnUpdate(t *testing.T) {
 	tests := []struct {
 		name            string
-		serviceID       string
-		mockServices    map[string]*api.AgentService
-		tagPrefix       string
+		existingTags    []string
 		mockRegisterErr error
-		expectError     bool
-		expectTags      []string
+		expectCalled    bool
+		expectAdded     []string
+		expectRemoved   []string
 	}{
 		{
-			name:      "Successful Tag Cleanup",
-			serviceID: "test-service",
-			mockServices: map[string]*api.AgentService{
-				"test-service": {
-					ID:   "test-service",
-					Tags: []string{"tag-prefix1", "tag-prefix2", "other-tag"},
-				},
-			},
-			tagPrefix:   "tag",
-			expectError: false,
-			expectTags:  []string{"other-tag"},
-		},
-		{
-			name:      "No Tag Cleanup needed",
-			serviceID: "test-service",
-			mockServices: map[string]*api.AgentService{
-				"test-service": {
-					ID:   "test-service",
-					Tags: []string{"prefix1", "prefix2", "other-tag"},
-				},
-			},
-			tagPrefix:   "tag",
-			expectError: false,
-			expectTags:  []string{"other-tag", "prefix1", "prefix2"},
+			name:          "Tags Changed",
+			existingTags:  []string{"tag-old-tag", "tag-new-tag1"},
+			expectCalled:  true,
+			expectAdded:   []string{"tag-new-tag2"},
+			expectRemoved: []string{"tag-old-tag"},
 		},
 		{
-			name:      "Service Not Found",
-			serviceID: "non-existent-service",
-			mockServices: map[string]*api.AgentService{
-				"other-service": {
-					ID:   "other-service",
-					Tags: []string{"some-tag", "another-tag"},
-				},
-			},
-			tagPrefix:   "tag-prefix",
-			expectError: true,
+			name:         "No-op Cycle",
+			existingTags: []string{"tag-new-tag1", "tag-new-tag2"},
+			expectCalled: false,
 		},
 		{
-			name:      "Consul Register Error",
-			serviceID: "test-service",
-			mockServices: map[string]*api.AgentService{
-				"test-service": {
-					ID:   "test-service",
-					Tags: []string{"tag-prefix1", "other-tag"},
-				},
-			},
-			tagPrefix:       "tag",
-			mockRegisterErr: fmt.Errorf("consul register error"),
-			expectError:     true,
+			name:            "Register Failed",
+			existingTags:    []string{"tag-old-tag"},
+			mockRegisterErr: fmt.Errorf("consul error"),
+			expectCalled:    false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag1 new-tag2")}
 			mockConsulClient := &MockConsulClient{
 				MockAgent: &MockAgent{
 					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
-						service, exists := tt.mockServices[serviceID]
-						if !exists {
-							return nil, nil, fmt.Errorf("service not found")
-						}
-						return service, nil, nil
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: tt.existingTags,
+						}, nil, nil
 					},
 					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
-						if tt.mockRegisterErr != nil {
-							return tt.mockRegisterErr
-						}
-						// Update the mock service with the new tags
-						tt.mockServices[reg.ID].Tags = reg.Tags
-						return nil
+						return tt.mockRegisterErr
 					},
 				},
 			}
 			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-			tagit := New(mockConsulClient, nil, tt.serviceID, "", time.Duration(0), tt.tagPrefix, logger)
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
 
-			err := tagit.CleanupTags()
-			if tt.expectError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-				service, _ := tagit.getService()
-				if service != nil {
-					actualTags := service.Tags
-					sort.Strings(actualTags)
-					sort.Strings(tt.expectTags)
-					assert.Equal(t, tt.expectTags, actualTags, "Unexpected tags after cleanup")
-				}
+			called := false
+			var added, removed []string
+			tagit.OnUpdate = func(ctx context.Context, a, r []string) {
+				called = true
+				added, removed = a, r
 			}
+
+			tagit.updateServiceTags()
+
+			assert.Equal(t, tt.expectCalled, called, "Unexpected OnUpdate call")
+			assert.Equal(t, tt.expectAdded, added, "Unexpected added tags")
+			assert.Equal(t, tt.expectRemoved, removed, "Unexpected removed tags")
 		})
 	}
 }
 
-func TestRun(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	updateServiceTagsCalled := atomic.Int32{}
-	mockExecutor := &MockCommandExecutor{
-		MockOutput: []byte("new-tag1 new-tag2"),
-		MockError:  nil,
-	}
-	mockConsulClient := &MockConsulClient{
-		MockAgent: &MockAgent{
-			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
-				updateServiceTagsCalled.Add(1)
-				if updateServiceTagsCalled.Load() == 2 {
-					return nil, nil, fmt.Errorf("simulated error")
-				}
-				return &api.AgentService{
-					ID:   "test-service",
-					Tags: []string{"old-tag"},
-				}, nil, nil
-			},
-			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
-				return nil
-			},
+func TestUpdatedTagsLogFormat(t *testing.T) {
+	tests := []struct {
+		name         string
+		separator    string
+		expectedLine string
+	}{
+		{
+			name:         "Default List",
+			expectedLine: `msg="updated service tags" service=test-service tags="[other-tag tag-new-tag1 tag-new-tag2]" added=2 removed=1`,
+		},
+		{
+			name:         "Comma Separator",
+			separator:    ",",
+			expectedLine: `msg="updated service tags" service=test-service tags=other-tag,tag-new-tag1,tag-new-tag2 added=2 removed=1`,
+		},
+		{
+			name:         "Pipe Separator",
+			separator:    " | ",
+			expectedLine: `msg="updated service tags" service=test-service tags="other-tag | tag-new-tag1 | tag-new-tag2" added=2 removed=1`,
 		},
 	}
 
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	tagit := New(mockConsulClient, mockExecutor, "test-service", "echo test", 100*time.Millisecond, "tag", logger)
-
-	go tagit.Run(ctx)
-
-	time.Sleep(350 * time.Millisecond)
-	cancel()
-
-	time.Sleep(50 * time.Millisecond)
-
-	assert.GreaterOrEqual(t, updateServiceTagsCalled.Load(), int32(2), "Expected updateServiceTags to be called at least 2 times")
-	assert.LessOrEqual(t, updateServiceTagsCalled.Load(), int32(4), "Expected updateServiceTags to be called at most 4 times")
-}
-
-func TestNewConsulAPIWrapper(t *testing.T) {
-	consulClient, err := api.NewClient(api.DefaultConfig())
-	assert.NoError(t, err, "Failed to create Consul client")
-
-	wrapper := NewConsulAPIWrapper(consulClient)
-
-	assert.NotNil(t, wrapper, "NewConsulAPIWrapper returned nil")
-
-	_, isConsulClient := interface{}(wrapper).(ConsulClient)
-	assert.True(t, isConsulClient, "NewConsulAPIWrapper does not implement ConsulClient interface")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: []string{"other-tag", "tag-old-tag"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag1 new-tag2")}
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey || a.Key == slog.LevelKey {
+						return slog.Attr{}
+					}
+					return a
+				},
+			}))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.LogTagSeparator = tt.separator
 
-	_, isConsulAgent := wrapper.Agent().(ConsulAgent)
-	assert.True(t, isConsulAgent, "Wrapper's Agent method does not return a ConsulAgent")
+			_, err = tagit.updateServiceTags()
+			assert.NoError(t, err)
+			assert.Contains(t, buf.String(), tt.expectedLine+"\n")
+		})
+	}
 }
 
-func TestCmdExecutor_Execute(t *testing.T) {
+func TestOnlyIfHealthy(t *testing.T) {
 	tests := []struct {
-		name        string
-		command     string
-		wantOutput  string
-		wantErr     string
-		expectError bool
+		name           string
+		health         string
+		healthErr      error
+		expectRegister bool
+		expectError    bool
 	}{
 		{
-			name:        "Valid command",
-			command:     "echo test",
-			wantOutput:  "test\n",
-			expectError: false,
+			name:           "Passing",
+			health:         api.HealthPassing,
+			expectRegister: true,
 		},
 		{
-			name:        "Empty command",
-			command:     "",
-			wantErr:     "failed to execute: empty command",
-			expectError: true,
+			name:           "Warning",
+			health:         api.HealthWarning,
+			expectRegister: true,
 		},
 		{
-			name:        "Command with unclosed quote",
-			command:     "echo \"unclosed quote",
-			wantErr:     "failed to split command:",
-			expectError: true,
+			name:           "Critical",
+			health:         api.HealthCritical,
+			expectRegister: false,
 		},
 		{
-			name:        "Invalid command",
-			command:     "invalidcommand",
-			wantErr:     "exec: \"invalidcommand\": executable file not found in $PATH",
+			name:           "Health Error",
+			healthErr:      fmt.Errorf("consul error"),
+			expectRegister: false,
+			expectError:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registerCalled := false
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: []string{"other-tag"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalled = true
+						return nil
+					},
+					HealthFunc: func(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+						return tt.health, nil, tt.healthErr
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.OnlyIfHealthy = true
+
+			changed, err := tagit.updateServiceTags()
+
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectRegister, registerCalled, "Unexpected ServiceRegister call")
+			assert.Equal(t, tt.expectRegister, changed, "Unexpected changed result")
+		})
+	}
+}
+
+func TestSkipInMaintenance(t *testing.T) {
+	maintenance := &api.HealthCheck{
+		CheckID: "_service_maintenance:test-service",
+		Status:  api.HealthCritical,
+	}
+	tests := []struct {
+		name           string
+		checks         []*api.HealthCheck
+		health         string
+		onlyIfHealthy  bool
+		expectRegister bool
+	}{
+		{
+			name:           "Maintenance Disabled",
+			checks:         []*api.HealthCheck{{CheckID: "service:test-service", Status: api.HealthPassing}},
+			health:         api.HealthPassing,
+			expectRegister: true,
+		},
+		{
+			name:           "Maintenance Enabled",
+			checks:         []*api.HealthCheck{maintenance},
+			health:         api.HealthCritical,
+			expectRegister: false,
+		},
+		{
+			name:           "Other Service In Maintenance",
+			checks:         []*api.HealthCheck{{CheckID: "_service_maintenance:other-service", Status: api.HealthCritical}},
+			health:         api.HealthPassing,
+			expectRegister: true,
+		},
+		{
+			name:           "Node Maintenance Enabled",
+			checks:         []*api.HealthCheck{{CheckID: "_node_maintenance", Status: api.HealthCritical}},
+			health:         api.HealthCritical,
+			expectRegister: false,
+		},
+		{
+			name:           "Maintenance Enabled With Only If Healthy",
+			checks:         []*api.HealthCheck{maintenance},
+			health:         api.HealthCritical,
+			onlyIfHealthy:  true,
+			expectRegister: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registerCalled := false
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: []string{"other-tag"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalled = true
+						return nil
+					},
+					HealthFunc: func(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+						return tt.health, &api.AgentServiceChecksInfo{AggregatedStatus: tt.health, Checks: tt.checks}, nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.SkipInMaintenance = true
+			tagit.OnlyIfHealthy = tt.onlyIfHealthy
+
+			changed, err := tagit.updateServiceTags()
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectRegister, registerCalled, "Unexpected ServiceRegister call")
+			assert.Equal(t, tt.expectRegister, changed, "Unexpected changed result")
+			if !tt.expectRegister {
+				assert.Contains(t, buf.String(), `level=INFO msg="skipping update of service in maintenance"`)
+			}
+		})
+	}
+}
+
+func TestForceReregister(t *testing.T) {
+	rejected := api.StatusError{Code: 400, Body: "Invalid service update"}
+
+	tests := []struct {
+		name             string
+		forceReregister  bool
+		registerErrs     []error
+		deregisterErr    error
+		checks           []*api.HealthCheck
+		healthErr        error
+		expectDeregister bool
+		expectRegisters  int
+		expectError      string
+	}{
+		{
+			name:            "Register Succeeds",
+			forceReregister: true,
+			registerErrs:    []error{nil},
+			expectRegisters: 1,
+		},
+		{
+			name:            "Rejected Without Force",
+			registerErrs:    []error{rejected},
+			expectRegisters: 1,
+			expectError:     "error registering service",
+		},
+		{
+			name:             "Rejected With Force",
+			forceReregister:  true,
+			registerErrs:     []error{rejected, nil},
+			expectDeregister: true,
+			expectRegisters:  2,
+		},
+		{
+			name:            "Other Error With Force",
+			forceReregister: true,
+			registerErrs:    []error{fmt.Errorf("connection refused")},
+			expectRegisters: 1,
+			expectError:     "error registering service",
+		},
+		{
+			name:            "Server Error With Force",
+			forceReregister: true,
+			registerErrs:    []error{api.StatusError{Code: 500, Body: "rpc error"}},
+			expectRegisters: 1,
+			expectError:     "error registering service",
+		},
+		{
+			name:            "Rate Limited With Force",
+			forceReregister: true,
+			registerErrs:    []error{api.StatusError{Code: 429, Body: "rate limit exceeded"}},
+			expectRegisters: 1,
+			expectError:     "error registering service",
+		},
+		{
+			name:            "Rejected With Force And Checks",
+			forceReregister: true,
+			registerErrs:    []error{rejected},
+			checks:          []*api.HealthCheck{{CheckID: "service:test-service", Status: api.HealthPassing}},
+			expectRegisters: 1,
+			expectError:     "would drop its 1 health checks",
+		},
+		{
+			name:            "Rejected With Force And Health Error",
+			forceReregister: true,
+			registerErrs:    []error{rejected},
+			healthErr:       fmt.Errorf("consul error"),
+			expectRegisters: 1,
+			expectError:     "not re-registering it",
+		},
+		{
+			name:             "Deregister Error",
+			forceReregister:  true,
+			registerErrs:     []error{rejected},
+			deregisterErr:    fmt.Errorf("consul error"),
+			expectDeregister: true,
+			expectRegisters:  1,
+			expectError:      "error deregistering service",
+		},
+		{
+			name:             "Re-register Error",
+			forceReregister:  true,
+			registerErrs:     []error{rejected, fmt.Errorf("consul error")},
+			expectDeregister: true,
+			expectRegisters:  2,
+			expectError:      "error re-registering service",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registers := 0
+			deregistered := ""
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: []string{"other-tag"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						err := tt.registerErrs[registers]
+						registers++
+						return err
+					},
+					ServiceDeregisterFunc: func(serviceID string) error {
+						deregistered = serviceID
+						return tt.deregisterErr
+					},
+					HealthFunc: func(serviceID string, q *api.QueryOptions) (string, *api.AgentServiceChecksInfo, error) {
+						return api.HealthPassing, &api.AgentServiceChecksInfo{Checks: tt.checks}, tt.healthErr
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ForceReregister = tt.forceReregister
+
+			_, err = tagit.updateServiceTags()
+
+			if tt.expectError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectRegisters, registers, "Unexpected number of ServiceRegister calls")
+			if tt.expectDeregister {
+				assert.Equal(t, "test-service", deregistered, "Service should be deregistered")
+			} else {
+				assert.Empty(t, deregistered, "Service should not be deregistered")
+			}
+		})
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	denied := api.StatusError{Code: 403, Body: "Permission denied: token lacks permission 'service:write' on \"web\""}
+
+	tests := []struct {
+		name        string
+		serviceErr  error
+		registerErr error
+		expectError string
+	}{
+		{
+			name:        "Register Denied",
+			registerErr: denied,
+			expectError: "permission denied: the consul token needs service:write on service web",
+		},
+		{
+			name:        "Register Denied Plain Error",
+			registerErr: fmt.Errorf("Unexpected response code: 403 (Permission denied)"),
+			expectError: "permission denied: the consul token needs service:write on service web",
+		},
+		{
+			name:        "Read Denied",
+			serviceErr:  denied,
+			expectError: "permission denied: the consul token needs service:read on service web-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registers := 0
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						if tt.serviceErr != nil {
+							return nil, nil, tt.serviceErr
+						}
+						return &api.AgentService{ID: "web-1", Service: "web", Tags: []string{"tag-old"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registers++
+						return tt.registerErr
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "web-1", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ForceReregister = true
+
+			_, err = tagit.updateServiceTags()
+			assert.ErrorIs(t, err, ErrPermissionDenied)
+			assert.Contains(t, err.Error(), tt.expectError)
+
+			_, err = tagit.CleanupTags()
+			assert.ErrorIs(t, err, ErrPermissionDenied)
+			assert.Contains(t, err.Error(), tt.expectError)
+
+			if tt.registerErr != nil {
+				assert.Equal(t, 2, registers, "A denied registration should not be forced")
+			}
+		})
+	}
+}
+
+func TestServiceNotFound(t *testing.T) {
+	tests := []struct {
+		name           string
+		byName         bool
+		service        *api.AgentService
+		serviceErr     error
+		expectNotFound bool
+		expectError    string
+	}{
+		{
+			name:           "Unknown Service ID",
+			serviceErr:     api.StatusError{Code: 404, Body: "unknown service ID: web-1"},
+			expectNotFound: true,
+			expectError:    "service not found: web-1",
+		},
+		{
+			name:           "Empty Answer",
+			expectNotFound: true,
+			expectError:    "service not found: web-1",
+		},
+		{
+			name:           "No Instances",
+			byName:         true,
+			expectNotFound: true,
+			expectError:    "no instances of service web-1 found",
+		},
+		{
+			name:        "Other Error",
+			serviceErr:  api.StatusError{Code: 500, Body: "internal error"},
+			expectError: "error getting service web-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return tt.service, nil, tt.serviceErr
+					},
+					ServicesFunc: func() (map[string]*api.AgentService, error) {
+						return map[string]*api.AgentService{"db-1": {ID: "db-1", Service: "db"}}, nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "web-1", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ByName = tt.byName
+
+			_, err = tagit.updateServiceTags()
+			assert.ErrorContains(t, err, tt.expectError)
+			assert.Equal(t, tt.expectNotFound, errors.Is(err, ErrServiceNotFound), "Unexpected match of ErrServiceNotFound")
+		})
+	}
+}
+
+func TestByName(t *testing.T) {
+	newServices := func() map[string]*api.AgentService {
+		return map[string]*api.AgentService{
+			"web-1": {ID: "web-1", Service: "web", Tags: []string{"other-tag"}},
+			"web-2": {ID: "web-2", Service: "web", Tags: []string{"tag-old"}},
+			"db-1":  {ID: "db-1", Service: "db", Tags: []string{"other-tag"}},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		serviceName  string
+		registerErr  map[string]error
+		expectTags   map[string][]string
+		expectError  string
+		expectChange bool
+	}{
+		{
+			name:        "Two Instances",
+			serviceName: "web",
+			expectTags: map[string][]string{
+				"web-1": {"other-tag", "tag-primary"},
+				"web-2": {"tag-primary"},
+				"db-1":  {"other-tag"},
+			},
+			expectChange: true,
+		},
+		{
+			name:        "No Instances",
+			serviceName: "cache",
+			expectTags: map[string][]string{
+				"web-1": {"other-tag"},
+				"web-2": {"tag-old"},
+				"db-1":  {"other-tag"},
+			},
+			expectError: "no instances of service cache found",
+		},
+		{
+			name:        "One Instance Fails",
+			serviceName: "web",
+			registerErr: map[string]error{"web-1": fmt.Errorf("consul error")},
+			expectTags: map[string][]string{
+				"web-1": {"other-tag"},
+				"web-2": {"tag-primary"},
+				"db-1":  {"other-tag"},
+			},
+			expectError:  "service web-1",
+			expectChange: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := newServices()
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServicesFunc: func() (map[string]*api.AgentService, error) {
+						return services, nil
+					},
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						service := *services[serviceID]
+						return &service, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						if err := tt.registerErr[reg.ID]; err != nil {
+							return err
+						}
+						services[reg.ID].Tags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &DynamicMockExecutor{Outputs: []string{"primary"}}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, tt.serviceName, "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ByName = true
+
+			changed, err := tagit.updateServiceTags()
+
+			if tt.expectError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectChange, changed, "Unexpected changed result")
+			for serviceID, tags := range tt.expectTags {
+				assert.Equal(t, tags, services[serviceID].Tags, "Unexpected tags for %s", serviceID)
+			}
+			assert.LessOrEqual(t, mockExecutor.calls, 1, "The script should run at most once per cycle")
+		})
+	}
+}
+
+func TestLowercaseTags(t *testing.T) {
+	tests := []struct {
+		name          string
+		lowercaseTags bool
+		expected      []string
+		cleaned       []string
+	}{
+		{
+			name:     "Disabled",
+			expected: []string{"TAG-Stale", "Tag-DC-East", "Tag-Primary", "Tag-Static", "Tag-Zone-East", "other-Tag"},
+			cleaned:  []string{"TAG-Stale", "other-Tag"},
+		},
+		{
+			name:          "Enabled",
+			lowercaseTags: true,
+			expected:      []string{"other-Tag", "tag-dc-east", "tag-primary", "tag-static", "tag-zone-east"},
+			cleaned:       []string{"other-Tag"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-Tag", "TAG-Stale"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: currentTags, Meta: map[string]string{"zone": "East"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("Primary DC-East")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "Tag", logger)
+			assert.NoError(t, err)
+			tagit.LowercaseTags = tt.lowercaseTags
+			tagit.StaticTags = []string{"Static"}
+			tmpl, err := ParseTagTemplate("Zone-{{ .Meta.zone }}")
+			assert.NoError(t, err)
+			tagit.TagTemplates = []*template.Template{tmpl}
+
+			_, err = tagit.updateServiceTags()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, currentTags, "Only lowercase tags should replace the managed tags of any case")
+
+			changed, err := tagit.updateServiceTags()
+			assert.NoError(t, err)
+			assert.False(t, changed, "Expected the tags to round-trip without further updates")
+
+			_, err = tagit.CleanupTags()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.cleaned, currentTags, "Cleanup should match the tags of the update")
+
+			generated, err := tagit.GenerateTags(mockExecutor)
+			assert.NoError(t, err)
+			if tt.lowercaseTags {
+				assert.Equal(t, []string{"tag-primary", "tag-dc-east", "tag-static"}, generated, "GenerateTags should lowercase the tags the same way")
+			} else {
+				assert.Equal(t, []string{"Tag-Primary", "Tag-DC-East", "Tag-Static"}, generated)
+			}
+		})
+	}
+}
+
+func TestStaticTags(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.StaticTags = []string{"managed-by-tagit", "static"}
+
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-managed-by-tagit", "tag-static"}, currentTags, "Static tags should be added even without script output")
+
+	mockExecutor.MockOutput = []byte("static dynamic")
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-dynamic", "tag-managed-by-tagit", "tag-static"}, currentTags, "Static tags should be merged and deduplicated with the script output")
+
+	_, err = tagit.CleanupTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag"}, currentTags, "Static tags should be removed on cleanup")
+}
+
+func TestPortTag(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	port := 8080
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+					Port: port,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-primary"}, currentTags, "The port tag should only be added when enabled")
+
+	tagit.PortTag = true
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-port-8080", "tag-primary"}, currentTags, "The port tag should be added")
+
+	port = 9090
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-port-9090", "tag-primary"}, currentTags, "The port tag should follow the service port")
+
+	port = 0
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-primary"}, currentTags, "A service without a port should get no port tag")
+
+	port = 8080
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	_, err = tagit.CleanupTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag"}, currentTags, "The port tag should be removed on cleanup")
+}
+
+func TestHostnameTag(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{ID: "test-service", Tags: currentTags}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	hostname := "node-1"
+	var hostnameErr error
+	tagit.hostname = func() (string, error) { return hostname, hostnameErr }
+
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-primary"}, currentTags, "The hostname tag should only be added when enabled")
+
+	tagit.HostnameTag = true
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-host-node-1", "tag-primary"}, currentTags, "The hostname tag should be added")
+
+	hostname = "node-2"
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag", "tag-host-node-2", "tag-primary"}, currentTags, "The hostname tag should follow the hostname")
+
+	hostnameErr = fmt.Errorf("lookup failed")
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err, "A failed hostname lookup should not fail the cycle")
+	assert.Equal(t, []string{"other-tag", "tag-primary"}, currentTags, "The hostname tag should be skipped when the lookup fails")
+
+	hostnameErr = nil
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	_, err = tagit.CleanupTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other-tag"}, currentTags, "The hostname tag should be removed on cleanup")
+}
+
+func TestAddressTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		expected []string
+	}{
+		{name: "IPv4", address: "10.0.0.1", expected: []string{"other-tag", "tag-addr-10-0-0-1", "tag-primary"}},
+		{name: "IPv6", address: "2001:db8::1", expected: []string{"other-tag", "tag-addr-2001-db8--1", "tag-primary"}},
+		{name: "IPv6 with brackets and zone", address: "[FE80::1%eth0]", expected: []string{"other-tag", "tag-addr-fe80--1-eth0", "tag-primary"}},
+		{name: "No address", address: "", expected: []string{"other-tag", "tag-primary"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-tag"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Address: tt.address, Tags: currentTags}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.AddressTag = true
+
+			_, err = tagit.updateServiceTags()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, currentTags)
+			for _, tag := range currentTags {
+				assert.NotContains(t, tag, ":", "Tags should not contain colons")
+				assert.NotContains(t, tag, ".", "Tags should not contain dots")
+			}
+
+			_, err = tagit.CleanupTags()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"other-tag"}, currentTags, "The address tag should be removed on cleanup")
+		})
+	}
+}
+
+func TestProbeTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		probeErr error
+		upTag    string
+		downTag  string
+		expected []string
+	}{
+		{name: "Success", expected: []string{"other-tag", "tag-primary", "tag-up"}},
+		{name: "Failure", probeErr: &ScriptExitError{Code: 1}, expected: []string{"other-tag", "tag-down", "tag-primary"}},
+		{name: "Custom Up Tag", upTag: "healthy", downTag: "unhealthy", expected: []string{"other-tag", "tag-healthy", "tag-primary"}},
+		{name: "Custom Down Tag", probeErr: &ScriptExitError{Code: 2}, upTag: "healthy", downTag: "unhealthy", expected: []string{"other-tag", "tag-primary", "tag-unhealthy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-tag"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: currentTags}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			var probed []string
+			tagit.ProbeCommand = "check-health --quiet"
+			tagit.ProbeUpTag = tt.upTag
+			tagit.ProbeDownTag = tt.downTag
+			tagit.ProbeExecutor = executorFunc(func(command string) ([]byte, error) {
+				probed = append(probed, command)
+				// The probe output never becomes a tag
+				return []byte("ignored output"), tt.probeErr
+			})
+
+			_, err = tagit.updateServiceTags()
+			assert.NoError(t, err, "A failed probe should not fail the cycle")
+			assert.Equal(t, tt.expected, currentTags)
+			assert.Equal(t, []string{"check-health --quiet"}, probed)
+
+			_, err = tagit.CleanupTags()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"other-tag"}, currentTags, "The probe tag should be removed on cleanup")
+		})
+	}
+
+	t.Run("Probe Result Changes", func(t *testing.T) {
+		currentTags := []string{"other-tag"}
+		mockConsulClient := &MockConsulClient{
+			MockAgent: &MockAgent{
+				ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+					return &api.AgentService{ID: "test-service", Tags: currentTags}, nil, nil
+				},
+				ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+					currentTags = reg.Tags
+					return nil
+				},
+			},
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", 30*time.Second, "tag", logger)
+		assert.NoError(t, err)
+		probeExecutor := &MockCommandExecutor{}
+		tagit.ProbeCommand = "check-health"
+		tagit.ProbeExecutor = probeExecutor
+
+		_, err = tagit.updateServiceTags()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"other-tag", "tag-primary", "tag-up"}, currentTags)
+
+		probeExecutor.MockError = &ScriptExitError{Code: 1}
+		changed, err := tagit.updateServiceTags()
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, []string{"other-tag", "tag-down", "tag-primary"}, currentTags, "The up tag should be replaced by the down tag")
+	})
+
+	for _, probeErr := range []error{ErrScriptNotFound, ErrScriptTimeout, fmt.Errorf("failed to split command: EOF found after escape character")} {
+		t.Run("Setup Error "+probeErr.Error(), func(t *testing.T) {
+			currentTags := []string{"other-tag", "tag-primary", "tag-up"}
+			registerCalled := false
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: currentTags}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalled = true
+						return nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ProbeCommand = "check-helth"
+			tagit.ProbeExecutor = &MockCommandExecutor{MockError: probeErr}
+
+			_, err = tagit.updateServiceTags()
+			assert.ErrorIs(t, err, probeErr)
+			assert.ErrorContains(t, err, "error running probe command")
+			assert.False(t, registerCalled, "A probe that cannot run should not mark the service down")
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name          string
+		scriptErr     error
+		registerErr   error
+		expectedSpans []string
+		failedSpans   []string
+	}{
+		{
+			name:          "Successful update",
+			expectedSpans: []string{"tagit.script", "consul.service_register", "tagit.update"},
+		},
+		{
+			name:          "Script failure",
+			scriptErr:     fmt.Errorf("script error"),
+			expectedSpans: []string{"tagit.script", "tagit.update"},
+			failedSpans:   []string{"tagit.script", "tagit.update"},
+		},
+		{
+			name:          "Registration failure",
+			registerErr:   fmt.Errorf("register error"),
+			expectedSpans: []string{"tagit.script", "consul.service_register", "tagit.update"},
+			failedSpans:   []string{"consul.service_register", "tagit.update"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: []string{"other-tag"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						return tt.registerErr
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary"), MockError: tt.scriptErr}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+
+			exporter := tracetest.NewInMemoryExporter()
+			tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			tagit.Tracer = tracerProvider.Tracer("test")
+
+			_, err = tagit.updateServiceTags()
+			assert.Equal(t, tt.scriptErr == nil && tt.registerErr == nil, err == nil)
+
+			spans := exporter.GetSpans()
+			var names []string
+			for _, span := range spans {
+				names = append(names, span.Name)
+			}
+			assert.Equal(t, tt.expectedSpans, names, "Expected the child spans to end before the update span")
+
+			update := spans[len(spans)-1]
+			assert.False(t, update.Parent.IsValid(), "Expected the update span to be the root")
+			assert.Contains(t, update.Attributes, attribute.String("tagit.service_id", "test-service"))
+			for _, span := range spans[:len(spans)-1] {
+				assert.Equal(t, update.SpanContext.SpanID(), span.Parent.SpanID(), "Expected %s to be a child of the update span", span.Name)
+				assert.Equal(t, update.SpanContext.TraceID(), span.SpanContext.TraceID())
+			}
+			for _, span := range spans {
+				if slices.Contains(tt.failedSpans, span.Name) {
+					assert.Equal(t, codes.Error, span.Status.Code, "Expected %s to fail", span.Name)
+					assert.NotEmpty(t, span.Events, "Expected %s to record the error", span.Name)
+				} else {
+					assert.Equal(t, codes.Unset, span.Status.Code, "Expected %s not to fail", span.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditMeta(t *testing.T) {
+	originalMeta := map[string]string{"owner": "team-a"}
+	currentTags := []string{"other-tag"}
+	currentMeta := originalMeta
+	registerCalled := 0
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{ID: "test-service", Tags: currentTags, Meta: currentMeta}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled++
+				currentTags = reg.Tags
+				currentMeta = reg.Meta
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary replica")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.AuditMeta = true
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tagit.now = func() time.Time { return now }
+
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"owner":            "team-a",
+		LastUpdatedMetaKey: "2024-03-01T10:00:00Z",
+		ManagedTagsMetaKey: "tag-primary,tag-replica",
+	}, currentMeta, "The audit meta should be set on the first change")
+	assert.Equal(t, map[string]string{"owner": "team-a"}, originalMeta, "The meta of the service should not be modified in place")
+
+	now = now.Add(time.Minute)
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, registerCalled, "Unchanged tags should not be registered")
+	assert.Equal(t, "2024-03-01T10:00:00Z", currentMeta[LastUpdatedMetaKey], "The audit meta should only change with the tags")
+
+	mockExecutor.MockOutput = []byte("primary")
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-03-01T10:01:00Z", currentMeta[LastUpdatedMetaKey], "The audit meta should record the new change")
+	assert.Equal(t, "tag-primary", currentMeta[ManagedTagsMetaKey])
+	assert.Equal(t, "team-a", currentMeta["owner"])
+
+	mockExecutor.MockOutput = []byte(strings.Repeat("x", 300) + " " + strings.Repeat("y", 300))
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, "tag-"+strings.Repeat("x", 300), currentMeta[ManagedTagsMetaKey], "Tags beyond the meta value limit should be left out")
+}
+
+func TestTagTemplates(t *testing.T) {
+	tests := []struct {
+		name         string
+		templates    []string
+		expectedTags []string
+		wantErr      string
+	}{
+		{
+			name:         "Meta And Fields",
+			templates:    []string{"region-{{ .Meta.region }}", "{{ .Service }}-{{ .Port }}"},
+			expectedTags: []string{"other-tag", "tag-primary", "tag-region-eu-west-1", "tag-web-8080"},
+		},
+		{
+			name:         "Empty Result Adds No Tag",
+			templates:    []string{`{{ with index .Meta "canary" }}canary{{ end }}`},
+			expectedTags: []string{"other-tag", "tag-primary"},
+		},
+		{
+			name:         "Missing Key",
+			templates:    []string{"zone-{{ .Meta.zone }}"},
+			expectedTags: []string{"other-tag"},
+			wantErr:      `error rendering tag template "zone-{{ .Meta.zone }}"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-tag"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:      "test-service",
+							Service: "web",
+							Port:    8080,
+							Tags:    currentTags,
+							Meta:    map[string]string{"region": "eu-west-1"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			for _, text := range tt.templates {
+				tmpl, err := ParseTagTemplate(text)
+				assert.NoError(t, err)
+				tagit.TagTemplates = append(tagit.TagTemplates, tmpl)
+			}
+
+			_, err = tagit.updateServiceTags()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.ErrorContains(t, err, `map has no entry for key "zone"`)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedTags, currentTags)
+		})
+	}
+
+	_, err := ParseTagTemplate("region-{{ .Meta.region")
+	assert.ErrorContains(t, err, `invalid tag template "region-{{ .Meta.region"`)
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name          string
+		replace       bool
+		preserveOrder bool
+		currentTags   []string
+		expectedTags  []string
+		expectedCalls int
+	}{
+		{
+			name:          "Diff ignores duplicated stale tags",
+			currentTags:   []string{"other-tag", "tag-primary", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary", "tag-primary"},
+			expectedCalls: 0,
+		},
+		{
+			name:          "Replace drops duplicated stale tags",
+			replace:       true,
+			currentTags:   []string{"other-tag", "tag-primary", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Replace drops all stale prefixed tags",
+			replace:       true,
+			currentTags:   []string{"tag-replica", "other-tag", "tag-old", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Replace keeps matching tags",
+			replace:       true,
+			currentTags:   []string{"other-tag", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 0,
+		},
+		{
+			name:          "Replace with preserve order drops duplicated stale tags",
+			replace:       true,
+			preserveOrder: true,
+			currentTags:   []string{"tag-primary", "other-tag", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Replace with preserve order drops all stale prefixed tags",
+			replace:       true,
+			preserveOrder: true,
+			currentTags:   []string{"tag-replica", "other-tag", "tag-old"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Replace with preserve order keeps matching tags",
+			replace:       true,
+			preserveOrder: true,
+			currentTags:   []string{"other-tag", "tag-primary"},
+			expectedTags:  []string{"other-tag", "tag-primary"},
+			expectedCalls: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := tt.currentTags
+			registerCalls := 0
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: currentTags,
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalls++
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.Replace = tt.replace
+			tagit.PreserveOrder = tt.preserveOrder
+
+			_, err = tagit.updateServiceTags()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedTags, currentTags)
+			assert.Equal(t, tt.expectedCalls, registerCalls, "Replace should update the service in a single registration")
+		})
+	}
+}
+
+func TestKVPath(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	var kvPuts []*api.KVPair
+	var putErr error
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+		MockKV: &MockKV{
+			PutFunc: func(p *api.KVPair) error {
+				kvPuts = append(kvPuts, p)
+				return putErr
+			},
+		},
+	}
+	mockExecutor := &DynamicMockExecutor{Outputs: []string{"primary", "primary", "replica", "replica"}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.KVPath = "tagit/test-service"
+
+	changed, err := tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	if assert.Len(t, kvPuts, 1, "The managed tags should be written on a change") {
+		assert.Equal(t, "tagit/test-service", kvPuts[0].Key)
+		assert.JSONEq(t, `["tag-primary"]`, string(kvPuts[0].Value))
+	}
+
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, kvPuts, 1, "Nothing should be written when the tags did not change")
+
+	putErr = fmt.Errorf("kv unavailable")
+	_, err = tagit.updateServiceTags()
+	assert.ErrorContains(t, err, "kv unavailable")
+	assert.Equal(t, []string{"other-tag", "tag-replica"}, currentTags, "The service should be updated even when the kv write fails")
+	if assert.Len(t, kvPuts, 2) {
+		assert.JSONEq(t, `["tag-replica"]`, string(kvPuts[1].Value))
+	}
+
+	putErr = nil
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	if assert.Len(t, kvPuts, 3, "The managed tags should be written again after a failed write") {
+		assert.JSONEq(t, `["tag-replica"]`, string(kvPuts[2].Value))
+	}
+
+	_, err = tagit.CleanupTags()
+	assert.NoError(t, err)
+	if assert.Len(t, kvPuts, 4, "A cleanup should clear the kv value") {
+		assert.JSONEq(t, `[]`, string(kvPuts[3].Value))
+	}
+}
+
+func TestKVPathFirstCycle(t *testing.T) {
+	var kvPuts []*api.KVPair
+	putErr := fmt.Errorf("kv unavailable")
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"other-tag", "tag-primary"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				t.Error("The service should not be registered when its tags are up to date")
+				return nil
+			},
+		},
+		MockKV: &MockKV{
+			PutFunc: func(p *api.KVPair) error {
+				kvPuts = append(kvPuts, p)
+				return putErr
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.KVPath = "tagit/test-service"
+
+	changed, err := tagit.updateServiceTags()
+	assert.ErrorContains(t, err, "error writing tags to kv tagit/test-service")
+	assert.False(t, changed)
+	assert.Len(t, kvPuts, 1, "The managed tags should be written on the first cycle even without a change")
+
+	putErr = nil
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	if assert.Len(t, kvPuts, 2, "The failed write should be retried") {
+		assert.JSONEq(t, `["tag-primary"]`, string(kvPuts[1].Value))
+	}
+
+	_, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.Len(t, kvPuts, 2, "Nothing should be written once the kv value is up to date")
+}
+
+func TestTagsOutputFile(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &DynamicMockExecutor{Outputs: []string{"primary", "primary", "replica"}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	tagit.TagsOutputFile = filepath.Join(dir, "tags.json")
+
+	readTags := func() string {
+		content, err := os.ReadFile(tagit.TagsOutputFile)
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	changed, err := tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.JSONEq(t, `["tag-primary"]`, readTags(), "The managed tags should be written on a change")
+	info, err := os.Stat(tagit.TagsOutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+
+	// Mark the file to tell whether the next cycle rewrites it
+	assert.NoError(t, os.WriteFile(tagit.TagsOutputFile, []byte("untouched"), 0o644))
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "untouched", readTags(), "Nothing should be written when the tags did not change")
+
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.JSONEq(t, `["tag-replica"]`, readTags(), "The file should be rewritten on a change")
+
+	_, err = tagit.CleanupTags()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[]`, readTags(), "A cleanup should clear the file")
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "No temporary file should be left behind")
+
+	tagit.TagsOutputFile = filepath.Join(dir, "missing", "tags.json")
+	_, err = tagit.updateServiceTags()
+	assert.ErrorContains(t, err, "service tags updated but writing them to")
+	assert.Equal(t, []string{"other-tag", "tag-primary"}, currentTags, "The service should be updated even when the file write fails")
+
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "missing"), 0o755))
+	changed, err = tagit.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.JSONEq(t, `["tag-primary"]`, readTags(), "The failed write should be retried on the next cycle")
+
+	// A new TagIt writes the file on its first cycle, even without a change
+	restarted, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	restarted.TagsOutputFile = filepath.Join(dir, "restarted.json")
+	changed, err = restarted.updateServiceTags()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	content, err := os.ReadFile(restarted.TagsOutputFile)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["tag-primary"]`, string(content), "The file should be written on the first cycle")
+}
+
+func TestProtectTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(tagit *TagIt)
+		output string
+		meta   map[string]string
+		run    func(tagit *TagIt) error
+	}{
+		{
+			name:   "Update",
+			output: "replica",
+			run:    func(tagit *TagIt) error { _, err := tagit.updateServiceTags(); return err },
+		},
+		{
+			name:   "Update Preserving Order",
+			setup:  func(tagit *TagIt) { tagit.PreserveOrder = true },
+			output: "replica",
+			run:    func(tagit *TagIt) error { _, err := tagit.updateServiceTags(); return err },
+		},
+		{
+			name:   "Replace",
+			setup:  func(tagit *TagIt) { tagit.Replace = true },
+			output: "replica",
+			run:    func(tagit *TagIt) error { _, err := tagit.updateServiceTags(); return err },
+		},
+		{
+			name:   "Empty Output",
+			output: "",
+			run:    func(tagit *TagIt) error { _, err := tagit.updateServiceTags(); return err },
+		},
+		{
+			name:   "Prefix Change",
+			output: "replica",
+			meta:   map[string]string{PrefixMetaKey: "team"},
+			run:    func(tagit *TagIt) error { _, err := tagit.updateServiceTags(); return err },
+		},
+		{
+			name: "Cleanup",
+			run: func(tagit *TagIt) error {
+				_, err := tagit.CleanupTags()
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-tag", "tag-manual", "tag-primary"}
+			var meta map[string]string
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: currentTags,
+							Meta: meta,
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte(tt.output)}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ProtectTags = []string{"tag-manual"}
+			if tt.setup != nil {
+				tt.setup(tagit)
+			}
+			if tt.meta != nil {
+				// Let the first cycle see the tag prefix, so the next one cleans up its tags
+				_, err := tagit.updateServiceTags()
+				assert.NoError(t, err)
+				meta = tt.meta
+			}
+
+			assert.NoError(t, tt.run(tagit))
+			assert.Contains(t, currentTags, "tag-manual", "The protected tag should survive")
+			assert.NotContains(t, currentTags, "tag-primary", "The unprotected managed tag should be removed")
+			assert.Contains(t, currentTags, "other-tag")
+		})
+	}
+}
+
+func TestRemoveTags(t *testing.T) {
+	tests := []struct {
+		name         string
+		preserve     bool
+		replace      bool
+		cleanup      bool
+		expectedTags []string
+	}{
+		{
+			name:         "Update",
+			expectedTags: []string{"other-tag", "tag-keep", "tag-primary"},
+		},
+		{
+			name:         "Update Preserving Order",
+			preserve:     true,
+			expectedTags: []string{"other-tag", "tag-keep", "tag-primary"},
+		},
+		{
+			name:         "Replace",
+			replace:      true,
+			expectedTags: []string{"other-tag", "tag-keep", "tag-primary"},
+		},
+		{
+			name:         "Cleanup",
+			cleanup:      true,
+			expectedTags: []string{"other-tag", "tag-keep"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"bad-tag", "other-tag", "tag-bad", "tag-keep", "tag-primary"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: currentTags,
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			// The script keeps emitting the bad tag
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary bad")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.RemoveTags = []string{"bad-tag", "tag-bad", "tag-keep"}
+			tagit.ProtectTags = []string{"tag-keep"}
+			tagit.PreserveOrder = tt.preserve
+			tagit.Replace = tt.replace
+
+			if tt.cleanup {
+				_, err = tagit.CleanupTags()
+			} else {
+				_, err = tagit.updateServiceTags()
+			}
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expectedTags, currentTags, "Protected tags should win over the tags to remove")
+		})
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	tests := []struct {
+		name         string
+		exclusive    bool
+		preserve     bool
+		cleanup      bool
+		expectedTags []string
+	}{
+		{
+			name:         "Shared",
+			expectedTags: []string{"manual", "other-tag", "tag-primary", "v1"},
+		},
+		{
+			name:         "Exclusive",
+			exclusive:    true,
+			expectedTags: []string{"manual", "tag-primary", "v1"},
+		},
+		{
+			name:         "Exclusive Preserving Order",
+			exclusive:    true,
+			preserve:     true,
+			expectedTags: []string{"manual", "v1", "tag-primary"},
+		},
+		{
+			name:         "Exclusive Cleanup Keeps Unprefixed Tags",
+			exclusive:    true,
+			cleanup:      true,
+			expectedTags: []string{"manual", "other-tag", "v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := []string{"other-tag", "manual", "v1", "tag-stale"}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: currentTags}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.Exclusive = tt.exclusive
+			tagit.PreserveOrder = tt.preserve
+			tagit.ProtectTags = []string{"manual"}
+			tagit.ExcludeTags = []string{"v*"}
+
+			if tt.cleanup {
+				_, err = tagit.CleanupTags()
+			} else {
+				_, err = tagit.updateServiceTags()
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedTags, currentTags, "Unmanaged tags should only be removed in exclusive mode")
+		})
+	}
+}
+
+func TestChangeMarker(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &DynamicMockExecutor{Outputs: []string{"primary", "primary", "replica", "replica", "primary"}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.ChangeMarker = "changed"
+
+	expected := [][]string{
+		{"other-tag", "tag-primary"},
+		{"other-tag", "tag-primary"},
+		{"other-tag", "tag-changed", "tag-replica"},
+		{"other-tag", "tag-replica"},
+		{"other-tag", "tag-changed", "tag-primary"},
+	}
+	for i, want := range expected {
+		_, err := tagit.updateServiceTags()
+		assert.NoError(t, err)
+		assert.Equal(t, want, currentTags, "Unexpected tags on cycle %d", i+1)
+	}
+}
+
+func TestPrefixFromMeta(t *testing.T) {
+	tests := []struct {
+		name            string
+		prefixes        []string
+		tags            []string
+		restart         bool
+		expected        [][]string
+		expectedManaged string
+	}{
+		{
+			name:            "Meta Prefix",
+			prefixes:        []string{"meta"},
+			tags:            []string{"other-tag", "tag-old"},
+			expected:        [][]string{{"meta-primary", "other-tag"}},
+			expectedManaged: "meta",
+		},
+		{
+			name:            "Invalid Meta Prefix",
+			prefixes:        []string{"bad prefix"},
+			tags:            []string{"other-tag", "tag-old"},
+			expected:        [][]string{{"other-tag", "tag-primary"}},
+			expectedManaged: "tag",
+		},
+		{
+			name:     "Meta Prefix Changed",
+			prefixes: []string{"first", "second"},
+			tags:     []string{"other-tag"},
+			expected: [][]string{
+				{"first-primary", "other-tag"},
+				{"other-tag", "second-primary"},
+			},
+			expectedManaged: "second",
+		},
+		{
+			name:     "Meta Prefix Changed Across Restart",
+			prefixes: []string{"first", "second"},
+			tags:     []string{"other-tag"},
+			restart:  true,
+			expected: [][]string{
+				{"first-primary", "other-tag"},
+				{"other-tag", "second-primary"},
+			},
+			expectedManaged: "second",
+		},
+		{
+			name:     "Meta Prefix Removed",
+			prefixes: []string{"meta", ""},
+			tags:     []string{"other-tag"},
+			expected: [][]string{
+				{"meta-primary", "other-tag"},
+				{"other-tag", "tag-primary"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentTags := tt.tags
+			var currentMeta map[string]string
+			cycle := 0
+			var registered [][]string
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						// The owner sets the prefix, the rest of the meta is what was registered
+						meta := maps.Clone(currentMeta)
+						if meta == nil {
+							meta = make(map[string]string)
+						}
+						if tt.prefixes[cycle] != "" {
+							meta[PrefixMetaKey] = tt.prefixes[cycle]
+						}
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: currentTags,
+							Meta: meta,
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						currentTags = reg.Tags
+						currentMeta = maps.Clone(reg.Meta)
+						delete(currentMeta, PrefixMetaKey)
+						registered = append(registered, reg.Tags)
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+
+			for cycle = range tt.prefixes {
+				if tt.restart {
+					tagit, err = New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+					assert.NoError(t, err)
+				}
+				_, err := tagit.updateServiceTags()
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, registered, "Unexpected registered tags")
+			assert.Equal(t, tt.expectedManaged, currentMeta[ManagedPrefixMetaKey], "Unexpected recorded prefix")
+		})
+	}
+
+	t.Run("Script Failure Keeps Tags", func(t *testing.T) {
+		registrations := 0
+		mockConsulClient := &MockConsulClient{
+			MockAgent: &MockAgent{
+				ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+					return &api.AgentService{
+						ID:   "test-service",
+						Tags: []string{"first-primary", "other-tag"},
+						Meta: map[string]string{PrefixMetaKey: "second", ManagedPrefixMetaKey: "first"},
+					}, nil, nil
+				},
+				ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+					registrations++
+					return nil
+				},
+			},
+		}
+		mockExecutor := &MockCommandExecutor{MockError: fmt.Errorf("script failed")}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+		assert.NoError(t, err)
+
+		_, err = tagit.updateServiceTags()
+		assert.Error(t, err)
+		assert.Zero(t, registrations, "The tags of the previous prefix should stay until the script succeeds")
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		var registeredTags []string
+		mockConsulClient := &MockConsulClient{
+			MockAgent: &MockAgent{
+				ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+					return &api.AgentService{
+						ID:   "test-service",
+						Tags: []string{"meta-primary", "other-tag", "tag-primary"},
+						Meta: map[string]string{PrefixMetaKey: "meta", ManagedPrefixMetaKey: "meta"},
+					}, nil, nil
+				},
+				ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+					registeredTags = reg.Tags
+					return nil
+				},
+			},
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, &MockCommandExecutor{}, "test-service", "", 0, "tag", logger)
+		assert.NoError(t, err)
+
+		removedTags, err := tagit.CleanupTagsDryRun(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"meta-primary"}, removedTags)
+
+		removed, err := tagit.CleanupTags()
+		assert.NoError(t, err)
+		assert.Equal(t, removedTags, removed, "Expected the cleanup to remove what the dry run listed")
+		assert.Equal(t, []string{"other-tag", "tag-primary"}, registeredTags)
+	})
+}
+
+func TestEmptyOutput(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		output       string
+		expectErr    bool
+		expectedTags []string
+	}{
+		{
+			name:         "Default Clears",
+			policy:       "",
+			output:       "",
+			expectedTags: []string{"other-tag"},
+		},
+		{
+			name:         "Clear",
+			policy:       EmptyOutputClear,
+			output:       "",
+			expectedTags: []string{"other-tag"},
+		},
+		{
+			name:         "Keep",
+			policy:       EmptyOutputKeep,
+			output:       " \n",
+			expectedTags: nil,
+		},
+		{
+			name:         "Error",
+			policy:       EmptyOutputError,
+			output:       "",
+			expectErr:    true,
+			expectedTags: nil,
+		},
+		{
+			name:         "Keep With Output",
+			policy:       EmptyOutputKeep,
+			output:       "new",
+			expectedTags: []string{"other-tag", "tag-new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var registeredTags []string
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: []string{"other-tag", "tag-old"},
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registeredTags = reg.Tags
+						return nil
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte(tt.output)}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.EmptyOutput = tt.policy
+
+			_, err = tagit.updateServiceTags()
+			if tt.expectErr {
+				assert.ErrorIs(t, err, ErrEmptyOutput)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedTags, registeredTags)
+		})
+	}
+}
+
+func TestValidateEmptyOutput(t *testing.T) {
+	for _, policy := range []string{EmptyOutputClear, EmptyOutputKeep, EmptyOutputError} {
+		assert.NoError(t, ValidateEmptyOutput(policy), "Expected %q to be valid", policy)
+	}
+	assert.Error(t, ValidateEmptyOutput(""))
+	assert.Error(t, ValidateEmptyOutput("ignore"))
+}
+
+func TestExcludeTags(t *testing.T) {
+	existingTags := []string{"other-tag", "tag-legacy-db", "tag-old"}
+	var registeredTags []string
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: existingTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registeredTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new legacy-cache")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+	tagit.ExcludeTags = []string{"tag-legacy-*"}
+
+	t.Run("Update", func(t *testing.T) {
+		registeredTags = nil
+		_, err := tagit.updateServiceTags()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"other-tag", "tag-legacy-db", "tag-new"}, registeredTags, "Excluded tags should be neither removed nor added")
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		registeredTags = nil
+		_, err := tagit.CleanupTags()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"other-tag", "tag-legacy-db"}, registeredTags, "Excluded tags should survive cleanup")
+	})
+}
+
+func TestCleanupTags(t *testing.T) {
+	tests := []struct {
+		name            string
+		serviceID       string
+		mockServices    map[string]*api.AgentService
+		tagPrefix       string
+		mockRegisterErr error
+		expectError     bool
+		expectTags      []string
+		expectRemoved   []string
+	}{
+		{
+			name:      "Successful Tag Cleanup",
+			serviceID: "test-service",
+			mockServices: map[string]*api.AgentService{
+				"test-service": {
+					ID:   "test-service",
+					Tags: []string{"tag-prefix1", "tag-prefix2", "other-tag"},
+				},
+			},
+			tagPrefix:     "tag",
+			expectError:   false,
+			expectTags:    []string{"other-tag"},
+			expectRemoved: []string{"tag-prefix1", "tag-prefix2"},
+		},
+		{
+			name:      "No Tag Cleanup needed",
+			serviceID: "test-service",
+			mockServices: map[string]*api.AgentService{
+				"test-service": {
+					ID:   "test-service",
+					Tags: []string{"prefix1", "prefix2", "other-tag"},
+				},
+			},
+			tagPrefix:   "tag",
+			expectError: false,
+			expectTags:  []string{"other-tag", "prefix1", "prefix2"},
+		},
+		{
+			name:      "Service Not Found",
+			serviceID: "non-existent-service",
+			mockServices: map[string]*api.AgentService{
+				"other-service": {
+					ID:   "other-service",
+					Tags: []string{"some-tag", "another-tag"},
+				},
+			},
+			tagPrefix:   "tag-prefix",
+			expectError: true,
+		},
+		{
+			name:      "Consul Register Error",
+			serviceID: "test-service",
+			mockServices: map[string]*api.AgentService{
+				"test-service": {
+					ID:   "test-service",
+					Tags: []string{"tag-prefix1", "other-tag"},
+				},
+			},
+			tagPrefix:       "tag",
+			mockRegisterErr: fmt.Errorf("consul register error"),
+			expectError:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						service, exists := tt.mockServices[serviceID]
+						if !exists {
+							return nil, nil, api.StatusError{Code: 404, Body: "unknown service ID: " + serviceID}
+						}
+						return service, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						if tt.mockRegisterErr != nil {
+							return tt.mockRegisterErr
+						}
+						// Update the mock service with the new tags
+						tt.mockServices[reg.ID].Tags = reg.Tags
+						return nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, nil, tt.serviceID, "", time.Duration(0), tt.tagPrefix, logger)
+			assert.NoError(t, err)
+
+			removed, err := tagit.CleanupTags()
+			if tt.expectError {
+				assert.Error(t, err)
+				assert.Nil(t, removed)
+			} else {
+				assert.NoError(t, err)
+				assert.ElementsMatch(t, tt.expectRemoved, removed, "Expected the removed tags to be the prefixed ones")
+				service, _ := tagit.getService(context.Background())
+				if service != nil {
+					actualTags := service.Tags
+					sort.Strings(actualTags)
+					sort.Strings(tt.expectTags)
+					assert.Equal(t, tt.expectTags, actualTags, "Unexpected tags after cleanup")
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupTagsDryRun(t *testing.T) {
+	registerCalled := false
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"tag-prefix1", "other-tag", "tag-legacy", "tag-prefix2"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled = true
+				return nil
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, &MockCommandExecutor{}, "test-service", "", 0, "tag", logger)
+	assert.NoError(t, err)
+	tagit.ExcludeTags = []string{"tag-legacy"}
+
+	removed, err := tagit.CleanupTagsDryRun(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tag-prefix1", "tag-prefix2"}, removed, "Unexpected tags to be removed")
+	assert.False(t, registerCalled, "ServiceRegister should not be called on a dry run")
+}
+
+func TestService(t *testing.T) {
+	registerCalled := false
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				if serviceID != "test-service" {
+					return nil, nil, api.StatusError{Code: 404, Body: "unknown service ID: " + serviceID}
+				}
+				return &api.AgentService{ID: serviceID, Tags: []string{"tag-primary"}, Meta: map[string]string{"region": "eu"}}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled = true
+				return nil
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tagit, err := New(mockConsulClient, nil, "test-service", "", 0, "tag", logger)
+	assert.NoError(t, err)
+	service, err := tagit.Service(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tag-primary"}, service.Tags)
+	assert.Equal(t, map[string]string{"region": "eu"}, service.Meta)
+	assert.False(t, registerCalled, "Service should not update the service")
+
+	tagit, err = New(mockConsulClient, nil, "missing-service", "", 0, "tag", logger)
+	assert.NoError(t, err)
+	service, err = tagit.Service(context.Background())
+	assert.ErrorContains(t, err, "error getting service")
+	assert.Nil(t, service)
+}
+
+func TestDoctor(t *testing.T) {
+	denied := api.StatusError{Code: 403, Body: "Permission denied: token lacks permission 'service:write' on \"test-service\""}
+	tests := []struct {
+		name        string
+		scriptErr   error
+		servicesErr error
+		serviceErr  error
+		registerErr error
+		readOnly    bool
+		expected    map[string]string
+	}{
+		{
+			name:     "All Pass",
+			expected: map[string]string{},
+		},
+		{
+			name:        "Read Only",
+			readOnly:    true,
+			registerErr: denied,
+			expected:    map[string]string{},
+		},
+		{
+			name:      "Script Fails",
+			scriptErr: fmt.Errorf("exit status 1"),
+			expected:  map[string]string{"script": "error running script: exit status 1"},
+		},
+		{
+			name:        "Consul Unreachable",
+			servicesErr: fmt.Errorf("connection refused"),
+			expected: map[string]string{
+				"consul":           "error reaching the consul agent: connection refused",
+				"service":          "skipped",
+				"write permission": "skipped",
+			},
+		},
+		{
+			name:       "Service Not Found",
+			serviceErr: api.StatusError{Code: 404, Body: "unknown service ID: test-service"},
+			expected: map[string]string{
+				"service":          "service not found: test-service",
+				"write permission": "skipped",
+			},
+		},
+		{
+			name:        "Write Denied",
+			registerErr: denied,
+			expected:    map[string]string{"write permission": "the consul token needs service:write on service test-service"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var registered []*api.AgentServiceRegistration
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServicesFunc: func() (map[string]*api.AgentService, error) {
+						return map[string]*api.AgentService{"test-service": {ID: "test-service"}}, tt.servicesErr
+					},
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						if tt.serviceErr != nil {
+							return nil, nil, tt.serviceErr
+						}
+						return &api.AgentService{ID: "test-service", Service: "test-service", Tags: []string{"tag-old", "other-tag"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registered = append(registered, reg)
+						return tt.registerErr
+					},
+				},
+			}
+			mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary replica"), MockError: tt.scriptErr}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+
+			checks := tagit.Doctor(context.Background(), !tt.readOnly)
+
+			names := make([]string, len(checks))
+			for i, check := range checks {
+				names[i] = check.Name
+				if expected, ok := tt.expected[check.Name]; ok {
+					assert.ErrorContains(t, check.Err, expected, "Unexpected result of check %s", check.Name)
+				} else {
+					assert.NoError(t, check.Err, "Expected check %s to pass", check.Name)
+				}
+			}
+			if tt.readOnly {
+				assert.Equal(t, []string{"script", "consul", "service"}, names)
+				assert.Empty(t, registered, "Expected nothing to be written without the write check")
+			} else {
+				assert.Equal(t, []string{"script", "consul", "service", "write permission"}, names)
+			}
+			for _, reg := range registered {
+				assert.Equal(t, []string{"tag-old", "other-tag"}, reg.Tags, "Expected the write check to keep the registered tags")
+			}
+		})
+	}
+}
+
+func TestCurrentTags(t *testing.T) {
+	tests := []struct {
+		name              string
+		tags              []string
+		meta              map[string]string
+		excludeTags       []string
+		expectedManaged   []string
+		expectedUnmanaged []string
+	}{
+		{
+			name:              "Mixed tags",
+			tags:              []string{"tag-primary", "other-tag", "tagged", "tag-port-8080"},
+			expectedManaged:   []string{"tag-primary", "tag-port-8080"},
+			expectedUnmanaged: []string{"other-tag", "tagged"},
+		},
+		{
+			name:              "Excluded tags are unmanaged",
+			tags:              []string{"tag-primary", "tag-legacy", "other-tag"},
+			excludeTags:       []string{"tag-legacy"},
+			expectedManaged:   []string{"tag-primary"},
+			expectedUnmanaged: []string{"tag-legacy", "other-tag"},
+		},
+		{
+			name:              "Prefix from meta",
+			tags:              []string{"tag-primary", "team-primary"},
+			meta:              map[string]string{PrefixMetaKey: "team"},
+			expectedManaged:   []string{"team-primary"},
+			expectedUnmanaged: []string{"tag-primary"},
+		},
+		{
+			name:              "No tags",
+			tags:              nil,
+			expectedManaged:   []string{},
+			expectedUnmanaged: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registerCalled := false
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{
+							ID:   "test-service",
+							Tags: tt.tags,
+							Meta: tt.meta,
+						}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalled = true
+						return nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{}, "test-service", "", 0, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ExcludeTags = tt.excludeTags
+
+			managed, unmanaged, err := tagit.CurrentTags(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedManaged, managed)
+			assert.Equal(t, tt.expectedUnmanaged, unmanaged)
+			assert.False(t, registerCalled, "CurrentTags should not update the service")
+		})
+	}
+}
+
+func TestCleanupTagsContext(t *testing.T) {
+	registerCalled := false
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				// Simulate a hanging Consul that only returns once the request is cancelled.
+				<-q.Context().Done()
+				return nil, nil, q.Context().Err()
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled = true
+				return nil
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, &MockCommandExecutor{}, "test-service", "", 0, "tag", logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tagit.CleanupTagsContext(ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.False(t, registerCalled, "ServiceRegister should not be called after cancellation")
+	case <-time.After(time.Second):
+		t.Fatal("CleanupTagsContext did not return after the context was cancelled")
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceCalled := atomic.Int32{}
+	registerCalled := atomic.Int32{}
+	mockExecutor := &MockCommandExecutor{
+		MockOutput: []byte("new-tag1 new-tag2"),
+		MockError:  nil,
+	}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				serviceCalled.Add(1)
+				if serviceCalled.Load() == 2 {
+					return nil, nil, fmt.Errorf("simulated error")
+				}
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"old-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled.Add(1)
+				return nil
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 100*time.Millisecond, "tag", logger)
+	assert.NoError(t, err)
+	ticker := NewMockTicker()
+	tagit.newTicker = func(d time.Duration) Ticker {
+		assert.Equal(t, 100*time.Millisecond, d, "Unexpected ticker interval")
+		return ticker
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+
+	ticker.Tick(3)
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(3), serviceCalled.Load(), "Expected one service lookup per tick")
+	assert.Equal(t, int32(2), registerCalled.Load(), "Expected a registration for every tick without error")
+	assert.True(t, ticker.stopped.Load(), "Expected the ticker to be stopped")
+}
+
+func TestRunFailFast(t *testing.T) {
+	newFailingTagIt := func(t *testing.T, failOn int32) (*TagIt, *MockTicker) {
+		serviceCalled := atomic.Int32{}
+		mockConsulClient := &MockConsulClient{
+			MockAgent: &MockAgent{
+				ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+					if serviceCalled.Add(1) == failOn {
+						return nil, nil, fmt.Errorf("simulated error")
+					}
+					return &api.AgentService{ID: "test-service"}, nil, nil
+				},
+				ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+					return nil
+				},
+			},
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", time.Hour, "tag", logger)
+		assert.NoError(t, err)
+		tagit.FailFast = true
+		ticker := NewMockTicker()
+		tagit.newTicker = func(d time.Duration) Ticker { return ticker }
+		return tagit, ticker
+	}
+
+	t.Run("First Cycle Fails", func(t *testing.T) {
+		tagit, ticker := newFailingTagIt(t, 1)
+		done := make(chan error)
+		go func() { done <- tagit.Run(context.Background()) }()
+
+		ticker.Tick(1)
+		select {
+		case err := <-done:
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "first update of service test-service failed")
+		case <-time.After(time.Second):
+			t.Fatal("Run did not return after the first cycle failed")
+		}
+	})
+
+	t.Run("Later Cycle Fails", func(t *testing.T) {
+		tagit, ticker := newFailingTagIt(t, 2)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- tagit.Run(ctx) }()
+
+		// The third tick is only picked up when Run survived the failing second cycle
+		ticker.Tick(3)
+		cancel()
+		assert.NoError(t, <-done)
+	})
+}
+
+func TestRunHistory(t *testing.T) {
+	tests := []struct {
+		name         string
+		historySize  int
+		cycles       int
+		failOn       int32
+		expectedSize int
+	}{
+		{
+			name:         "Fewer Cycles Than Size",
+			historySize:  5,
+			cycles:       3,
+			failOn:       2,
+			expectedSize: 3,
+		},
+		{
+			name:         "Caps At Size",
+			historySize:  3,
+			cycles:       7,
+			failOn:       6,
+			expectedSize: 3,
+		},
+		{
+			name:         "Default Size",
+			cycles:       DefaultHistorySize + 5,
+			failOn:       DefaultHistorySize + 5,
+			expectedSize: DefaultHistorySize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceCalled := atomic.Int32{}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						if serviceCalled.Add(1) == tt.failOn {
+							return nil, nil, fmt.Errorf("simulated error")
+						}
+						return &api.AgentService{ID: "test-service", Tags: []string{"old-tag"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						return nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("new-tag")}, "test-service", "echo test", time.Hour, "tag", logger)
+			assert.NoError(t, err)
+			tagit.HistorySize = tt.historySize
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			cycle := 0
+			tagit.now = func() time.Time { return start.Add(time.Duration(cycle) * time.Minute) }
+			assert.Empty(t, tagit.History())
+
+			for cycle = 1; cycle <= tt.cycles; cycle++ {
+				assert.NoError(t, tagit.runUpdate(context.Background(), false))
+			}
+
+			history := tagit.History()
+			assert.Len(t, history, tt.expectedSize)
+			for i, result := range history {
+				// The history holds the latest cycles, oldest first
+				n := tt.cycles - tt.expectedSize + i + 1
+				assert.Equal(t, start.Add(time.Duration(n)*time.Minute), result.Time)
+				if n == int(tt.failOn) {
+					assert.False(t, result.Changed)
+					assert.Contains(t, result.Error, "simulated error")
+				} else {
+					assert.True(t, result.Changed)
+					assert.Empty(t, result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLock(t *testing.T) {
+	t.Run("One Leader At A Time", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		type instance struct {
+			tagit      *TagIt
+			lock       *MockLock
+			ticker     *MockTicker
+			registered atomic.Int32
+		}
+		sem := make(chan struct{}, 1)
+		instances := make([]*instance, 2)
+		for i := range instances {
+			inst := &instance{lock: NewMockLock(sem), ticker: NewMockTicker()}
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: []string{"old-tag"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						inst.registered.Add(1)
+						return nil
+					},
+				},
+				LockKeyFunc: func(key string) (ConsulLock, error) {
+					assert.Equal(t, "tagit/lock/test-service", key)
+					return inst.lock, nil
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte(fmt.Sprintf("tag%d", i))}, "test-service", "echo test", time.Hour, "tag", logger)
+			assert.NoError(t, err)
+			tagit.LockKey = "tagit/lock/test-service"
+			tagit.newTicker = func(d time.Duration) Ticker { return inst.ticker }
+			inst.tagit = tagit
+			instances[i] = inst
+		}
+
+		done := make(chan error, len(instances))
+		for _, inst := range instances {
+			go func() { done <- inst.tagit.Run(ctx) }()
+		}
+
+		var leader, follower *instance
+		assert.Eventually(t, func() bool {
+			return instances[0].lock.Held() || instances[1].lock.Held()
+		}, time.Second, 5*time.Millisecond, "Expected one instance to acquire the lock")
+		leader, follower = instances[0], instances[1]
+		if follower.lock.Held() {
+			leader, follower = follower, leader
+		}
+
+		leader.ticker.Tick(1)
+		assert.Eventually(t, func() bool {
+			return leader.registered.Load() == 1
+		}, time.Second, 5*time.Millisecond, "Expected the leader to update the service")
+		assert.Equal(t, int32(0), follower.registered.Load(), "Expected the follower to stay idle")
+
+		leader.lock.Lose()
+		assert.Eventually(t, func() bool {
+			return follower.lock.Held()
+		}, time.Second, 5*time.Millisecond, "Expected the follower to take over the lost lock")
+		assert.Eventually(t, func() bool {
+			return leader.ticker.stopped.Load()
+		}, time.Second, 5*time.Millisecond, "Expected the former leader to stop updating")
+
+		follower.ticker.Tick(1)
+		assert.Eventually(t, func() bool {
+			return follower.registered.Load() == 1
+		}, time.Second, 5*time.Millisecond, "Expected the new leader to update the service")
+
+		cancel()
+		for range instances {
+			assert.NoError(t, <-done)
+		}
+		assert.False(t, follower.lock.Held(), "Expected the lock to be released when Run returns")
+	})
+
+	t.Run("Lock Creation Fails", func(t *testing.T) {
+		mockConsulClient := &MockConsulClient{
+			LockKeyFunc: func(key string) (ConsulLock, error) {
+				return nil, fmt.Errorf("invalid key")
+			},
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, &MockCommandExecutor{}, "test-service", "echo test", time.Hour, "tag", logger)
+		assert.NoError(t, err)
+		tagit.LockKey = "/"
+
+		err = tagit.Run(context.Background())
+		assert.ErrorContains(t, err, "error creating lock /: invalid key")
+	})
+}
+
+func TestTriggerUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registerCalled := atomic.Int32{}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"old-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registerCalled.Add(1)
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+	ticker := NewMockTicker()
+	tagit.newTicker = func(d time.Duration) Ticker { return ticker }
+
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+
+	tagit.TriggerUpdate()
+	assert.Eventually(t, func() bool {
+		return registerCalled.Load() == 1
+	}, time.Second, 5*time.Millisecond, "Expected a triggered update without a tick")
+
+	ticker.Tick(1)
+	tagit.TriggerUpdate()
+	assert.Eventually(t, func() bool {
+		return registerCalled.Load() == 3
+	}, time.Second, 5*time.Millisecond, "Expected the trigger to add to the ticked updates")
+
+	cancel()
+	<-done
+}
+
+func TestTriggerUpdateFromChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceCalled := atomic.Int32{}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				serviceCalled.Add(1)
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"old-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+	ticker := NewMockTicker()
+	tagit.newTicker = func(d time.Duration) Ticker { return ticker }
+
+	// A library user feeding its own channel into the TagIt
+	trigger := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		for range trigger {
+			tagit.TriggerUpdate()
+		}
+		close(forwarded)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+
+	trigger <- struct{}{}
+	assert.Eventually(t, func() bool {
+		return serviceCalled.Load() == 1
+	}, time.Second, 5*time.Millisecond, "Expected an update for the first trigger")
+
+	ticker.Tick(1)
+	assert.Eventually(t, func() bool {
+		return serviceCalled.Load() == 2
+	}, time.Second, 5*time.Millisecond, "Expected an update for the tick")
+
+	trigger <- struct{}{}
+	assert.Eventually(t, func() bool {
+		return serviceCalled.Load() == 3
+	}, time.Second, 5*time.Millisecond, "Expected an extra update for the second trigger")
+
+	close(trigger)
+	<-forwarded
+	cancel()
+	<-done
+	assert.Equal(t, int32(3), serviceCalled.Load(), "Expected one update per trigger and tick")
+}
+
+func TestOnUpdateContext(t *testing.T) {
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"old-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				return nil
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+
+	// The hook hangs until the context it was given is done
+	started := make(chan struct{})
+	tagit.OnUpdate = func(ctx context.Context, added, removed []string) {
+		close(started)
+		<-ctx.Done()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+
+	tagit.TriggerUpdate()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a hanging OnUpdate not to block Run from stopping")
+	}
+}
+
+// scheduleFunc implements the Schedule interface with a function.
+type scheduleFunc func(time.Time) time.Time
+
+func (f scheduleFunc) Next(t time.Time) time.Time { return f(t) }
+
+func TestScheduleTicker(t *testing.T) {
+	schedule, err := cron.Parse("*/15 * * * *")
+	assert.NoError(t, err)
+
+	type wait struct {
+		d  time.Duration
+		ch chan time.Time
+	}
+	now := time.Date(2024, 3, 1, 10, 7, 30, 0, time.UTC)
+	var mu sync.Mutex
+	waits := make(chan wait)
+	ticker := newScheduleTicker(schedule,
+		func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+		func(d time.Duration) <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			waits <- wait{d: d, ch: ch}
+			return ch
+		})
+	defer ticker.Stop()
+
+	expected := []time.Time{
+		time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC),
+		time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC),
+		time.Date(2024, 3, 1, 10, 45, 0, 0, time.UTC),
+	}
+	for i, tick := range expected {
+		w := <-waits
+		mu.Lock()
+		assert.Equal(t, tick.Sub(now), w.d, "Unexpected wait before tick %d", i)
+		// The first timer fires a second early, which must not repeat the tick
+		if i == 0 {
+			now = tick.Add(-time.Second)
+		} else {
+			now = tick
+		}
+		mu.Unlock()
+		w.ch <- tick
+		assert.Equal(t, tick, <-ticker.C())
+	}
+
+	ticker.Stop()
+	select {
+	case w := <-waits:
+		w.ch <- time.Time{}
+		select {
+		case <-ticker.C():
+			t.Fatal("Expected no tick after Stop")
+		case <-time.After(20 * time.Millisecond):
+		}
+	case <-time.After(time.Second):
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceCalled := atomic.Int32{}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				serviceCalled.Add(1)
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"old-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+	tagit.Schedule = scheduleFunc(func(t time.Time) time.Time { return t.Add(5 * time.Millisecond) })
+
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return serviceCalled.Load() >= 3
+	}, time.Second, 5*time.Millisecond, "Expected the schedule to drive the updates instead of the hourly interval")
+	cancel()
+	<-done
+}
+
+func TestWaitForFile(t *testing.T) {
+	newWaitingTagIt := func(t *testing.T, file string, timeout time.Duration, fileSeen *atomic.Bool) (*TagIt, *MockTicker) {
+		mockConsulClient := &MockConsulClient{
+			MockAgent: &MockAgent{
+				ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+					_, err := os.Stat(file)
+					fileSeen.Store(err == nil)
+					return &api.AgentService{ID: "test-service"}, nil, nil
+				},
+				ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+					return nil
+				},
+			},
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		tagit, err := New(mockConsulClient, &MockCommandExecutor{MockOutput: []byte("primary")}, "test-service", "echo test", time.Hour, "tag", logger)
+		assert.NoError(t, err)
+		tagit.WaitForFile = file
+		tagit.WaitForFileTimeout = timeout
+		tagit.waitPollInterval = 5 * time.Millisecond
+		ticker := NewMockTicker()
+		tagit.newTicker = func(d time.Duration) Ticker { return ticker }
+		return tagit, ticker
+	}
+
+	t.Run("File Created Later", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "ready")
+		var fileSeen atomic.Bool
+		tagit, ticker := newWaitingTagIt(t, file, 0, &fileSeen)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go tagit.Run(ctx)
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			os.WriteFile(file, nil, 0o600)
+		})
+		// The tick is only picked up once Run stopped waiting
+		ticker.Tick(1)
+		ticker.Tick(1)
+		assert.True(t, fileSeen.Load(), "Expected the first update to run after the file was created")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "never")
+		var fileSeen atomic.Bool
+		tagit, ticker := newWaitingTagIt(t, file, 20*time.Millisecond, &fileSeen)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go tagit.Run(ctx)
+
+		ticker.Tick(1)
+		ticker.Tick(1)
+		assert.False(t, fileSeen.Load(), "Expected the updates to start after the timeout")
+	})
+
+	t.Run("Cancelled While Waiting", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "never")
+		var fileSeen atomic.Bool
+		tagit, _ := newWaitingTagIt(t, file, 0, &fileSeen)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			tagit.Run(ctx)
+			close(done)
+		}()
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Run did not return after the context was cancelled")
+		}
+	})
+}
+
+func TestRunOnce(t *testing.T) {
+	currentTags := []string{"other-tag"}
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: currentTags,
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				currentTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("new-tag")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+
+	changed, err := tagit.RunOnce()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Expected the first run to change the tags")
+
+	changed, err = tagit.RunOnce()
+	assert.NoError(t, err)
+	assert.False(t, changed, "Expected no change once the tags are up to date")
+
+	mockExecutor.MockError = fmt.Errorf("script error")
+	changed, err = tagit.RunOnce()
+	assert.Error(t, err)
+	assert.False(t, changed)
+}
+
+// executorFunc adapts a function to the CommandExecutor interface.
+type executorFunc func(command string) ([]byte, error)
+
+func (f executorFunc) Execute(command string) ([]byte, error) { return f(command) }
+
+// blockingExecutor blocks in ExecuteContext until ctx is done.
+type blockingExecutor struct {
+	started chan struct{}
+}
+
+func (e *blockingExecutor) Execute(command string) ([]byte, error) {
+	return []byte("new-tag"), nil
+}
+
+func (e *blockingExecutor) ExecuteContext(ctx context.Context, command string) ([]byte, error) {
+	close(e.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRunOnceContextCancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		executor func(cancel context.CancelFunc) CommandExecutor
+	}{
+		{
+			name: "Cancelled during the script",
+			executor: func(cancel context.CancelFunc) CommandExecutor {
+				executor := &blockingExecutor{started: make(chan struct{})}
+				go func() {
+					<-executor.started
+					cancel()
+				}()
+				return executor
+			},
+		},
+		{
+			name: "Cancelled after the script",
+			executor: func(cancel context.CancelFunc) CommandExecutor {
+				// An executor without ExecuteContext cannot be interrupted,
+				// but the registration is still skipped
+				return executorFunc(func(command string) ([]byte, error) {
+					cancel()
+					return []byte("new-tag"), nil
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registerCalled := 0
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service", Tags: []string{"other-tag"}}, nil, nil
+					},
+					ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+						registerCalled++
+						return nil
+					},
+				},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, tt.executor(cancel), "test-service", "echo test", 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			tagit.ScriptBreakerThreshold = 1
+
+			done := make(chan struct{})
+			var changed bool
+			go func() {
+				defer close(done)
+				changed, err = tagit.RunOnceContext(ctx)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("RunOnceContext did not return after the context was cancelled")
+			}
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.False(t, changed)
+			assert.Equal(t, 0, registerCalled, "Expected no registration in a cancelled cycle")
+			assert.NoError(t, tagit.allowScript(), "Expected a cancelled cycle not to count as a script failure")
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	newClient := func() (ConsulClient, error) { return &MockConsulClient{MockAgent: &MockAgent{}}, nil }
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{
+			name:    "Empty Script",
+			cfg:     Config{NewClient: newClient, ServiceID: "test-service", Interval: time.Second, TagPrefix: "tag"},
+			wantErr: "script must not be empty",
+		},
+		{
+			name:    "Invalid Interval",
+			cfg:     Config{NewClient: newClient, ServiceID: "test-service", Script: "echo test", TagPrefix: "tag"},
+			wantErr: "invalid interval",
+		},
+		{
+			name:    "Invalid Prefix",
+			cfg:     Config{NewClient: newClient, ServiceID: "test-service", Script: "echo test", Interval: time.Second, TagPrefix: "bad prefix"},
+			wantErr: "invalid tag prefix",
+		},
+		{
+			name:    "No Client",
+			cfg:     Config{ServiceID: "test-service", Script: "echo test", Interval: time.Second, TagPrefix: "tag"},
+			wantErr: "consul client",
+		},
+		{
+			name: "Factory Error",
+			cfg: Config{
+				NewClient: func() (ConsulClient, error) { return nil, fmt.Errorf("connection refused") },
+				ServiceID: "test-service",
+				Script:    "echo test",
+				Interval:  time.Second,
+				TagPrefix: "tag",
+			},
+			wantErr: "error creating consul client: connection refused",
+		},
+		{
+			name:    "Empty Service ID",
+			cfg:     Config{NewClient: newClient, Script: "echo test", Interval: time.Second, TagPrefix: "tag"},
+			wantErr: "service id must not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Start(context.Background(), tt.cfg)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	t.Run("Runs Until Done", func(t *testing.T) {
+		var registeredTags atomic.Value
+		cfg := Config{
+			NewClient: func() (ConsulClient, error) {
+				return &MockConsulClient{
+					MockAgent: &MockAgent{
+						ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+							return &api.AgentService{ID: serviceID, Tags: []string{"other-tag"}}, nil, nil
+						},
+						ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+							registeredTags.Store(reg.Tags)
+							return nil
+						},
+					},
+				}, nil
+			},
+			Executor:  &MockCommandExecutor{MockOutput: []byte("primary")},
+			ServiceID: "test-service",
+			Script:    "echo test",
+			Interval:  10 * time.Millisecond,
+			TagPrefix: "tag",
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- Start(ctx, cfg) }()
+
+		assert.Eventually(t, func() bool {
+			tags, _ := registeredTags.Load().([]string)
+			return assert.ObjectsAreEqual([]string{"other-tag", "tag-primary"}, tags)
+		}, time.Second, 5*time.Millisecond, "Expected Start to tag the service")
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Start did not return after the context was cancelled")
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	var registeredTags atomic.Value
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{
+					ID:   "test-service",
+					Tags: []string{"other-tag"},
+				}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registeredTags.Store(reg.Tags)
+				return nil
+			},
+		},
+	}
+	mockExecutor := &MockCommandExecutor{MockOutput: []byte("primary")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, mockExecutor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tagit.Run(ctx)
+
+	err = tagit.Reload("echo reloaded", "reloaded", 10*time.Millisecond)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		tags, _ := registeredTags.Load().([]string)
+		return assert.ObjectsAreEqual([]string{"other-tag", "reloaded-primary"}, tags)
+	}, time.Second, 5*time.Millisecond, "Expected updates to use the reloaded prefix and interval")
+
+	err = tagit.Reload("echo test", "tag", 0)
+	assert.Error(t, err, "Reload should reject a non-positive interval")
+
+	err = tagit.Reload("echo test", "bad prefix", time.Second)
+	assert.Error(t, err, "Reload should reject an invalid prefix")
+}
+
+func TestReloadDuringUpdate(t *testing.T) {
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{ID: "test-service"}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				return nil
+			},
+		},
+	}
+	executor := &blockingExecutor{started: make(chan struct{})}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, executor, "test-service", "echo test", time.Hour, "tag", logger)
+	assert.NoError(t, err)
+	tagit.newTicker = func(d time.Duration) Ticker { return NewMockTicker() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tagit.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	tagit.TriggerUpdate()
+	<-executor.started
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- tagit.Reload("echo reloaded", "reloaded", time.Minute)
+	}()
+	select {
+	case err := <-reloaded:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected Reload not to wait for the update in progress")
+	}
+}
+
+func TestNewConsulAPIWrapper(t *testing.T) {
+	consulClient, err := api.NewClient(api.DefaultConfig())
+	assert.NoError(t, err, "Failed to create Consul client")
+
+	wrapper := NewConsulAPIWrapper(consulClient)
+
+	assert.NotNil(t, wrapper, "NewConsulAPIWrapper returned nil")
+
+	_, isConsulClient := interface{}(wrapper).(ConsulClient)
+	assert.True(t, isConsulClient, "NewConsulAPIWrapper does not implement ConsulClient interface")
+
+	_, isConsulAgent := wrapper.Agent().(ConsulAgent)
+	assert.True(t, isConsulAgent, "Wrapper's Agent method does not return a ConsulAgent")
+}
+
+func TestCmdExecutor_Execute(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		wantOutput  string
+		wantErr     string
+		expectError bool
+	}{
+		{
+			name:        "Valid command",
+			command:     "echo test",
+			wantOutput:  "test\n",
+			expectError: false,
+		},
+		{
+			name:        "Empty command",
+			command:     "",
+			wantErr:     "failed to execute: empty command",
+			expectError: true,
+		},
+		{
+			name:        "Command with unclosed quote",
+			command:     "echo \"unclosed quote",
+			wantErr:     "failed to split command:",
+			expectError: true,
+		},
+		{
+			name:        "Output at the default limit",
+			command:     fmt.Sprintf("head -c %d /dev/zero", DefaultMaxOutputBytes),
+			wantOutput:  string(make([]byte, DefaultMaxOutputBytes)),
+			expectError: false,
+		},
+		{
+			name:        "Output over the default limit",
+			command:     fmt.Sprintf("head -c %d /dev/zero", DefaultMaxOutputBytes+1),
+			wantErr:     fmt.Sprintf("failed to execute: output exceeds %d bytes", DefaultMaxOutputBytes),
+			expectError: true,
+		},
+		{
+			name:        "Invalid command",
+			command:     "invalidcommand",
+			wantErr:     "exec: \"invalidcommand\": executable file not found in $PATH",
 			expectError: true,
 		},
 	}
@@ -661,3 +4659,328 @@ func TestCmdExecutor_Execute(t *testing.T) {
 		})
 	}
 }
+
+func TestCmdExecutor_MaxOutputBytes(t *testing.T) {
+	executor := &CmdExecutor{MaxOutputBytes: 16}
+
+	output, err := executor.Execute("echo short")
+	assert.NoError(t, err)
+	assert.Equal(t, "short\n", string(output))
+
+	// yes never stops on its own, so the limit must also end the process
+	output, err = executor.Execute("yes this-is-a-long-line")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute: output exceeds 16 bytes")
+	assert.Nil(t, output)
+
+	_, err = executor.Execute("sh -c 'echo oops >&2; exit 3'")
+	var exitErr *exec.ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, "oops\n", string(exitErr.Stderr), "Expected stderr to be kept on the exit error")
+}
+
+func TestCmdExecutor_ExecuteContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	output, err := (&CmdExecutor{Timeout: time.Minute}).ExecuteContext(ctx, "sleep 10")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrScriptTimeout, "Expected a cancelled context not to be reported as a script timeout")
+	assert.Nil(t, output)
+	assert.Less(t, time.Since(start), 5*time.Second, "Expected the command to be killed when the context is done")
+}
+
+// childCountingContext is a parent context that is never done and counts the
+// children registered through AfterFunc that were not released yet.
+type childCountingContext struct {
+	context.Context
+	done     chan struct{}
+	children atomic.Int64
+}
+
+func (c *childCountingContext) Done() <-chan struct{} { return c.done }
+
+func (c *childCountingContext) AfterFunc(f func()) func() bool {
+	c.children.Add(1)
+	var once sync.Once
+	return func() bool {
+		once.Do(func() { c.children.Add(-1) })
+		return true
+	}
+}
+
+func TestCmdExecutor_ReleasesContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{name: "Without Timeout"},
+		{name: "With Timeout", timeout: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := &childCountingContext{Context: context.Background(), done: make(chan struct{})}
+			executor := &CmdExecutor{Timeout: tt.timeout}
+			for range 20 {
+				_, err := executor.ExecuteContext(parent, "echo hi")
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, int64(0), parent.children.Load(), "Expected every run to release its context")
+		})
+	}
+}
+
+func TestCmdExecutor_Grandchild(t *testing.T) {
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		// sleep is a child of the shell, holding its output open
+		output, err := (&CmdExecutor{Timeout: 100 * time.Millisecond}).Execute("sh -c 'sleep 5; echo hi'")
+		assert.ErrorIs(t, err, ErrScriptTimeout)
+		assert.Nil(t, output)
+		assert.Less(t, time.Since(start), 3*time.Second, "Expected the timeout to kill the children of the shell")
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		output, err := (&CmdExecutor{}).ExecuteContext(ctx, "sh -c 'sleep 5; echo hi'")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Nil(t, output)
+		assert.Less(t, time.Since(start), 3*time.Second, "Expected the cancellation to kill the children of the shell")
+	})
+
+	t.Run("Background Child", func(t *testing.T) {
+		start := time.Now()
+		output, err := (&CmdExecutor{}).Execute("sh -c 'sleep 5 & echo hi'")
+		assert.NoError(t, err)
+		assert.Equal(t, "hi\n", string(output))
+		assert.Less(t, time.Since(start), 3*time.Second, "Expected a child left behind not to block the output")
+	})
+}
+
+func TestStdinExecutor(t *testing.T) {
+	executor := &StdinExecutor{Reader: bytes.NewBufferString("db cache\n")}
+
+	var registeredTags []string
+	mockConsulClient := &MockConsulClient{
+		MockAgent: &MockAgent{
+			ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+				return &api.AgentService{ID: serviceID, Tags: []string{"other-tag"}}, nil, nil
+			},
+			ServiceRegisterFunc: func(reg *api.AgentServiceRegistration) error {
+				registeredTags = reg.Tags
+				return nil
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tagit, err := New(mockConsulClient, executor, "test-service", "-", 30*time.Second, "tag", logger)
+	assert.NoError(t, err)
+
+	changed, err := tagit.RunOnce()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{"other-tag", "tag-cache", "tag-db"}, registeredTags)
+
+	output, err := executor.Execute("-")
+	assert.NoError(t, err)
+	assert.Equal(t, "db cache\n", string(output), "Expected later calls to return the same input")
+
+	t.Run("Too Large", func(t *testing.T) {
+		executor := &StdinExecutor{Reader: bytes.NewBufferString("db cache"), MaxOutputBytes: 4}
+		_, err := executor.Execute("-")
+		assert.ErrorContains(t, err, "input exceeds 4 bytes")
+	})
+}
+
+func TestHTTPExecutor_Execute(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tags":
+			fmt.Fprint(w, "primary\nzone-a\n")
+		case "/large":
+			fmt.Fprint(w, strings.Repeat("a", 32))
+		case "/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		default:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		url           string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "Tags",
+			url:      server.URL + "/tags",
+			expected: "primary\nzone-a\n",
+		},
+		{
+			name:          "Error Status",
+			url:           server.URL + "/broken",
+			expectedError: "unexpected status 500 Internal Server Error",
+		},
+		{
+			name:          "Response Too Large",
+			url:           server.URL + "/large",
+			expectedError: "response exceeds 16 bytes",
+		},
+		{
+			name:          "Timeout",
+			url:           server.URL + "/slow",
+			expectedError: "context deadline exceeded",
+		},
+		{
+			name:          "Empty URL",
+			url:           "",
+			expectedError: "empty url",
+		},
+	}
+
+	executor := &HTTPExecutor{Timeout: 100 * time.Millisecond, MaxOutputBytes: 16}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := executor.Execute(tt.url)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				assert.Nil(t, output)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(output))
+		})
+	}
+}
+
+func TestCmdExecutor_Env(t *testing.T) {
+	t.Setenv("TAGIT_TEST_INHERITED", "inherited")
+	t.Setenv("TAGIT_TEST_ROLE", "replica")
+
+	executor := &CmdExecutor{Env: map[string]string{
+		"TAGIT_TEST_ROLE": "primary",
+		"TAGIT_TEST_ZONE": "zone a",
+	}}
+	output, err := executor.Execute(`sh -c 'echo "$TAGIT_TEST_ROLE,$TAGIT_TEST_ZONE,$TAGIT_TEST_INHERITED"'`)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary,zone a,inherited\n", string(output), "Expected the variables to be merged onto the process environment")
+}
+
+func TestCheckScript(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "tags.sh")
+	assert.NoError(t, os.WriteFile(executable, []byte("#!/bin/sh\necho primary\n"), 0o755))
+	notExecutable := filepath.Join(dir, "tags.txt")
+	assert.NoError(t, os.WriteFile(notExecutable, []byte("primary\n"), 0o644))
+
+	tests := []struct {
+		name    string
+		command string
+		wantErr error
+	}{
+		{name: "Valid file", command: executable + " --role"},
+		{name: "Missing file", command: filepath.Join(dir, "missing.sh"), wantErr: ErrScriptNotFound},
+		{name: "Non-executable file", command: notExecutable, wantErr: ErrScriptNotExecutable},
+		{name: "Directory", command: dir, wantErr: ErrScriptNotExecutable},
+		{name: "Shell command", command: "sh -c 'echo primary'"},
+		{name: "Name looked up in PATH", command: "invalidcommand"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckScript(tt.command)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCmdExecutor_Errors(t *testing.T) {
+	missingScript := filepath.Join(t.TempDir(), "missing.sh")
+
+	tests := []struct {
+		name     string
+		executor *CmdExecutor
+		command  string
+		check    func(t *testing.T, err error)
+	}{
+		{
+			name:     "Not in PATH",
+			executor: &CmdExecutor{},
+			command:  "invalidcommand",
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrScriptNotFound)
+				assert.ErrorIs(t, err, exec.ErrNotFound)
+			},
+		},
+		{
+			name:     "Missing path",
+			executor: &CmdExecutor{},
+			command:  missingScript,
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrScriptNotFound)
+			},
+		},
+		{
+			name:     "Timeout",
+			executor: &CmdExecutor{Timeout: 50 * time.Millisecond},
+			command:  "sleep 5",
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrScriptTimeout)
+				var exitErr *ScriptExitError
+				assert.False(t, errors.As(err, &exitErr), "A timeout should not be reported as an exit")
+			},
+		},
+		{
+			name:     "Non-zero exit",
+			executor: &CmdExecutor{},
+			command:  "sh -c 'echo oops >&2; exit 3'",
+			check: func(t *testing.T, err error) {
+				var exitErr *ScriptExitError
+				if assert.ErrorAs(t, err, &exitErr) {
+					assert.Equal(t, 3, exitErr.Code)
+					assert.Equal(t, "oops\n", string(exitErr.Stderr))
+				}
+				assert.ErrorContains(t, err, "script exited with code 3")
+				assert.NotErrorIs(t, err, ErrScriptNotFound)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.executor.Execute(tt.command)
+			assert.Error(t, err)
+			tt.check(t, err)
+
+			// The error must survive the wrapping of an update cycle
+			mockConsulClient := &MockConsulClient{
+				MockAgent: &MockAgent{
+					ServiceFunc: func(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+						return &api.AgentService{ID: "test-service"}, nil, nil
+					},
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			tagit, err := New(mockConsulClient, tt.executor, "test-service", tt.command, 30*time.Second, "tag", logger)
+			assert.NoError(t, err)
+			_, err = tagit.updateServiceTags()
+			assert.ErrorContains(t, err, "error running script")
+			tt.check(t, err)
+		})
+	}
+}
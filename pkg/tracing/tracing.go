@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// TracerName is the name of the tracer of tagit.
+const TracerName = "github.com/ncode/tagit"
+
+// tracesPath is where OTLP/HTTP collectors receive the spans.
+const tracesPath = "/v1/traces"
+
+// NewTracerProvider returns a tracer provider batching the spans to the
+// OTLP/HTTP collector at endpoint, such as http://localhost:4318. The spans
+// are reported under the tagit service name. Shutdown flushes the spans left.
+func NewTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	url, err := tracesURL(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(url))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otel exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "tagit"))),
+	), nil
+}
+
+// tracesURL returns the URL the spans are sent to for endpoint, adding the
+// /v1/traces path unless endpoint already ends with it.
+func tracesURL(endpoint string) (string, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return "", fmt.Errorf("invalid otel endpoint %q: must start with http:// or https://", endpoint)
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, tracesPath) {
+		url += tracesPath
+	}
+	return url, nil
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracesURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		url      string
+		wantErr  string
+	}{
+		{name: "Collector address", endpoint: "http://localhost:4318", url: "http://localhost:4318/v1/traces"},
+		{name: "Trailing slash", endpoint: "https://collector:4318/", url: "https://collector:4318/v1/traces"},
+		{name: "Full URL", endpoint: "http://localhost:4318/v1/traces", url: "http://localhost:4318/v1/traces"},
+		{name: "Missing scheme", endpoint: "localhost:4318", wantErr: "must start with http:// or https://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := tracesURL(tt.endpoint)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.url, url)
+		})
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	var (
+		path        string
+		contentType string
+		body        []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	tracerProvider, err := NewTracerProvider(server.URL)
+	assert.NoError(t, err)
+	tracer := tracerProvider.Tracer(TracerName)
+
+	ctx, parent := tracer.Start(context.Background(), "tagit.update")
+	_, child := tracer.Start(ctx, "consul.service_register", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("tagit.service_id", "web")))
+	child.End()
+	parent.End()
+	assert.NoError(t, tracerProvider.Shutdown(context.Background()), "Expected the spans left to be flushed")
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "application/x-protobuf", contentType)
+
+	var req coltracepb.ExportTraceServiceRequest
+	assert.NoError(t, proto.Unmarshal(body, &req))
+	assert.Len(t, req.ResourceSpans, 1)
+	assert.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal(t, "tagit", req.ResourceSpans[0].Resource.Attributes[0].Value.GetStringValue())
+	assert.Len(t, req.ResourceSpans[0].ScopeSpans, 1)
+	assert.Equal(t, TracerName, req.ResourceSpans[0].ScopeSpans[0].Scope.Name)
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "consul.service_register", spans[0].Name)
+	assert.Equal(t, spans[1].SpanId, spans[0].ParentSpanId)
+	assert.Equal(t, "tagit.service_id", spans[0].Attributes[0].Key)
+}
+
+func TestNewTracerProviderInvalidEndpoint(t *testing.T) {
+	_, err := NewTracerProvider("localhost:4318")
+	assert.ErrorContains(t, err, "must start with http:// or https://")
+}